@@ -0,0 +1,241 @@
+// Package api holds the JSON request and response types of the PiFi REST API, shared by the handlers and the client.
+package api
+
+import (
+	"time"
+
+	"github.com/ztkent/pifi/networkmanager"
+)
+
+// Response wraps every API response. Failed responses carry a human readable Error and, on /api/v1, a stable Code.
+// Details holds a *networkmanager.ConnectionError when a network could not be saved or connected,
+// a *networkmanager.EnvValidationError when a value doesn't match the environment schema,
+// the EnvBatchResult of the changes applied before a batch of environment changes failed,
+// and the BackupRestoreResult of what was restored before a restore failed.
+type Response struct {
+	Success bool        `json:"success"`
+	Data    interface{} `json:"data,omitempty"`
+	Error   string      `json:"error,omitempty"`
+	Code    string      `json:"code,omitempty"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// Error codes returned in Response.Code. They are part of the API contract, messages may change.
+const (
+	CodeInvalidRequest    = "invalid_request"
+	CodeMissingParameter  = "missing_parameter"
+	CodeInvalidParameter  = "invalid_parameter"
+	CodeUnauthorized      = "unauthorized"
+	CodeInvalidToken      = "invalid_token"
+	CodeInsufficientScope = "insufficient_scope"
+	CodeCrossOrigin       = "cross_origin"
+	CodeNotFound          = "not_found"
+	CodeOperationFailed   = "operation_failed"
+	CodeEnvPassword       = "env_password_required"
+	CodeInvalidValue      = "invalid_value"
+	CodeConflict          = "conflict"
+)
+
+// EnvPasswordHeader carries the environment password on /api/v1/env requests that aren't authenticated by a token
+const EnvPasswordHeader = "X-PiFi-Env-Password"
+
+// ErrorCodes lists every code in Response.Code, including the networkmanager.Failure* codes of connection errors
+var ErrorCodes = append([]string{
+	CodeInvalidRequest, CodeMissingParameter, CodeInvalidParameter,
+	CodeUnauthorized, CodeInvalidToken, CodeInsufficientScope, CodeCrossOrigin,
+	CodeNotFound, CodeOperationFailed, CodeEnvPassword, CodeInvalidValue, CodeConflict,
+}, networkmanager.FailureCodes...)
+
+type ModeRequest struct {
+	Mode string `json:"mode"`
+}
+
+type ModeResponse struct {
+	Mode string `json:"mode"`
+}
+
+// NetworkSettings is the body of PUT /api/v1/networks/{ssid}
+type NetworkSettings struct {
+	Password    string `json:"password,omitempty"`
+	AutoConnect bool   `json:"autoConnect,omitempty"`
+}
+
+// AutoConnectSettings is the body of PATCH /api/v1/networks/{ssid}
+type AutoConnectSettings struct {
+	AutoConnect *bool `json:"autoConnect"`
+}
+
+type SSIDRequest struct {
+	SSID string `json:"ssid"`
+}
+
+type ModifyNetworkRequest struct {
+	SSID        string `json:"ssid"`
+	Password    string `json:"password"`
+	AutoConnect bool   `json:"autoConnect"`
+}
+
+type AutoConnectRequest struct {
+	SSID        string `json:"ssid"`
+	AutoConnect bool   `json:"autoConnect"`
+}
+
+type AvailableNetworksResponse struct {
+	Networks []string `json:"networks"`
+}
+
+type ConfiguredNetworksResponse struct {
+	Connections []networkmanager.ConnectionInfo `json:"connections"`
+}
+
+// NetworkResult is returned by the routes that change a saved network
+type NetworkResult struct {
+	SSID        string `json:"ssid"`
+	Status      string `json:"status"`
+	AutoConnect *bool  `json:"autoConnect,omitempty"`
+}
+
+// SecretMask replaces the value of secret environment variables in responses
+const SecretMask = networkmanager.SecretMask
+
+// EnvVariablesResponse lists the managed environment variables, the values of secrets are masked
+type EnvVariablesResponse struct {
+	Variables map[string]string `json:"variables"`
+	Secrets   []string          `json:"secrets,omitempty"`
+	// Targets of the variables not written to /etc/environment or with dependent units
+	Targets map[string]networkmanager.EnvTarget `json:"targets,omitempty"`
+	// Missing lists the variables the environment schema requires that aren't set
+	Missing []string `json:"missing,omitempty"`
+	// Provenance of every managed variable, with the values of secrets in drift masked
+	Provenance map[string]networkmanager.EnvProvenance `json:"provenance,omitempty"`
+}
+
+// EnvSchemaResponse is the environment schema with the required variables that aren't set
+type EnvSchemaResponse struct {
+	Strict    bool                          `json:"strict"`
+	Variables []networkmanager.EnvSchemaVar `json:"variables"`
+	Missing   []string                      `json:"missing,omitempty"`
+}
+
+// EnvVariable is one managed environment variable, its value is masked if it is a secret.
+// After a change, Units reports the units that were restarted or reloaded, a failed unit doesn't fail the request.
+type EnvVariable struct {
+	Key        string                        `json:"key"`
+	Value      string                        `json:"value"`
+	Secret     bool                          `json:"secret,omitempty"`
+	Target     *networkmanager.EnvTarget     `json:"target,omitempty"`
+	Provenance *networkmanager.EnvProvenance `json:"provenance,omitempty"`
+	Units      []networkmanager.UnitResult   `json:"units,omitempty"`
+}
+
+// EnvValue is the body of PUT /api/v1/env/{key}
+type EnvValue struct {
+	Value  string `json:"value"`
+	Secret bool   `json:"secret,omitempty"`
+}
+
+// EnvBatchRequest sets and unsets several environment variables in one request, unsets are applied after sets.
+// Keys of Set listed in Secrets are stored as secrets.
+type EnvBatchRequest struct {
+	Set     map[string]string `json:"set,omitempty"`
+	Secrets []string          `json:"secrets,omitempty"`
+	Unset   []string          `json:"unset,omitempty"`
+}
+
+// EnvBatchResult lists the keys a batch request changed, in the order they were applied,
+// and the units restarted or reloaded once for all of them
+type EnvBatchResult struct {
+	Set   []string                    `json:"set"`
+	Unset []string                    `json:"unset"`
+	Units []networkmanager.UnitResult `json:"units,omitempty"`
+}
+
+// EnvImportRequest imports a .env file. Mode "merge", the default, adds and changes variables,
+// "replace" also removes the managed variables missing from the file, except secrets.
+// To apply, Base must be the base of the preview, and changed variables listed in Keep keep their current value.
+type EnvImportRequest struct {
+	Content string   `json:"content"`
+	Mode    string   `json:"mode,omitempty"`
+	Keep    []string `json:"keep,omitempty"`
+	Base    string   `json:"base,omitempty"`
+}
+
+// EnvImportPreview is what an import would change, the values of secrets are masked.
+// Base identifies the current variables, the import is refused if they change before it is applied.
+type EnvImportPreview struct {
+	networkmanager.EnvDiff
+	Ignored []string `json:"ignored,omitempty"` // Lines that are neither assignments nor comments
+	Base    string   `json:"base"`
+}
+
+// EnvRollbackRequest rolls the variables back to their values right after Revision.
+// With a Key only that variable is rolled back.
+type EnvRollbackRequest struct {
+	Revision int    `json:"revision"`
+	Key      string `json:"key,omitempty"`
+}
+
+// EnvRollbackResult lists the variables a rollback changed, the secrets it couldn't restore,
+// and the units restarted or reloaded
+type EnvRollbackResult struct {
+	networkmanager.EnvRollback
+	Units []networkmanager.UnitResult `json:"units,omitempty"`
+}
+
+// BackupRequest downloads a backup of the device, encrypted if Passphrase isn't empty
+type BackupRequest struct {
+	Passphrase string `json:"passphrase,omitempty"`
+}
+
+// BackupRestoreRequest previews or restores a backup file, Passphrase is required for encrypted backups
+type BackupRestoreRequest struct {
+	Backup     string `json:"backup"`
+	Passphrase string `json:"passphrase,omitempty"`
+}
+
+// BackupPreview is what restoring a backup changes. Restoring only adds and updates, passwords
+// and the values of secrets are left out.
+type BackupPreview struct {
+	CreatedAt time.Time               `json:"createdAt"`
+	Hostname  string                  `json:"hostname,omitempty"`
+	Networks  []BackupNetworkChange   `json:"networks"`
+	Env       *networkmanager.EnvDiff `json:"env,omitempty"`
+	Config    string                  `json:"config,omitempty"`  // "changed" or "unchanged", empty if the backup has none
+	Skipped   []string                `json:"skipped,omitempty"` // Parts of the backup this device doesn't restore, as they are disabled
+}
+
+// BackupNetworkChange is a saved network of a backup, Action is "add", "update" or "unchanged"
+type BackupNetworkChange struct {
+	SSID   string `json:"ssid"`
+	Action string `json:"action"`
+}
+
+// BackupRestoreResult lists what a restore changed. A restored config takes effect when PiFi restarts.
+type BackupRestoreResult struct {
+	Networks []string                    `json:"networks"`
+	Env      []string                    `json:"env"`
+	Config   bool                        `json:"config"`
+	Units    []networkmanager.UnitResult `json:"units,omitempty"`
+}
+
+// DesiredChange is a difference between the desired state file and the device. Network passwords
+// are never shown, the values of secrets are masked.
+type DesiredChange struct {
+	Kind   string   `json:"kind"`             // "network", "ap" or "env"
+	Name   string   `json:"name"`             // SSID, AP setting or variable
+	Action string   `json:"action"`           // "add", "update" or "remove"
+	Fields []string `json:"fields,omitempty"` // Settings of a network that differ
+	Old    string   `json:"old,omitempty"`
+	New    string   `json:"new,omitempty"`
+}
+
+// DesiredStateStatus is the drift of the device from the desired state file, and the last reconcile
+type DesiredStateStatus struct {
+	File          string                      `json:"file"`
+	Drift         []DesiredChange             `json:"drift"` // What reconciling now would change
+	Watching      bool                        `json:"watching"`
+	LastReconcile *time.Time                  `json:"lastReconcile,omitempty"`
+	LastApplied   []DesiredChange             `json:"lastApplied"` // Made by the last reconcile, also if it failed
+	LastError     string                      `json:"lastError,omitempty"`
+	Units         []networkmanager.UnitResult `json:"units,omitempty"` // Restarted by the last reconcile
+}
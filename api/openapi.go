@@ -0,0 +1,283 @@
+package api
+
+import (
+	"encoding"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ztkent/pifi/networkmanager"
+)
+
+// Version is the version of the API served under /api/v1
+const Version = "1.0.0"
+
+// Endpoint describes one route of the versioned API. The server registers its routes and
+// generates the OpenAPI document from the same list, so the two can't drift apart.
+type Endpoint struct {
+	Method  string
+	Path    string // relative to /api/v1, with {name} path parameters
+	Summary string
+	Scope   string   // token scope required, empty for public routes
+	Headers []string // optional request headers
+	// Request and Response are zero values of the JSON body types, nil when there is no body
+	Request  interface{}
+	Response interface{}
+	// Raw endpoints answer with the bare body instead of wrapping it in a Response
+	Raw bool
+	// Connects is set for routes that fail with a networkmanager.ConnectionError in Response.Details
+	Connects bool
+}
+
+// OpenAPI is an OpenAPI 3 document, limited to the parts PiFi uses
+type OpenAPI struct {
+	OpenAPI    string                          `json:"openapi"`
+	Info       OpenAPIInfo                     `json:"info"`
+	Servers    []OpenAPIServer                 `json:"servers"`
+	Paths      map[string]map[string]Operation `json:"paths"`
+	Components OpenAPIComponents               `json:"components"`
+	Security   []map[string][]string           `json:"security,omitempty"`
+}
+
+type OpenAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type OpenAPIServer struct {
+	URL string `json:"url"`
+}
+
+type OpenAPIComponents struct {
+	Schemas         map[string]Schema         `json:"schemas"`
+	SecuritySchemes map[string]SecurityScheme `json:"securitySchemes"`
+}
+
+type SecurityScheme struct {
+	Type   string `json:"type"`
+	Scheme string `json:"scheme"`
+}
+
+type Operation struct {
+	Summary     string                `json:"summary"`
+	OperationID string                `json:"operationId"`
+	Parameters  []Parameter           `json:"parameters,omitempty"`
+	RequestBody *RequestBody          `json:"requestBody,omitempty"`
+	Responses   map[string]Reply      `json:"responses"`
+	Security    []map[string][]string `json:"security,omitempty"`
+	Scope       string                `json:"x-pifi-scope,omitempty"`
+}
+
+type Parameter struct {
+	Name     string `json:"name"`
+	In       string `json:"in"`
+	Required bool   `json:"required"`
+	Schema   Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                 `json:"required"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+type Reply struct {
+	Description string               `json:"description"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+type MediaType struct {
+	Schema Schema `json:"schema"`
+}
+
+// Schema is a JSON schema object
+type Schema map[string]interface{}
+
+var pathParam = regexp.MustCompile(`\{([a-zA-Z]+)\}`)
+
+// NewOpenAPI generates the OpenAPI document for the endpoints, served below serverURL
+func NewOpenAPI(serverURL string, endpoints []Endpoint) OpenAPI {
+	schemas := map[string]Schema{}
+	doc := OpenAPI{
+		OpenAPI: "3.0.3",
+		Info:    OpenAPIInfo{Title: "PiFi API", Version: Version},
+		Servers: []OpenAPIServer{{URL: serverURL}},
+		Paths:   map[string]map[string]Operation{},
+		Components: OpenAPIComponents{
+			Schemas:         schemas,
+			SecuritySchemes: map[string]SecurityScheme{"bearer": {Type: "http", Scheme: "bearer"}},
+		},
+	}
+
+	schemas["Error"] = Schema{
+		"type":     "object",
+		"required": []string{"success", "error", "code"},
+		"properties": map[string]Schema{
+			"success": {"type": "boolean", "enum": []bool{false}},
+			"error":   {"type": "string"},
+			"code":    {"type": "string", "enum": ErrorCodes},
+			"details": {"oneOf": []Schema{
+				schemaFor(reflect.TypeOf(networkmanager.ConnectionError{}), schemas),
+				schemaFor(reflect.TypeOf(EnvBatchResult{}), schemas),
+			}},
+		},
+	}
+	errorReply := func(description string) Reply {
+		return Reply{
+			Description: description,
+			Content:     map[string]MediaType{"application/json": {Schema: Schema{"$ref": "#/components/schemas/Error"}}},
+		}
+	}
+
+	for _, e := range endpoints {
+		op := Operation{
+			Summary:     e.Summary,
+			OperationID: operationID(e.Method, e.Path),
+			Responses:   map[string]Reply{},
+			Scope:       e.Scope,
+		}
+		for _, match := range pathParam.FindAllStringSubmatch(e.Path, -1) {
+			op.Parameters = append(op.Parameters, Parameter{Name: match[1], In: "path", Required: true, Schema: Schema{"type": "string"}})
+		}
+		for _, header := range e.Headers {
+			op.Parameters = append(op.Parameters, Parameter{Name: header, In: "header", Schema: Schema{"type": "string"}})
+		}
+		if e.Request != nil {
+			op.RequestBody = &RequestBody{
+				Required: true,
+				Content:  map[string]MediaType{"application/json": {Schema: schemaFor(reflect.TypeOf(e.Request), schemas)}},
+			}
+			op.Responses["400"] = errorReply("Invalid request")
+		}
+
+		var data Schema
+		if e.Response != nil {
+			data = schemaFor(reflect.TypeOf(e.Response), schemas)
+		}
+		body := data
+		if !e.Raw {
+			properties := map[string]Schema{"success": {"type": "boolean", "enum": []bool{true}}}
+			if data != nil {
+				properties["data"] = data
+			}
+			body = Schema{"type": "object", "required": []string{"success"}, "properties": properties}
+		}
+		ok := Reply{Description: "OK"}
+		if body != nil {
+			ok.Content = map[string]MediaType{"application/json": {Schema: body}}
+		}
+		op.Responses["200"] = ok
+
+		if e.Scope != "" {
+			op.Security = []map[string][]string{{"bearer": {}}}
+			op.Responses["401"] = errorReply("Missing or invalid token")
+			op.Responses["403"] = errorReply("Token lacks the " + e.Scope + " scope, or the request came from another origin")
+		}
+		op.Responses["500"] = errorReply("NetworkManager failed")
+		if e.Connects {
+			op.Responses["422"] = errorReply("The network could not be saved or connected, details explains why")
+			op.Responses["503"] = errorReply("NetworkManager is not running or the WiFi radio is disabled")
+		}
+
+		if doc.Paths[e.Path] == nil {
+			doc.Paths[e.Path] = map[string]Operation{}
+		}
+		doc.Paths[e.Path][strings.ToLower(e.Method)] = op
+	}
+	return doc
+}
+
+// operationID turns GET /networks/{ssid} into getNetworksSsid
+func operationID(method, path string) string {
+	id := strings.ToLower(method)
+	for _, part := range strings.FieldsFunc(path, func(r rune) bool { return !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9') }) {
+		id += strings.ToUpper(part[:1]) + part[1:]
+	}
+	return id
+}
+
+var (
+	textMarshaler = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	timeType      = reflect.TypeOf(time.Time{})
+)
+
+// schemaFor returns the JSON schema of t as encoding/json would encode it. Named structs are added to
+// schemas and referenced.
+func schemaFor(t reflect.Type, schemas map[string]Schema) Schema {
+	if t == timeType {
+		return Schema{"type": "string", "format": "date-time"}
+	}
+	if t.Implements(textMarshaler) || reflect.PointerTo(t).Implements(textMarshaler) {
+		return Schema{"type": "string"}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		schema := schemaFor(t.Elem(), schemas)
+		if _, ref := schema["$ref"]; ref {
+			return schema
+		}
+		nullable := Schema{"nullable": true}
+		for k, v := range schema {
+			nullable[k] = v
+		}
+		return nullable
+	case reflect.Bool:
+		return Schema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return Schema{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return Schema{"type": "number"}
+	case reflect.String:
+		return Schema{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return Schema{"type": "string", "format": "byte"}
+		}
+		return Schema{"type": "array", "items": schemaFor(t.Elem(), schemas)}
+	case reflect.Map:
+		return Schema{"type": "object", "additionalProperties": schemaFor(t.Elem(), schemas)}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return structSchema(t, schemas)
+		}
+		name := t.Name()
+		if _, ok := schemas[name]; !ok {
+			schemas[name] = nil // placeholder for recursive types
+			schemas[name] = structSchema(t, schemas)
+		}
+		return Schema{"$ref": "#/components/schemas/" + name}
+	}
+	return Schema{}
+}
+
+func structSchema(t reflect.Type, schemas map[string]Schema) Schema {
+	properties := map[string]Schema{}
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" && options == "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = schemaFor(field.Type, schemas)
+		if !strings.Contains(options, "omitempty") && field.Type.Kind() != reflect.Pointer {
+			required = append(required, name)
+		}
+	}
+	sort.Strings(required)
+
+	schema := Schema{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
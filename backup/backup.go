@@ -0,0 +1,164 @@
+// Package backup reads and writes PiFi backups: the saved networks, managed environment variables
+// and configuration of a device in one file, optionally encrypted with a passphrase.
+package backup
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ztkent/pifi/networkmanager"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// Format identifies a PiFi backup file
+	Format = "pifi-backup"
+
+	// Version is the layout of the backups written by this version of PiFi
+	Version = 1
+)
+
+// The passphrase key is derived with scrypt, with the same cost as the environment password
+const (
+	scryptLogN    = 15
+	scryptR       = 8
+	scryptP       = 1
+	scryptSaltLen = 16
+)
+
+var (
+	ErrPassphraseRequired = errors.New("the backup is encrypted, enter its passphrase")
+	ErrWrongPassphrase    = errors.New("wrong passphrase, or the backup is damaged")
+)
+
+// Bundle is the contents of a backup. Passwords and the values of secrets are kept in full.
+type Bundle struct {
+	CreatedAt time.Time                        `json:"createdAt"`
+	Hostname  string                           `json:"hostname,omitempty"`
+	Networks  []networkmanager.SavedConnection `json:"networks"`
+	Env       *Env                             `json:"env,omitempty"`    // nil if the environment wasn't backed up
+	Config    string                           `json:"config,omitempty"` // The config file, AP settings included
+}
+
+// Env is the managed environment variables of a backup
+type Env struct {
+	Variables map[string]string                   `json:"variables"`
+	Secrets   []string                            `json:"secrets,omitempty"`
+	Targets   map[string]networkmanager.EnvTarget `json:"targets,omitempty"`
+}
+
+// Config is a configuration that backups include, implemented by *config.Config
+type Config interface {
+	// MarshalBackup returns the configuration as a config file
+	MarshalBackup() ([]byte, error)
+	// RestoreBackup validates a config file from a backup and writes it, it takes effect when PiFi restarts
+	RestoreBackup(data []byte) error
+}
+
+// file is a backup as written, Bundle is set unless it is encrypted
+type file struct {
+	Format    string  `json:"format"`
+	Version   int     `json:"version"`
+	Bundle    *Bundle `json:"bundle,omitempty"`
+	Encrypted *sealed `json:"encrypted,omitempty"`
+}
+
+// sealed is a bundle encrypted with AES-GCM, with a key derived from the passphrase with scrypt
+type sealed struct {
+	LogN  int    `json:"ln"`
+	R     int    `json:"r"`
+	P     int    `json:"p"`
+	Salt  []byte `json:"salt"`
+	Nonce []byte `json:"nonce"`
+	Data  []byte `json:"data"`
+}
+
+// Encode writes the backup file of b, encrypted if passphrase isn't empty
+func Encode(b Bundle, passphrase string) ([]byte, error) {
+	f := file{Format: Format, Version: Version}
+	if passphrase == "" {
+		f.Bundle = &b
+		return json.MarshalIndent(f, "", "  ")
+	}
+
+	plain, err := json.Marshal(b)
+	if err != nil {
+		return nil, err
+	}
+	s := &sealed{LogN: scryptLogN, R: scryptR, P: scryptP, Salt: make([]byte, scryptSaltLen)}
+	if _, err := rand.Read(s.Salt); err != nil {
+		return nil, err
+	}
+	aead, err := s.cipher(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	s.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(s.Nonce); err != nil {
+		return nil, err
+	}
+	s.Data = aead.Seal(nil, s.Nonce, plain, []byte(Format))
+	f.Encrypted = s
+	return json.MarshalIndent(f, "", "  ")
+}
+
+// Decode reads a backup file. Encrypted backups fail with ErrPassphraseRequired without a
+// passphrase, and with ErrWrongPassphrase if it doesn't decrypt them.
+func Decode(data []byte, passphrase string) (Bundle, error) {
+	var f file
+	if err := json.Unmarshal(data, &f); err != nil || f.Format != Format {
+		return Bundle{}, fmt.Errorf("not a PiFi backup")
+	}
+	if f.Version > Version {
+		return Bundle{}, fmt.Errorf("the backup has version %d, this PiFi only knows up to version %d", f.Version, Version)
+	}
+	if f.Encrypted == nil {
+		if f.Bundle == nil {
+			return Bundle{}, fmt.Errorf("the backup is empty")
+		}
+		return *f.Bundle, nil
+	}
+
+	if passphrase == "" {
+		return Bundle{}, ErrPassphraseRequired
+	}
+	s := f.Encrypted
+	// Costs beyond the ones PiFi writes would exhaust the memory of a Pi
+	if s.LogN < 1 || s.LogN > scryptLogN+1 || s.R < 1 || s.R > scryptR || s.P < 1 || s.P > 4 {
+		return Bundle{}, fmt.Errorf("unsupported encryption parameters in the backup")
+	}
+	aead, err := s.cipher(passphrase)
+	if err != nil {
+		return Bundle{}, err
+	}
+	if len(s.Nonce) != aead.NonceSize() {
+		return Bundle{}, ErrWrongPassphrase
+	}
+	plain, err := aead.Open(nil, s.Nonce, s.Data, []byte(Format))
+	if err != nil {
+		return Bundle{}, ErrWrongPassphrase
+	}
+	var b Bundle
+	if err := json.Unmarshal(plain, &b); err != nil {
+		return Bundle{}, fmt.Errorf("invalid backup contents: %v", err)
+	}
+	return b, nil
+}
+
+// cipher returns the AES-GCM cipher for the key derived from passphrase
+func (s *sealed) cipher(passphrase string) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), s.Salt, 1<<s.LogN, s.R, s.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
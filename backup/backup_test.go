@@ -0,0 +1,52 @@
+package backup
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/ztkent/pifi/networkmanager"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	b := Bundle{
+		Networks: []networkmanager.SavedConnection{{SSID: "Home", Password: "wifi-secret", AutoConnect: true}},
+		Env:      &Env{Variables: map[string]string{"API_KEY": "env-secret"}, Secrets: []string{"API_KEY"}},
+		Config:   "ap:\n  band: a\n",
+	}
+
+	plain, err := Encode(b, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := Decode(plain, ""); err != nil || got.Networks[0].Password != "wifi-secret" || got.Config != b.Config {
+		t.Errorf("Decode of a plain backup = %+v, %v", got, err)
+	}
+
+	encrypted, err := Encode(b, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"wifi-secret", "env-secret", "Home"} {
+		if strings.Contains(string(encrypted), secret) {
+			t.Errorf("encrypted backup contains %q", secret)
+		}
+	}
+	if _, err := Decode(encrypted, ""); !errors.Is(err, ErrPassphraseRequired) {
+		t.Errorf("Decode without a passphrase = %v, want ErrPassphraseRequired", err)
+	}
+	if _, err := Decode(encrypted, "wrong"); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("Decode with a wrong passphrase = %v, want ErrWrongPassphrase", err)
+	}
+	got, err := Decode(encrypted, "correct horse")
+	if err != nil || got.Env.Variables["API_KEY"] != "env-secret" {
+		t.Errorf("Decode = %+v, %v", got, err)
+	}
+
+	if _, err := Decode([]byte(`{"format":"pifi-backup","version":2}`), ""); err == nil {
+		t.Error("Decode accepted a backup from a newer version")
+	}
+	if _, err := Decode([]byte("KEY=value\n"), ""); err == nil {
+		t.Error("Decode accepted a file that isn't a backup")
+	}
+}
@@ -0,0 +1,416 @@
+// Package client is a Go client for the PiFi REST API.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ztkent/pifi/api"
+	"github.com/ztkent/pifi/networkmanager"
+)
+
+const (
+	DefaultTimeout   = 30 * time.Second
+	DefaultRetries   = 2
+	DefaultRetryWait = 500 * time.Millisecond
+)
+
+// Client calls the API of one PiFi device. It is safe for concurrent use.
+type Client struct {
+	baseURL     *url.URL
+	token       string
+	envPassword string
+	httpClient  *http.Client
+	retries     int
+	retryWait   time.Duration
+}
+
+type Option func(*Client)
+
+// WithToken authenticates every request with an API token created in the dashboard
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// WithEnvPassword unlocks the environment routes when the device has an environment password
+// and the client doesn't use a token
+func WithEnvPassword(password string) Option {
+	return func(c *Client) {
+		c.envPassword = password
+	}
+}
+
+// WithHTTPClient replaces the HTTP client, for example to trust a self-signed certificate
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithTimeout limits how long a single attempt may take
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.httpClient.Timeout = timeout
+	}
+}
+
+// WithRetries sets how often a failed request is retried, waiting wait, then twice as long, between attempts.
+// Reads are retried after network errors and 429, 502, 503 and 504 responses, changes only after 429 and 503.
+func WithRetries(retries int, wait time.Duration) Option {
+	return func(c *Client) {
+		c.retries = retries
+		c.retryWait = wait
+	}
+}
+
+// New creates a client for the PiFi server at baseURL, such as http://10.42.0.1:8088
+func New(baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid base URL: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid base URL %q, expected http or https", baseURL)
+	}
+
+	c := &Client{
+		baseURL:    u,
+		httpClient: &http.Client{Timeout: DefaultTimeout},
+		retries:    DefaultRetries,
+		retryWait:  DefaultRetryWait,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// Error is returned when the server answers with an error
+type Error struct {
+	StatusCode int
+	Code       string // one of the api.Code* error codes, empty if the server didn't send one
+	Message    string
+	// Diagnosis explains why a network could not be saved or connected, with a suggested fix
+	Diagnosis *networkmanager.ConnectionError
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("pifi: %s", http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("pifi: %s (%d)", e.Message, e.StatusCode)
+}
+
+// IsUnauthorized reports whether err is a missing, invalid or insufficient API token
+func IsUnauthorized(err error) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && (apiErr.StatusCode == http.StatusUnauthorized || apiErr.StatusCode == http.StatusForbidden)
+}
+
+// GetNetworkStatus returns the current network status
+func (c *Client) GetNetworkStatus(ctx context.Context) (networkmanager.NetworkStatus, error) {
+	var status networkmanager.NetworkStatus
+	err := c.do(ctx, http.MethodGet, "/status", nil, &status)
+	return status, err
+}
+
+// SetWifiMode switches between client and AP mode, see networkmanager.ModeClient and networkmanager.ModeAP
+func (c *Client) SetWifiMode(ctx context.Context, mode string) error {
+	return c.do(ctx, http.MethodPut, "/mode", api.ModeRequest{Mode: mode}, nil)
+}
+
+// FindAvailableNetworks scans for nearby networks and returns their SSIDs
+func (c *Client) FindAvailableNetworks(ctx context.Context) ([]string, error) {
+	var response api.AvailableNetworksResponse
+	err := c.do(ctx, http.MethodGet, "/networks/available", nil, &response)
+	return response.Networks, err
+}
+
+// GetConfiguredConnections returns the saved networks
+func (c *Client) GetConfiguredConnections(ctx context.Context) ([]networkmanager.ConnectionInfo, error) {
+	var response api.ConfiguredNetworksResponse
+	err := c.do(ctx, http.MethodGet, "/networks", nil, &response)
+	return response.Connections, err
+}
+
+// ModifyNetworkConnection saves a network, creating it if it doesn't exist
+func (c *Client) ModifyNetworkConnection(ctx context.Context, ssid, password string, autoConnect bool) error {
+	request := api.NetworkSettings{Password: password, AutoConnect: autoConnect}
+	return c.do(ctx, http.MethodPut, networkPath(ssid), request, nil)
+}
+
+// RemoveNetworkConnection deletes a saved network
+func (c *Client) RemoveNetworkConnection(ctx context.Context, ssid string) error {
+	return c.do(ctx, http.MethodDelete, networkPath(ssid), nil, nil)
+}
+
+// SetAutoConnectConnection sets whether a saved network connects automatically
+func (c *Client) SetAutoConnectConnection(ctx context.Context, ssid string, autoConnect bool) error {
+	return c.do(ctx, http.MethodPatch, networkPath(ssid), api.AutoConnectSettings{AutoConnect: &autoConnect}, nil)
+}
+
+// ConnectNetwork connects to a saved network
+func (c *Client) ConnectNetwork(ctx context.Context, ssid string) error {
+	return c.do(ctx, http.MethodPost, networkPath(ssid)+"/connect", nil, nil)
+}
+
+func networkPath(ssid string) string {
+	return "/networks/" + url.PathEscape(ssid)
+}
+
+// GetEnvironmentVariables returns the environment variables managed by PiFi, secrets are masked
+func (c *Client) GetEnvironmentVariables(ctx context.Context) (map[string]string, error) {
+	var response api.EnvVariablesResponse
+	err := c.do(ctx, http.MethodGet, "/env", nil, &response)
+	return response.Variables, err
+}
+
+// GetEnvironmentProvenance returns where each managed variable is read from and the running processes
+// with a different value, values of secrets are masked
+func (c *Client) GetEnvironmentProvenance(ctx context.Context) (map[string]networkmanager.EnvProvenance, error) {
+	var response api.EnvVariablesResponse
+	err := c.do(ctx, http.MethodGet, "/env", nil, &response)
+	return response.Provenance, err
+}
+
+// GetEnvironmentVariable returns one managed environment variable
+func (c *Client) GetEnvironmentVariable(ctx context.Context, key string) (string, error) {
+	var variable api.EnvVariable
+	err := c.do(ctx, http.MethodGet, "/env/"+url.PathEscape(key), nil, &variable)
+	return variable.Value, err
+}
+
+// SetEnvironmentVariable sets a variable in /etc/environment and manages it from then on
+func (c *Client) SetEnvironmentVariable(ctx context.Context, key, value string) error {
+	return c.do(ctx, http.MethodPut, "/env/"+url.PathEscape(key), api.EnvValue{Value: value}, nil)
+}
+
+// SetEnvironmentVariableUnits sets a variable like SetEnvironmentVariable and returns the units
+// restarted or reloaded after the change. A unit that failed doesn't make the call fail.
+func (c *Client) SetEnvironmentVariableUnits(ctx context.Context, key, value string) ([]networkmanager.UnitResult, error) {
+	var variable api.EnvVariable
+	err := c.do(ctx, http.MethodPut, "/env/"+url.PathEscape(key), api.EnvValue{Value: value}, &variable)
+	return variable.Units, err
+}
+
+// SetEnvironmentTarget sets the file a variable is written to and the units that read it
+func (c *Client) SetEnvironmentTarget(ctx context.Context, key string, target networkmanager.EnvTarget) error {
+	return c.do(ctx, http.MethodPut, "/env/"+url.PathEscape(key)+"/target", target, nil)
+}
+
+// SetSecretEnvironmentVariable sets a variable whose value is never returned by the API
+func (c *Client) SetSecretEnvironmentVariable(ctx context.Context, key, value string) error {
+	return c.do(ctx, http.MethodPut, "/env/"+url.PathEscape(key), api.EnvValue{Value: value, Secret: true}, nil)
+}
+
+// UnsetEnvironmentVariable removes a managed variable
+func (c *Client) UnsetEnvironmentVariable(ctx context.Context, key string) error {
+	return c.do(ctx, http.MethodDelete, "/env/"+url.PathEscape(key), nil, nil)
+}
+
+// GetEnvironmentSchema returns the environment schema and the required variables that aren't set
+func (c *Client) GetEnvironmentSchema(ctx context.Context) (api.EnvSchemaResponse, error) {
+	var schema api.EnvSchemaResponse
+	err := c.do(ctx, http.MethodGet, "/env/schema", nil, &schema)
+	return schema, err
+}
+
+// ExportEnvironment returns the managed variables as a .env file. Without withSecrets, secrets are only named in comments.
+func (c *Client) ExportEnvironment(ctx context.Context, withSecrets bool) ([]byte, error) {
+	var data []byte
+	err := c.do(ctx, http.MethodGet, "/env/export?secrets="+strconv.FormatBool(withSecrets), nil, &data)
+	return data, err
+}
+
+// PreviewEnvironmentImport returns what importing the .env file content would change, in mode "merge" or "replace"
+func (c *Client) PreviewEnvironmentImport(ctx context.Context, content []byte, mode string) (api.EnvImportPreview, error) {
+	var preview api.EnvImportPreview
+	err := c.do(ctx, http.MethodPost, "/env/import/preview", api.EnvImportRequest{Content: string(content), Mode: mode}, &preview)
+	return preview, err
+}
+
+// ImportEnvironment applies every change of an import or none. With the base of a preview it fails with
+// the conflict code if the variables changed since, the changed variables in keep keep their value.
+func (c *Client) ImportEnvironment(ctx context.Context, content []byte, mode, base string, keep []string) (api.EnvBatchResult, error) {
+	var result api.EnvBatchResult
+	err := c.do(ctx, http.MethodPost, "/env/import", api.EnvImportRequest{Content: string(content), Mode: mode, Base: base, Keep: keep}, &result)
+	return result, err
+}
+
+// UpdateEnvironment sets and unsets several variables in one request
+func (c *Client) UpdateEnvironment(ctx context.Context, set map[string]string, unset []string) (api.EnvBatchResult, error) {
+	var result api.EnvBatchResult
+	err := c.do(ctx, http.MethodPatch, "/env", api.EnvBatchRequest{Set: set, Unset: unset}, &result)
+	return result, err
+}
+
+// GetEnvironmentHistory returns the revisions of key, or of every variable if key is empty, newest first
+func (c *Client) GetEnvironmentHistory(ctx context.Context, key string) ([]networkmanager.EnvRevision, error) {
+	path := "/env/history"
+	if key != "" {
+		path = "/env/" + url.PathEscape(key) + "/history"
+	}
+	var revisions []networkmanager.EnvRevision
+	err := c.do(ctx, http.MethodGet, path, nil, &revisions)
+	return revisions, err
+}
+
+// RollbackEnvironment rolls the variables back to their values right after revision, only key if it isn't empty
+func (c *Client) RollbackEnvironment(ctx context.Context, revision int, key string) (api.EnvRollbackResult, error) {
+	var result api.EnvRollbackResult
+	err := c.do(ctx, http.MethodPost, "/env/rollback", api.EnvRollbackRequest{Revision: revision, Key: key}, &result)
+	return result, err
+}
+
+// Backup returns a backup file of the device, encrypted with passphrase if it isn't empty
+func (c *Client) Backup(ctx context.Context, passphrase string) ([]byte, error) {
+	var data []byte
+	err := c.do(ctx, http.MethodPost, "/backup", api.BackupRequest{Passphrase: passphrase}, &data)
+	return data, err
+}
+
+// PreviewRestore returns what restoring the backup file would change
+func (c *Client) PreviewRestore(ctx context.Context, backup []byte, passphrase string) (api.BackupPreview, error) {
+	var preview api.BackupPreview
+	err := c.do(ctx, http.MethodPost, "/backup/restore/preview", api.BackupRestoreRequest{Backup: string(backup), Passphrase: passphrase}, &preview)
+	return preview, err
+}
+
+// Restore adds and updates the networks, environment variables and configuration of the backup file
+func (c *Client) Restore(ctx context.Context, backup []byte, passphrase string) (api.BackupRestoreResult, error) {
+	var result api.BackupRestoreResult
+	err := c.do(ctx, http.MethodPost, "/backup/restore", api.BackupRestoreRequest{Backup: string(backup), Passphrase: passphrase}, &result)
+	return result, err
+}
+
+// GetDesiredState returns what reconciling the desired state file would change, and the last reconcile
+func (c *Client) GetDesiredState(ctx context.Context) (api.DesiredStateStatus, error) {
+	var status api.DesiredStateStatus
+	err := c.do(ctx, http.MethodGet, "/desired", nil, &status)
+	return status, err
+}
+
+// ReconcileDesiredState applies the desired state file now, LastApplied lists the changes made
+func (c *Client) ReconcileDesiredState(ctx context.Context) (api.DesiredStateStatus, error) {
+	var status api.DesiredStateStatus
+	err := c.do(ctx, http.MethodPost, "/desired/reconcile", nil, &status)
+	return status, err
+}
+
+// do sends the request to path below /api/v1, retrying where it is safe, and decodes the data of the response into out.
+// If out is a *[]byte it receives the body of a successful response as it is.
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return fmt.Errorf("failed to encode request: %v", err)
+		}
+	}
+
+	wait := c.retryWait
+	for attempt := 0; ; attempt++ {
+		retryAfter, err := c.attempt(ctx, method, path, payload, out)
+		if err == nil || attempt >= c.retries || ctx.Err() != nil || !retryable(method, err) {
+			return err
+		}
+
+		if retryAfter > wait {
+			wait = retryAfter
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		wait *= 2
+	}
+}
+
+func (c *Client) attempt(ctx context.Context, method, path string, payload []byte, out interface{}) (time.Duration, error) {
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL.String()+"/api/v1"+path, body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if c.envPassword != "" {
+		req.Header.Set(api.EnvPasswordHeader, c.envPassword)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var retryAfter time.Duration
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		retryAfter = time.Duration(seconds) * time.Second
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return retryAfter, err
+	}
+	// Raw endpoints answer with the bare body
+	if raw, ok := out.(*[]byte); ok && resp.StatusCode < 400 {
+		*raw = data
+		return retryAfter, nil
+	}
+
+	diagnosis := &networkmanager.ConnectionError{}
+	response := api.Response{Data: out, Details: diagnosis}
+	if err := json.Unmarshal(data, &response); err != nil {
+		if resp.StatusCode >= 400 {
+			return retryAfter, &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(data))}
+		}
+		return retryAfter, fmt.Errorf("failed to decode response: %v", err)
+	}
+	if resp.StatusCode >= 400 || !response.Success {
+		apiErr := &Error{StatusCode: resp.StatusCode, Code: response.Code, Message: response.Error}
+		if diagnosis.Code != "" {
+			apiErr.Diagnosis = diagnosis
+		}
+		return retryAfter, apiErr
+	}
+	return retryAfter, nil
+}
+
+// retryable reports whether a failed request can be sent again without repeating a change
+func retryable(method string, err error) bool {
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		// Network error, the request may have been applied unless it only reads
+		return method == http.MethodGet
+	}
+	switch apiErr.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return true
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return method == http.MethodGet
+	}
+	return false
+}
@@ -0,0 +1,1167 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ztkent/pifi/api"
+	"github.com/ztkent/pifi/desired"
+	"github.com/ztkent/pifi/html/handlers"
+	"github.com/ztkent/pifi/networkmanager"
+	"github.com/ztkent/pifi/server"
+	"github.com/ztkent/pifi/state"
+)
+
+// fakeNetworkManager keeps saved networks in memory instead of calling nmcli
+type fakeNetworkManager struct {
+	mu          sync.Mutex
+	mode        string
+	connected   string
+	available   []string
+	connections map[string]fakeConnection
+	env         map[string]string
+	secrets     map[string]bool
+	targets     map[string]networkmanager.EnvTarget
+	restarted   []string
+	schema      networkmanager.EnvSchema
+	history     []networkmanager.EnvRevision
+	actor       string
+	envPassword string
+	apBand      string
+}
+
+type fakeConnection struct {
+	password    string
+	autoConnect bool
+	priority    int
+}
+
+func newFakeNetworkManager() *fakeNetworkManager {
+	return &fakeNetworkManager{
+		mode:        networkmanager.ModeClient,
+		available:   []string{"HomeWiFi", "OfficeWiFi"},
+		connections: map[string]fakeConnection{},
+		env:         map[string]string{},
+		secrets:     map[string]bool{},
+		targets:     map[string]networkmanager.EnvTarget{},
+		apBand:      networkmanager.DefaultAPBand,
+	}
+}
+
+func (f *fakeNetworkManager) SetupAPConnection() error { return nil }
+
+func (f *fakeNetworkManager) ManageOfflineAP(ctx context.Context, timeout time.Duration) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (f *fakeNetworkManager) GetNetworkStatus() (networkmanager.NetworkStatus, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return networkmanager.NetworkStatus{
+		State:          "Connected",
+		Connectivity:   "Full",
+		Wifi:           "Enabled",
+		WifiSSID:       f.connected,
+		WifiConnection: f.connected,
+		APSSID:         "PiFi-AP-TEST",
+		Mode:           f.mode,
+		IPs:            networkmanager.NetworkIPs{WifiIP: "192.168.1.20", WifiState: "online"},
+	}, nil
+}
+
+func (f *fakeNetworkManager) SetWifiMode(mode string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if mode != networkmanager.ModeClient && mode != networkmanager.ModeAP {
+		return fmt.Errorf("invalid mode: %s", mode)
+	}
+	f.mode = mode
+	return nil
+}
+
+func (f *fakeNetworkManager) FindAvailableNetworks() ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.available...), nil
+}
+
+func (f *fakeNetworkManager) GetConfiguredConnections() ([]networkmanager.ConnectionInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	connections := []networkmanager.ConnectionInfo{}
+	for ssid := range f.connections {
+		connections = append(connections, networkmanager.ConnectionInfo{SSID: ssid})
+	}
+	sort.Slice(connections, func(i, j int) bool { return connections[i].SSID < connections[j].SSID })
+	return connections, nil
+}
+
+func (f *fakeNetworkManager) GetSavedConnections() ([]networkmanager.SavedConnection, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	connections := []networkmanager.SavedConnection{}
+	for ssid, c := range f.connections {
+		connections = append(connections, networkmanager.SavedConnection{SSID: ssid, Password: c.password, AutoConnect: c.autoConnect, Priority: c.priority})
+	}
+	sort.Slice(connections, func(i, j int) bool { return connections[i].SSID < connections[j].SSID })
+	return connections, nil
+}
+
+func (f *fakeNetworkManager) ModifyNetworkConnection(ssid, password string, autoConnect bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	conn := f.connections[ssid]
+	conn.password, conn.autoConnect = password, autoConnect
+	f.connections[ssid] = conn
+	return nil
+}
+
+func (f *fakeNetworkManager) RemoveNetworkConnection(ssid string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.connections[ssid]; !ok {
+		return fmt.Errorf("connection %s not found", ssid)
+	}
+	delete(f.connections, ssid)
+	return nil
+}
+
+func (f *fakeNetworkManager) SetAutoConnectConnection(ssid string, autoConnect bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	conn, ok := f.connections[ssid]
+	if !ok {
+		return fmt.Errorf("connection %s not found", ssid)
+	}
+	conn.autoConnect = autoConnect
+	f.connections[ssid] = conn
+	return nil
+}
+
+func (f *fakeNetworkManager) SetConnectionPriority(ssid string, priority int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	conn, ok := f.connections[ssid]
+	if !ok {
+		return fmt.Errorf("connection %s not found", ssid)
+	}
+	conn.priority = priority
+	f.connections[ssid] = conn
+	return nil
+}
+
+func (f *fakeNetworkManager) GetAPSettings() (networkmanager.APSettings, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return networkmanager.APSettings{Band: f.apBand}, nil
+}
+
+func (f *fakeNetworkManager) SetAPSettings(settings networkmanager.APSettings) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.apBand = settings.Band
+	return nil
+}
+
+func (f *fakeNetworkManager) ConnectNetwork(ssid string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	conn, ok := f.connections[ssid]
+	if !ok {
+		return fmt.Errorf("connection %s not found", ssid)
+	}
+	if conn.password == "wrong" {
+		return &networkmanager.ConnectionError{
+			Code: networkmanager.FailureWrongPassword, SSID: ssid, Summary: "Wrong password",
+			ReasonCode: 7, Reason: "Secrets were required, but not provided",
+		}
+	}
+	f.connected = ssid
+	return nil
+}
+
+func (f *fakeNetworkManager) GetEnvironmentVariables() (map[string]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	vars := make(map[string]string, len(f.env))
+	for k, v := range f.env {
+		vars[k] = v
+	}
+	return vars, nil
+}
+
+func (f *fakeNetworkManager) GetEnvironmentSecrets() ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var secrets []string
+	for key := range f.secrets {
+		secrets = append(secrets, key)
+	}
+	sort.Strings(secrets)
+	return secrets, nil
+}
+
+func (f *fakeNetworkManager) EnvFingerprint(vars map[string]string) (string, error) {
+	keys := make([]string, 0, len(vars))
+	for key := range vars {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	for _, key := range keys {
+		fmt.Fprintf(h, "%s=%s\x00", key, vars[key])
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (f *fakeNetworkManager) SetEnvironmentVariable(key, value string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.schema.Validate(key, value); err != nil {
+		return err
+	}
+	f.record(key, &value)
+	f.env[key] = value
+	delete(f.secrets, key)
+	return nil
+}
+
+func (f *fakeNetworkManager) SetSecretEnvironmentVariable(key, value string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.schema.Validate(key, value); err != nil {
+		return err
+	}
+	f.record(key, &value)
+	f.env[key] = value
+	f.secrets[key] = true
+	return nil
+}
+
+func (f *fakeNetworkManager) UnsetEnvironmentVariable(key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record(key, nil)
+	delete(f.env, key)
+	delete(f.secrets, key)
+	return nil
+}
+
+func (f *fakeNetworkManager) ApplyEnvironmentSecrets() error { return nil }
+
+func (f *fakeNetworkManager) LoadEnvironment() error { return nil }
+
+// GetEnvironmentProvenance reads every variable from /etc/environment, running units named "stale.service" have another value
+func (f *fakeNetworkManager) GetEnvironmentProvenance() (map[string]networkmanager.EnvProvenance, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	provenance := map[string]networkmanager.EnvProvenance{}
+	for key := range f.env {
+		p := networkmanager.EnvProvenance{Source: "/etc/environment"}
+		if slices.Contains(f.targets[key].Restart, "stale.service") {
+			old := "stale"
+			p.Drift = []networkmanager.EnvDrift{{Process: "stale.service", Value: &old}}
+		}
+		provenance[key] = p
+	}
+	return provenance, nil
+}
+
+// ApplyEnvironment validates every value before changing anything, secrets stay secrets
+func (f *fakeNetworkManager) ApplyEnvironment(set map[string]string, unset []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for key, value := range set {
+		if err := f.schema.Validate(key, value); err != nil {
+			return err
+		}
+	}
+	for key, value := range set {
+		f.record(key, &value)
+		f.env[key] = value
+	}
+	for _, key := range unset {
+		f.record(key, nil)
+		delete(f.env, key)
+		delete(f.secrets, key)
+	}
+	return nil
+}
+
+// record adds a revision changing key to value, the caller holds the lock
+func (f *fakeNetworkManager) record(key string, value *string) {
+	rev := networkmanager.EnvRevision{ID: len(f.history) + 1, Time: time.Now(), Actor: f.actor, Key: key, New: value}
+	if old, ok := f.env[key]; ok {
+		rev.Old = &old
+	}
+	f.history = append(f.history, rev)
+}
+
+// WithActor records actor as the author of the following changes
+func (f *fakeNetworkManager) WithActor(actor string) networkmanager.NetworkManager {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.actor = actor
+	return f
+}
+
+func (f *fakeNetworkManager) GetEnvironmentHistory(key string) ([]networkmanager.EnvRevision, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	revisions := []networkmanager.EnvRevision{}
+	for i := len(f.history) - 1; i >= 0; i-- {
+		if key == "" || f.history[i].Key == key {
+			revisions = append(revisions, f.history[i])
+		}
+	}
+	return revisions, nil
+}
+
+// RollbackEnvironment restores the old value of the first revision after id of each variable
+func (f *fakeNetworkManager) RollbackEnvironment(id int, key string) (networkmanager.EnvRollback, error) {
+	set, unset := map[string]string{}, []string{}
+	for _, rev := range f.history {
+		if _, seen := set[rev.Key]; rev.ID <= id || seen || slices.Contains(unset, rev.Key) || key != "" && rev.Key != key {
+			continue
+		}
+		if rev.Old == nil {
+			unset = append(unset, rev.Key)
+		} else {
+			set[rev.Key] = *rev.Old
+		}
+	}
+	if err := f.ApplyEnvironment(set, unset); err != nil {
+		return networkmanager.EnvRollback{}, err
+	}
+	return networkmanager.EnvRollback{Set: slices.Sorted(maps.Keys(set)), Unset: unset}, nil
+}
+
+func (f *fakeNetworkManager) GetEnvironmentSchema() (*networkmanager.EnvSchema, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	schema := f.schema
+	return &schema, nil
+}
+
+func (f *fakeNetworkManager) ValidateEnvironmentVariable(key, value string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.schema.Validate(key, value)
+}
+
+func (f *fakeNetworkManager) GetEnvironmentTargets() (map[string]networkmanager.EnvTarget, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	targets := make(map[string]networkmanager.EnvTarget, len(f.targets))
+	for k, v := range f.targets {
+		targets[k] = v
+	}
+	return targets, nil
+}
+
+func (f *fakeNetworkManager) SetEnvironmentTarget(key string, target networkmanager.EnvTarget) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if target.File != "" && filepath.Dir(target.File) != "/etc/default" {
+		return fmt.Errorf("environment file %q must be /etc/environment or in /etc/default", target.File)
+	}
+	f.targets[key] = target
+	return nil
+}
+
+// RestartEnvironmentUnits records the restarts, units named "broken" fail
+func (f *fakeNetworkManager) RestartEnvironmentUnits(keys []string) []networkmanager.UnitResult {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	results := []networkmanager.UnitResult{}
+	for _, key := range keys {
+		for _, unit := range f.targets[key].Restart {
+			result := networkmanager.UnitResult{Unit: unit, Action: "restart"}
+			if unit == "broken.service" {
+				result.Error = "Job for broken.service failed"
+			}
+			f.restarted = append(f.restarted, unit)
+			results = append(results, result)
+		}
+	}
+	return results
+}
+
+func (f *fakeNetworkManager) SetEnvPassword(password string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.envPassword = password
+	return nil
+}
+
+func (f *fakeNetworkManager) RemoveEnvPassword() error { return f.SetEnvPassword("") }
+
+func (f *fakeNetworkManager) ValidateEnvPassword(password string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.envPassword != "" && password == f.envPassword, nil
+}
+
+func (f *fakeNetworkManager) IsEnvPasswordSet() (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.envPassword != "", nil
+}
+
+// newTestServer serves the real PiFi handlers, with its state file in a temp dir
+func newTestServer(t *testing.T) (*httptest.Server, *fakeNetworkManager, *handlers.TokenStore) {
+	t.Helper()
+	store := state.New(filepath.Join(t.TempDir(), "state.json"), state.Legacy{})
+	nm := newFakeNetworkManager()
+	pifi, err := server.New(server.Options{
+		NetworkManager: nm,
+		State:          store,
+	})
+	if err != nil {
+		t.Fatalf("server.New: %v", err)
+	}
+	ts := httptest.NewServer(pifi)
+	t.Cleanup(ts.Close)
+	return ts, nm, handlers.NewTokenStore(store)
+}
+
+func newTestClient(t *testing.T, baseURL string, opts ...Option) *Client {
+	t.Helper()
+	c, err := New(baseURL, append([]Option{WithRetries(0, 0)}, opts...)...)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return c
+}
+
+func TestNetworkStatus(t *testing.T) {
+	ts, _, _ := newTestServer(t)
+	c := newTestClient(t, ts.URL)
+
+	status, err := c.GetNetworkStatus(context.Background())
+	if err != nil {
+		t.Fatalf("GetNetworkStatus: %v", err)
+	}
+	if status.Mode != networkmanager.ModeClient || status.IPs.WifiIP != "192.168.1.20" {
+		t.Errorf("unexpected status: %+v", status)
+	}
+}
+
+func TestSetWifiMode(t *testing.T) {
+	ts, nm, _ := newTestServer(t)
+	c := newTestClient(t, ts.URL)
+	ctx := context.Background()
+
+	if err := c.SetWifiMode(ctx, networkmanager.ModeAP); err != nil {
+		t.Fatalf("SetWifiMode: %v", err)
+	}
+	if nm.mode != networkmanager.ModeAP {
+		t.Errorf("mode = %q, want %q", nm.mode, networkmanager.ModeAP)
+	}
+
+	err := c.SetWifiMode(ctx, "mesh")
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest || apiErr.Code != api.CodeInvalidParameter {
+		t.Errorf("SetWifiMode(mesh) = %v, want a 400 %s error", err, api.CodeInvalidParameter)
+	}
+	if err := c.SetWifiMode(ctx, ""); err == nil {
+		t.Error("SetWifiMode with an empty mode succeeded")
+	}
+}
+
+func TestNetworkLifecycle(t *testing.T) {
+	ts, nm, _ := newTestServer(t)
+	c := newTestClient(t, ts.URL)
+	ctx := context.Background()
+
+	available, err := c.FindAvailableNetworks(ctx)
+	if err != nil {
+		t.Fatalf("FindAvailableNetworks: %v", err)
+	}
+	if len(available) != 2 || available[0] != "HomeWiFi" {
+		t.Errorf("available = %v", available)
+	}
+
+	if err := c.ModifyNetworkConnection(ctx, "HomeWiFi", "secret", false); err != nil {
+		t.Fatalf("ModifyNetworkConnection: %v", err)
+	}
+	if nm.connections["HomeWiFi"].password != "secret" {
+		t.Error("password was not passed to the NetworkManager")
+	}
+
+	if err := c.SetAutoConnectConnection(ctx, "HomeWiFi", true); err != nil {
+		t.Fatalf("SetAutoConnectConnection: %v", err)
+	}
+	if !nm.connections["HomeWiFi"].autoConnect {
+		t.Error("autoconnect was not enabled")
+	}
+
+	if err := c.ConnectNetwork(ctx, "HomeWiFi"); err != nil {
+		t.Fatalf("ConnectNetwork: %v", err)
+	}
+	status, err := c.GetNetworkStatus(ctx)
+	if err != nil || status.WifiSSID != "HomeWiFi" {
+		t.Errorf("status after connect = %+v, %v", status, err)
+	}
+
+	configured, err := c.GetConfiguredConnections(ctx)
+	if err != nil {
+		t.Fatalf("GetConfiguredConnections: %v", err)
+	}
+	if len(configured) != 1 || configured[0].SSID != "HomeWiFi" {
+		t.Errorf("configured = %v", configured)
+	}
+
+	if err := c.RemoveNetworkConnection(ctx, "HomeWiFi"); err != nil {
+		t.Fatalf("RemoveNetworkConnection: %v", err)
+	}
+	if err := c.RemoveNetworkConnection(ctx, "HomeWiFi"); err == nil {
+		t.Error("removing a missing network succeeded")
+	}
+	if err := c.ConnectNetwork(ctx, ""); err == nil {
+		t.Error("ConnectNetwork with an empty SSID succeeded")
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	ts, _, tokens := newTestServer(t)
+	ctx := context.Background()
+
+	secret, _, err := tokens.Create("fleet", []string{handlers.ScopeStatusRead}, 0)
+	if err != nil {
+		t.Fatalf("Create token: %v", err)
+	}
+
+	if _, err := newTestClient(t, ts.URL).GetNetworkStatus(ctx); !IsUnauthorized(err) {
+		t.Errorf("request without a token = %v, want unauthorized", err)
+	}
+	if _, err := newTestClient(t, ts.URL, WithToken("pifi_invalid")).GetNetworkStatus(ctx); !IsUnauthorized(err) {
+		t.Errorf("request with an invalid token = %v, want unauthorized", err)
+	}
+
+	c := newTestClient(t, ts.URL, WithToken(secret))
+	if _, err := c.GetNetworkStatus(ctx); err != nil {
+		t.Errorf("GetNetworkStatus with a status:read token: %v", err)
+	}
+	if err := c.SetWifiMode(ctx, networkmanager.ModeAP); !IsUnauthorized(err) {
+		t.Errorf("SetWifiMode with a status:read token = %v, want forbidden", err)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	var calls atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"success":true,"data":{"networks":["HomeWiFi"]}}`))
+	}))
+	defer ts.Close()
+
+	c, err := New(ts.URL, WithRetries(2, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	networks, err := c.FindAvailableNetworks(context.Background())
+	if err != nil || len(networks) != 1 {
+		t.Fatalf("FindAvailableNetworks = %v, %v", networks, err)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("calls = %d, want 3", calls.Load())
+	}
+
+}
+
+func TestChangesNotRetriedAfterServerError(t *testing.T) {
+	var calls atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+	}))
+	defer ts.Close()
+
+	// The gateway may have passed the change on, so sending it again could repeat it
+	c, err := New(ts.URL, WithRetries(2, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.ConnectNetwork(context.Background(), "HomeWiFi")
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadGateway {
+		t.Fatalf("ConnectNetwork = %v, want a 502 error", err)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("calls = %d, want 1", calls.Load())
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer ts.Close()
+
+	c := newTestClient(t, ts.URL, WithTimeout(20*time.Millisecond))
+	start := time.Now()
+	if _, err := c.GetNetworkStatus(context.Background()); err == nil {
+		t.Fatal("GetNetworkStatus succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("request took %v, want it cut off by the timeout", elapsed)
+	}
+}
+
+func TestNewRejectsInvalidURL(t *testing.T) {
+	for _, baseURL := range []string{"10.42.0.1:8088", "ftp://10.42.0.1", "://"} {
+		if _, err := New(baseURL); err == nil {
+			t.Errorf("New(%q) succeeded", baseURL)
+		}
+	}
+}
+
+func TestSSIDWithSlash(t *testing.T) {
+	ts, nm, _ := newTestServer(t)
+	c := newTestClient(t, ts.URL)
+	ctx := context.Background()
+
+	if err := c.ModifyNetworkConnection(ctx, "Cafe/Guest 5G", "", true); err != nil {
+		t.Fatalf("ModifyNetworkConnection: %v", err)
+	}
+	if _, ok := nm.connections["Cafe/Guest 5G"]; !ok {
+		t.Errorf("connections = %v, want Cafe/Guest 5G", nm.connections)
+	}
+	if err := c.ConnectNetwork(ctx, "Cafe/Guest 5G"); err != nil {
+		t.Errorf("ConnectNetwork: %v", err)
+	}
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	ts, _, _ := newTestServer(t)
+
+	resp, err := http.Get(ts.URL + "/api/v1/openapi.json")
+	if err != nil {
+		t.Fatalf("GET openapi.json: %v", err)
+	}
+	defer resp.Body.Close()
+	var doc api.OpenAPI
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		t.Fatalf("decode openapi.json: %v", err)
+	}
+	if doc.OpenAPI != "3.0.3" || doc.Servers[0].URL != "/api/v1" {
+		t.Errorf("openapi = %q, servers = %v", doc.OpenAPI, doc.Servers)
+	}
+
+	// Every route the client calls must be documented, with its body and response schemas
+	for _, want := range []struct{ method, path string }{
+		{"get", "/status"}, {"put", "/mode"}, {"get", "/networks/available"}, {"get", "/networks"},
+		{"put", "/networks/{ssid}"}, {"patch", "/networks/{ssid}"}, {"delete", "/networks/{ssid}"},
+		{"post", "/networks/{ssid}/connect"},
+	} {
+		op, ok := doc.Paths[want.path][want.method]
+		if !ok {
+			t.Errorf("%s %s is not documented", want.method, want.path)
+			continue
+		}
+		if _, ok := op.Responses["200"]; !ok {
+			t.Errorf("%s %s has no 200 response", want.method, want.path)
+		}
+		if (want.method == "put" || want.method == "patch") && op.RequestBody == nil {
+			t.Errorf("%s %s has no request body", want.method, want.path)
+		}
+	}
+	if _, ok := doc.Components.Schemas["NetworkStatus"]; !ok {
+		t.Errorf("schemas = %v, want NetworkStatus", doc.Components.Schemas)
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	ts, _, tokens := newTestServer(t)
+
+	resp, err := http.Get(ts.URL + "/api/v1/nope")
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	var body api.Response
+	json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound || body.Code != api.CodeNotFound {
+		t.Errorf("unknown route = %d %q, want 404 %s", resp.StatusCode, body.Code, api.CodeNotFound)
+	}
+
+	if _, _, err := tokens.Create("fleet", []string{handlers.ScopeStatusRead}, 0); err != nil {
+		t.Fatalf("Create token: %v", err)
+	}
+	_, err = newTestClient(t, ts.URL).GetNetworkStatus(context.Background())
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.Code != api.CodeUnauthorized {
+		t.Errorf("request without a token = %v, want %s", err, api.CodeUnauthorized)
+	}
+}
+
+func TestDeprecatedAliases(t *testing.T) {
+	ts, _, _ := newTestServer(t)
+
+	resp, err := http.Get(ts.URL + "/api/status")
+	if err != nil {
+		t.Fatalf("GET /api/status: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Deprecation") == "" {
+		t.Errorf("/api/status = %d, Deprecation %q", resp.StatusCode, resp.Header.Get("Deprecation"))
+	}
+}
+
+func TestConnectionDiagnosis(t *testing.T) {
+	ts, _, _ := newTestServer(t)
+	c := newTestClient(t, ts.URL)
+	ctx := context.Background()
+
+	if err := c.ModifyNetworkConnection(ctx, "HomeWiFi", "wrong", true); err != nil {
+		t.Fatalf("ModifyNetworkConnection: %v", err)
+	}
+	err := c.ConnectNetwork(ctx, "HomeWiFi")
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnprocessableEntity || apiErr.Code != networkmanager.FailureWrongPassword {
+		t.Fatalf("ConnectNetwork with a wrong password = %v, want a 422 %s error", err, networkmanager.FailureWrongPassword)
+	}
+	if d := apiErr.Diagnosis; d == nil || d.SSID != "HomeWiFi" || d.ReasonCode != 7 {
+		t.Errorf("diagnosis = %+v", apiErr.Diagnosis)
+	}
+}
+
+func TestEnvironment(t *testing.T) {
+	ts, nm, _ := newTestServer(t)
+	c := newTestClient(t, ts.URL)
+	ctx := context.Background()
+
+	if err := c.SetEnvironmentVariable(ctx, "API_URL", "https://example.com"); err != nil {
+		t.Fatalf("SetEnvironmentVariable: %v", err)
+	}
+	if value, err := c.GetEnvironmentVariable(ctx, "API_URL"); err != nil || value != "https://example.com" {
+		t.Errorf("GetEnvironmentVariable = %q, %v", value, err)
+	}
+
+	result, err := c.UpdateEnvironment(ctx, map[string]string{"B": "2", "A": "1"}, []string{"API_URL"})
+	if err != nil {
+		t.Fatalf("UpdateEnvironment: %v", err)
+	}
+	if fmt.Sprint(result.Set, result.Unset) != "[A B] [API_URL]" {
+		t.Errorf("result = %+v", result)
+	}
+	vars, err := c.GetEnvironmentVariables(ctx)
+	if err != nil || fmt.Sprint(vars) != "map[A:1 B:2]" {
+		t.Errorf("GetEnvironmentVariables = %v, %v", vars, err)
+	}
+
+	if err := c.UnsetEnvironmentVariable(ctx, "A"); err != nil {
+		t.Fatalf("UnsetEnvironmentVariable: %v", err)
+	}
+	var apiErr *Error
+	if _, err := c.GetEnvironmentVariable(ctx, "A"); !errors.As(err, &apiErr) || apiErr.Code != api.CodeNotFound {
+		t.Errorf("GetEnvironmentVariable after unset = %v, want %s", err, api.CodeNotFound)
+	}
+
+	// A batch with an invalid key changes nothing
+	if _, err := c.UpdateEnvironment(ctx, map[string]string{"C": "3", "NOT VALID": "x"}, nil); !errors.As(err, &apiErr) || apiErr.Code != api.CodeInvalidParameter {
+		t.Errorf("UpdateEnvironment with an invalid key = %v, want %s", err, api.CodeInvalidParameter)
+	}
+	if _, ok := nm.env["C"]; ok {
+		t.Error("a rejected batch was partly applied")
+	}
+}
+
+func TestEnvironmentSecrets(t *testing.T) {
+	ts, nm, _ := newTestServer(t)
+	c := newTestClient(t, ts.URL)
+	ctx := context.Background()
+
+	if err := c.SetSecretEnvironmentVariable(ctx, "API_KEY", "s3cret"); err != nil {
+		t.Fatalf("SetSecretEnvironmentVariable: %v", err)
+	}
+	if nm.env["API_KEY"] != "s3cret" {
+		t.Errorf("stored value = %q", nm.env["API_KEY"])
+	}
+	if value, err := c.GetEnvironmentVariable(ctx, "API_KEY"); err != nil || value != api.SecretMask {
+		t.Errorf("GetEnvironmentVariable = %q, %v, want the mask", value, err)
+	}
+	if vars, err := c.GetEnvironmentVariables(ctx); err != nil || vars["API_KEY"] != api.SecretMask {
+		t.Errorf("GetEnvironmentVariables = %v, %v, want the mask", vars, err)
+	}
+
+	// The environment page never contains the value either
+	resp, err := http.Get(ts.URL + "/environment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	page, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(page), "API_KEY") || strings.Contains(string(page), "s3cret") {
+		t.Error("environment page doesn't list the secret or shows its value")
+	}
+
+	// Setting a plain value makes it a normal variable again
+	if err := c.SetEnvironmentVariable(ctx, "API_KEY", "public"); err != nil {
+		t.Fatalf("SetEnvironmentVariable: %v", err)
+	}
+	if value, err := c.GetEnvironmentVariable(ctx, "API_KEY"); err != nil || value != "public" {
+		t.Errorf("GetEnvironmentVariable = %q, %v", value, err)
+	}
+}
+
+func TestEnvironmentTargets(t *testing.T) {
+	ts, nm, _ := newTestServer(t)
+	c := newTestClient(t, ts.URL)
+	ctx := context.Background()
+
+	target := networkmanager.EnvTarget{File: "/etc/default/myapp", Restart: []string{"myapp.service", "broken.service"}}
+	if err := c.SetEnvironmentTarget(ctx, "API_URL", target); err != nil {
+		t.Fatalf("SetEnvironmentTarget: %v", err)
+	}
+	var apiErr *Error
+	if err := c.SetEnvironmentTarget(ctx, "API_URL", networkmanager.EnvTarget{File: "/etc/passwd"}); !errors.As(err, &apiErr) || apiErr.Code != api.CodeInvalidParameter {
+		t.Errorf("SetEnvironmentTarget outside /etc/default = %v, want %s", err, api.CodeInvalidParameter)
+	}
+
+	// A failing unit is reported without failing the change
+	units, err := c.SetEnvironmentVariableUnits(ctx, "API_URL", "https://example.com")
+	if err != nil {
+		t.Fatalf("SetEnvironmentVariableUnits: %v", err)
+	}
+	if len(units) != 2 || units[0].Error != "" || units[1].Error == "" {
+		t.Errorf("units = %+v, want myapp restarted and broken failed", units)
+	}
+
+	result, err := c.UpdateEnvironment(ctx, map[string]string{"API_URL": "https://example.org", "OTHER": "1"}, nil)
+	if err != nil || len(result.Units) != 2 {
+		t.Errorf("UpdateEnvironment units = %+v, %v", result.Units, err)
+	}
+	if len(nm.restarted) != 4 {
+		t.Errorf("restarted %v, want each unit once per change", nm.restarted)
+	}
+}
+
+func TestEnvironmentSchema(t *testing.T) {
+	ts, nm, _ := newTestServer(t)
+	c := newTestClient(t, ts.URL)
+	ctx := context.Background()
+	nm.schema = networkmanager.EnvSchema{Variables: []networkmanager.EnvSchemaVar{
+		{Key: "MQTT_HOST", Type: networkmanager.EnvTypeString, Required: true},
+		{Key: "SAMPLE_RATE_HZ", Type: networkmanager.EnvTypeInt},
+		{Key: "MQTT_PASSWORD", Type: networkmanager.EnvTypeString, Secret: true},
+	}}
+
+	schema, err := c.GetEnvironmentSchema(ctx)
+	if err != nil || len(schema.Variables) != 3 || !slices.Equal(schema.Missing, []string{"MQTT_HOST"}) {
+		t.Errorf("GetEnvironmentSchema = %+v, %v, want MQTT_HOST missing", schema, err)
+	}
+
+	var apiErr *Error
+	if err := c.SetEnvironmentVariable(ctx, "SAMPLE_RATE_HZ", "fast"); !errors.As(err, &apiErr) || apiErr.Code != api.CodeInvalidValue {
+		t.Errorf("SetEnvironmentVariable with an invalid int = %v, want %s", err, api.CodeInvalidValue)
+	}
+	// A batch with an invalid value changes nothing
+	if _, err := c.UpdateEnvironment(ctx, map[string]string{"MQTT_HOST": "broker", "SAMPLE_RATE_HZ": "1.5"}, nil); !errors.As(err, &apiErr) || apiErr.Code != api.CodeInvalidValue {
+		t.Errorf("UpdateEnvironment with an invalid value = %v, want %s", err, api.CodeInvalidValue)
+	}
+	if _, ok := nm.env["MQTT_HOST"]; ok {
+		t.Error("MQTT_HOST was set by a rejected batch")
+	}
+
+	// Variables the schema declares secret are stored as secrets
+	if err := c.SetEnvironmentVariable(ctx, "MQTT_PASSWORD", "hunter2"); err != nil {
+		t.Fatalf("SetEnvironmentVariable: %v", err)
+	}
+	if value, err := c.GetEnvironmentVariable(ctx, "MQTT_PASSWORD"); err != nil || value != api.SecretMask {
+		t.Errorf("MQTT_PASSWORD = %q, %v, want it masked", value, err)
+	}
+}
+
+func TestEnvironmentImport(t *testing.T) {
+	ts, nm, _ := newTestServer(t)
+	c := newTestClient(t, ts.URL)
+	ctx := context.Background()
+	nm.env = map[string]string{"SAME": "1", "CHANGED": "old", "GONE": "x", "TOKEN": "hunter2"}
+	nm.secrets = map[string]bool{"TOKEN": true}
+
+	data, err := c.ExportEnvironment(ctx, false)
+	if err != nil {
+		t.Fatalf("ExportEnvironment: %v", err)
+	}
+	if vars, _ := networkmanager.ParseEnv(string(data)); len(vars) != 3 || strings.Contains(string(data), "hunter2") {
+		t.Errorf("export without secrets = %q", data)
+	}
+	if data, err := c.ExportEnvironment(ctx, true); err != nil || !strings.Contains(string(data), "hunter2") {
+		t.Errorf("export with secrets = %q, %v", data, err)
+	}
+
+	content := []byte("SAME=1\nCHANGED=new\nADDED=y\nTOKEN=swordfish\n")
+	preview, err := c.PreviewEnvironmentImport(ctx, content, "replace")
+	if err != nil {
+		t.Fatalf("PreviewEnvironmentImport: %v", err)
+	}
+	if len(preview.Added) != 1 || len(preview.Changed) != 2 || len(preview.Removed) != 1 || preview.Removed[0].Key != "GONE" {
+		t.Errorf("preview = %+v, want ADDED added, CHANGED and TOKEN changed, GONE removed", preview.EnvDiff)
+	}
+	for _, change := range preview.Changed {
+		if change.Key == "TOKEN" && (change.New != api.SecretMask || !change.Secret) {
+			t.Errorf("secret in preview = %+v, want it masked", change)
+		}
+	}
+
+	// A change after the preview makes the import fail
+	nm.SetEnvironmentVariable("SAME", "2")
+	var apiErr *Error
+	if _, err := c.ImportEnvironment(ctx, content, "replace", preview.Base, nil); !errors.As(err, &apiErr) || apiErr.Code != api.CodeConflict {
+		t.Errorf("ImportEnvironment after a change = %v, want %s", err, api.CodeConflict)
+	}
+
+	preview, _ = c.PreviewEnvironmentImport(ctx, content, "replace")
+	if _, err := c.ImportEnvironment(ctx, content, "replace", preview.Base, []string{"CHANGED"}); err != nil {
+		t.Fatalf("ImportEnvironment: %v", err)
+	}
+	want := map[string]string{"SAME": "1", "CHANGED": "old", "ADDED": "y", "TOKEN": "swordfish"}
+	if vars, _ := nm.GetEnvironmentVariables(); !maps.Equal(vars, want) {
+		t.Errorf("variables after import = %v, want %v", vars, want)
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	ts, nm, _ := newTestServer(t)
+	c := newTestClient(t, ts.URL)
+	ctx := context.Background()
+	nm.connections["HomeWiFi"] = fakeConnection{password: "wifi-secret", autoConnect: true}
+	nm.env = map[string]string{"MODE": "prod", "TOKEN": "hunter2"}
+	nm.secrets = map[string]bool{"TOKEN": true}
+
+	data, err := c.Backup(ctx, "correct horse")
+	if err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	if strings.Contains(string(data), "hunter2") || strings.Contains(string(data), "wifi-secret") {
+		t.Errorf("encrypted backup contains a secret: %s", data)
+	}
+
+	// Restore to a fresh device that already has a network of its own
+	fresh, freshNM, _ := newTestServer(t)
+	c = newTestClient(t, fresh.URL)
+	freshNM.connections["Other"] = fakeConnection{password: "other"}
+	freshNM.env = map[string]string{"MODE": "dev"}
+
+	var apiErr *Error
+	if _, err := c.PreviewRestore(ctx, data, ""); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("PreviewRestore without the passphrase = %v, want a 400", err)
+	}
+	preview, err := c.PreviewRestore(ctx, data, "correct horse")
+	if err != nil {
+		t.Fatalf("PreviewRestore: %v", err)
+	}
+	if len(preview.Networks) != 1 || preview.Networks[0].Action != "add" || len(preview.Env.Added) != 1 || len(preview.Env.Changed) != 1 {
+		t.Errorf("preview = %+v, want HomeWiFi and TOKEN added, MODE changed", preview)
+	}
+	if preview.Env.Added[0].New != api.SecretMask {
+		t.Errorf("secret in preview = %+v, want it masked", preview.Env.Added[0])
+	}
+
+	result, err := c.Restore(ctx, data, "correct horse")
+	if err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if len(result.Networks) != 1 || len(result.Env) != 2 {
+		t.Errorf("result = %+v", result)
+	}
+	if conn := freshNM.connections["HomeWiFi"]; conn.password != "wifi-secret" || !conn.autoConnect {
+		t.Errorf("restored network = %+v", conn)
+	}
+	if _, ok := freshNM.connections["Other"]; !ok {
+		t.Error("restore removed a network missing from the backup")
+	}
+	want := map[string]string{"MODE": "prod", "TOKEN": "hunter2"}
+	if vars, _ := freshNM.GetEnvironmentVariables(); !maps.Equal(vars, want) || !freshNM.secrets["TOKEN"] {
+		t.Errorf("variables after restore = %v, secrets %v", vars, freshNM.secrets)
+	}
+
+	// Restoring again changes nothing
+	if preview, _ := c.PreviewRestore(ctx, data, "correct horse"); preview.Networks[0].Action != "unchanged" || len(preview.Env.Added)+len(preview.Env.Changed) != 0 {
+		t.Errorf("preview after restore = %+v", preview)
+	}
+}
+
+func TestDesiredState(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "desired.yaml")
+	nm := newFakeNetworkManager()
+	nm.connections["Old"] = fakeConnection{password: "old"}
+	nm.env = map[string]string{"MODE": "dev", "STALE": "1"}
+	pifi, err := server.New(server.Options{
+		NetworkManager: nm,
+		State:          state.New(filepath.Join(t.TempDir(), "state.json"), state.Legacy{}),
+		DesiredState:   file,
+	})
+	if err != nil {
+		t.Fatalf("server.New: %v", err)
+	}
+	ts := httptest.NewServer(pifi)
+	t.Cleanup(ts.Close)
+	c := newTestClient(t, ts.URL)
+	ctx := context.Background()
+
+	var apiErr *Error
+	if _, err := c.GetDesiredState(ctx); !errors.As(err, &apiErr) || apiErr.Code != api.CodeNotFound {
+		t.Errorf("GetDesiredState without a file = %v, want %s", err, api.CodeNotFound)
+	}
+
+	desiredState := `
+networks:
+  - ssid: HomeWiFi
+    password: wifi-secret
+    priority: 10
+ap:
+  band: a
+env:
+  variables:
+    MODE: prod
+  secrets:
+    TOKEN: hunter2
+prune:
+  networks: true
+  env: true
+`
+	if err := os.WriteFile(file, []byte(desiredState), 0600); err != nil {
+		t.Fatal(err)
+	}
+	status, err := c.GetDesiredState(ctx)
+	if err != nil {
+		t.Fatalf("GetDesiredState: %v", err)
+	}
+	if len(status.Drift) != 6 {
+		t.Errorf("drift = %+v, want HomeWiFi added, Old removed, the band, MODE and TOKEN set and STALE unset", status.Drift)
+	}
+	for _, change := range status.Drift {
+		if change.Name == "TOKEN" && change.New != api.SecretMask {
+			t.Errorf("secret in drift = %+v, want it masked", change)
+		}
+	}
+
+	if _, err := c.ReconcileDesiredState(ctx); err != nil {
+		t.Fatalf("ReconcileDesiredState: %v", err)
+	}
+	if conn := nm.connections["HomeWiFi"]; conn.password != "wifi-secret" || conn.priority != 10 || !conn.autoConnect {
+		t.Errorf("HomeWiFi = %+v", conn)
+	}
+	if _, ok := nm.connections["Old"]; ok || nm.apBand != "a" {
+		t.Errorf("connections = %v, band %s", nm.connections, nm.apBand)
+	}
+	want := map[string]string{"MODE": "prod", "TOKEN": "hunter2"}
+	if vars, _ := nm.GetEnvironmentVariables(); !maps.Equal(vars, want) || !nm.secrets["TOKEN"] || nm.actor != desired.Actor {
+		t.Errorf("variables = %v, secrets %v, actor %q", vars, nm.secrets, nm.actor)
+	}
+
+	// Reconciling again changes nothing
+	status, err = c.ReconcileDesiredState(ctx)
+	if err != nil || len(status.LastApplied) != 0 || len(status.Drift) != 0 || status.LastReconcile == nil {
+		t.Errorf("second reconcile = %+v, %v", status, err)
+	}
+}
+
+func TestEnvironmentProvenance(t *testing.T) {
+	ts, nm, _ := newTestServer(t)
+	c := newTestClient(t, ts.URL)
+	ctx := context.Background()
+	nm.env = map[string]string{"API_URL": "https://example.com", "TOKEN": "hunter2"}
+	nm.secrets = map[string]bool{"TOKEN": true}
+	nm.targets = map[string]networkmanager.EnvTarget{"TOKEN": {Restart: []string{"stale.service"}}}
+
+	provenance, err := c.GetEnvironmentProvenance(ctx)
+	if err != nil {
+		t.Fatalf("GetEnvironmentProvenance: %v", err)
+	}
+	if p := provenance["API_URL"]; p.Source != "/etc/environment" || len(p.Drift) != 0 {
+		t.Errorf("provenance of API_URL = %+v", p)
+	}
+	// The value of a secret in a running process is masked too
+	if drift := provenance["TOKEN"].Drift; len(drift) != 1 || drift[0].Process != "stale.service" || *drift[0].Value != api.SecretMask {
+		t.Errorf("drift of TOKEN = %+v, want stale.service with a masked value", drift)
+	}
+}
+
+func TestEnvironmentHistory(t *testing.T) {
+	ts, nm, _ := newTestServer(t)
+	c := newTestClient(t, ts.URL)
+	ctx := context.Background()
+
+	c.SetEnvironmentVariable(ctx, "GREETING", "hello")
+	c.SetEnvironmentVariable(ctx, "GREETING", "hi")
+	c.SetEnvironmentVariable(ctx, "OTHER", "x")
+
+	revisions, err := c.GetEnvironmentHistory(ctx, "GREETING")
+	if err != nil {
+		t.Fatalf("GetEnvironmentHistory: %v", err)
+	}
+	if len(revisions) != 2 || *revisions[0].New != "hi" || revisions[0].Actor != "127.0.0.1" {
+		t.Fatalf("history of GREETING = %+v, want 2 revisions by 127.0.0.1, newest first", revisions)
+	}
+
+	result, err := c.RollbackEnvironment(ctx, revisions[1].ID, "")
+	if err != nil {
+		t.Fatalf("RollbackEnvironment: %v", err)
+	}
+	if !slices.Equal(result.Set, []string{"GREETING"}) || !slices.Equal(result.Unset, []string{"OTHER"}) {
+		t.Errorf("rollback = %+v, want GREETING set and OTHER unset", result.EnvRollback)
+	}
+	if vars, _ := nm.GetEnvironmentVariables(); !maps.Equal(vars, map[string]string{"GREETING": "hello"}) {
+		t.Errorf("variables after rollback = %v", vars)
+	}
+
+	var apiErr *Error
+	if _, err := c.RollbackEnvironment(ctx, 99, ""); !errors.As(err, &apiErr) || apiErr.Code != api.CodeNotFound {
+		t.Errorf("RollbackEnvironment to a missing revision = %v, want %s", err, api.CodeNotFound)
+	}
+}
+
+func TestEnvironmentPassword(t *testing.T) {
+	ts, nm, tokens := newTestServer(t)
+	ctx := context.Background()
+	nm.SetEnvPassword("hunter2")
+
+	_, err := newTestClient(t, ts.URL).GetEnvironmentVariables(ctx)
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized || apiErr.Code != api.CodeEnvPassword {
+		t.Errorf("request without the env password = %v, want %s", err, api.CodeEnvPassword)
+	}
+	if _, err := newTestClient(t, ts.URL, WithEnvPassword("hunter2")).GetEnvironmentVariables(ctx); err != nil {
+		t.Errorf("request with the env password: %v", err)
+	}
+
+	// A token with the env:manage scope replaces the password
+	secret, _, err := tokens.Create("deploy", []string{handlers.ScopeEnvManage}, 0)
+	if err != nil {
+		t.Fatalf("Create token: %v", err)
+	}
+	if err := newTestClient(t, ts.URL, WithToken(secret)).SetEnvironmentVariable(ctx, "A", "1"); err != nil {
+		t.Errorf("SetEnvironmentVariable with an env:manage token: %v", err)
+	}
+	if _, err := newTestClient(t, ts.URL, WithEnvPassword("hunter2")).GetEnvironmentVariables(ctx); !IsUnauthorized(err) {
+		t.Errorf("env password without a token once tokens exist = %v, want unauthorized", err)
+	}
+}
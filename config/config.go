@@ -0,0 +1,531 @@
+// Package config builds the effective PiFi configuration from defaults, a YAML config file,
+// PIFI_* environment variables and command line flags.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ztkent/pifi/desired"
+	"github.com/ztkent/pifi/filestore"
+	"github.com/ztkent/pifi/html/handlers"
+	"github.com/ztkent/pifi/networkmanager"
+	"github.com/ztkent/pifi/server"
+	"github.com/ztkent/pifi/state"
+	"github.com/ztkent/pifi/tlscert"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	DefaultFile = "/etc/pifi/config.yaml"
+	envPrefix   = "PIFI_"
+)
+
+type Config struct {
+	File    string        `yaml:"-" json:"file,omitempty"` // Config file that was loaded, if any
+	HTTP    HTTPConfig    `yaml:"http" json:"http"`
+	TLS     TLSConfig     `yaml:"tls" json:"tls"`
+	AP      APConfig      `yaml:"ap" json:"ap"`
+	Auth    AuthConfig    `yaml:"auth" json:"auth"`
+	Env     EnvConfig     `yaml:"env" json:"env"`
+	Desired DesiredConfig `yaml:"desired" json:"desired"`
+	Files   FilesConfig   `yaml:"files" json:"files"`
+
+	store *state.Store // Built by the first call to State
+}
+
+type HTTPConfig struct {
+	Addr            string   `yaml:"addr" json:"addr"`
+	ReadTimeout     Duration `yaml:"read_timeout" json:"readTimeout"`
+	WriteTimeout    Duration `yaml:"write_timeout" json:"writeTimeout"`
+	ShutdownTimeout Duration `yaml:"shutdown_timeout" json:"shutdownTimeout"`
+}
+
+type TLSConfig struct {
+	Enabled      bool   `yaml:"enabled" json:"enabled"`
+	Addr         string `yaml:"addr" json:"addr"`
+	CertFile     string `yaml:"cert_file" json:"certFile"`
+	KeyFile      string `yaml:"key_file" json:"keyFile"`
+	RedirectHTTP bool   `yaml:"redirect_http" json:"redirectHttp"`
+}
+
+type APConfig struct {
+	Auto            bool     `yaml:"auto" json:"auto"`
+	Timeout         Duration `yaml:"timeout" json:"timeout"`
+	MonitorInterval Duration `yaml:"monitor_interval" json:"monitorInterval"`
+	Interface       string   `yaml:"interface" json:"interface"`
+	SSIDPrefix      string   `yaml:"ssid_prefix" json:"ssidPrefix"`
+	Band            string   `yaml:"band" json:"band"`
+}
+
+type AuthConfig struct {
+	SessionTTL         Duration `yaml:"session_ttl" json:"sessionTtl"`
+	SessionIdleTimeout Duration `yaml:"session_idle_timeout" json:"sessionIdleTimeout"`
+	MaxLoginFailures   int      `yaml:"max_login_failures" json:"maxLoginFailures"`
+	LoginLockout       Duration `yaml:"login_lockout" json:"loginLockout"`
+}
+
+type EnvConfig struct {
+	EncryptSecrets bool `yaml:"encrypt_secrets" json:"encryptSecrets"`
+	// Files read, in order, for managed variables their target file doesn't set
+	Sources []string `yaml:"sources" json:"sources"`
+}
+
+type DesiredConfig struct {
+	// File describes the networks, AP band and environment variables the device is kept at.
+	// Empty, the default, disables it: the file can remove networks and unset variables, so it is opt-in.
+	File string `yaml:"file" json:"file"`
+	// WatchInterval is how often the file is checked for changes to reconcile, 0 only reconciles at startup
+	WatchInterval Duration `yaml:"watch_interval" json:"watchInterval"`
+}
+
+type FilesConfig struct {
+	// State holds the password, managed variables, secrets, history, tokens and users
+	State string `yaml:"state" json:"state"`
+	// Files of earlier versions, imported into the state file once and renamed with a .migrated suffix
+	EnvPassword    string `yaml:"env_password" json:"envPassword"`
+	ManagedEnvVars string `yaml:"managed_env_vars" json:"managedEnvVars"`
+	DeviceKey      string `yaml:"device_key" json:"deviceKey"`
+	SecretEnv      string `yaml:"secret_env" json:"secretEnv"`
+	EnvSchema      string `yaml:"env_schema" json:"envSchema"`
+}
+
+// Default returns the configuration used when nothing is overridden
+func Default() *Config {
+	return &Config{
+		HTTP: HTTPConfig{
+			Addr:            "0.0.0.0:8088",
+			ReadTimeout:     Duration(15 * time.Second),
+			WriteTimeout:    Duration(15 * time.Second),
+			ShutdownTimeout: Duration(15 * time.Second),
+		},
+		TLS: TLSConfig{
+			Addr:     "0.0.0.0:8443",
+			CertFile: tlscert.DefaultCertFile,
+			KeyFile:  tlscert.DefaultKeyFile,
+		},
+		AP: APConfig{
+			Auto:            true,
+			Timeout:         Duration(30 * time.Second),
+			MonitorInterval: Duration(networkmanager.DefaultMonitorInterval),
+			Interface:       networkmanager.DefaultInterface,
+			SSIDPrefix:      networkmanager.DefaultAPSSIDPrefix,
+			Band:            networkmanager.DefaultAPBand,
+		},
+		Auth: AuthConfig{
+			SessionTTL:         Duration(handlers.DefaultSessionTTL),
+			SessionIdleTimeout: Duration(handlers.DefaultSessionIdleTimeout),
+			MaxLoginFailures:   handlers.DefaultMaxLoginFailures,
+			LoginLockout:       Duration(handlers.DefaultLoginLockout),
+		},
+		Env: EnvConfig{
+			Sources: slices.Clone(networkmanager.DefaultEnvSources),
+		},
+		Files: FilesConfig{
+			State:          state.DefaultFile,
+			EnvPassword:    state.DefaultLegacy.EnvPassword,
+			ManagedEnvVars: state.DefaultLegacy.ManagedEnvVars,
+			DeviceKey:      networkmanager.DefaultDeviceKeyFile,
+			SecretEnv:      networkmanager.DefaultSecretEnvFile,
+			EnvSchema:      networkmanager.DefaultEnvSchemaFile,
+		},
+	}
+}
+
+// State returns the state file, importing the legacy files when it is first written.
+// Every call returns the same store, so the server and the NetworkManager share it.
+func (c *Config) State() *state.Store {
+	if c.store == nil {
+		c.store = state.New(c.Files.State, state.Legacy{
+			EnvPassword:    c.Files.EnvPassword,
+			ManagedEnvVars: c.Files.ManagedEnvVars,
+		})
+	}
+	return c.store
+}
+
+// NetworkManagerOptions returns the options for networkmanager.NewWithOptions
+func (c *Config) NetworkManagerOptions() networkmanager.Options {
+	return networkmanager.Options{
+		Interface:       c.AP.Interface,
+		APSSIDPrefix:    c.AP.SSIDPrefix,
+		APBand:          c.AP.Band,
+		MonitorInterval: time.Duration(c.AP.MonitorInterval),
+		EncryptSecrets:  c.Env.EncryptSecrets,
+		DeviceKeyFile:   c.Files.DeviceKey,
+		SecretEnvFile:   c.Files.SecretEnv,
+		EnvSchemaFile:   c.Files.EnvSchema,
+		EnvSources:      c.Env.Sources,
+		State:           c.State(),
+	}
+}
+
+// ServerOptions returns the options for server.New, without the NetworkManager or TLS fingerprint
+func (c *Config) ServerOptions() server.Options {
+	return server.Options{
+		OfflineAP:        c.AP.Auto,
+		OfflineAPTimeout: time.Duration(c.AP.Timeout),
+		Auth: server.AuthOptions{
+			SessionTTL:         time.Duration(c.Auth.SessionTTL),
+			SessionIdleTimeout: time.Duration(c.Auth.SessionIdleTimeout),
+			MaxLoginFailures:   c.Auth.MaxLoginFailures,
+			LoginLockout:       time.Duration(c.Auth.LoginLockout),
+		},
+		Config:            c,
+		State:             c.State(),
+		DesiredState:      c.Desired.File,
+		DesiredStateWatch: time.Duration(c.Desired.WatchInterval),
+	}
+}
+
+// setting is a config value that can be overridden by a flag and a PIFI_* environment variable
+type setting struct {
+	flag  string
+	usage string
+	value func(c *Config) flag.Value
+}
+
+// envName returns the environment variable for a flag, -tls-addr is PIFI_TLS_ADDR
+func (s setting) envName() string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(s.flag, "-", "_"))
+}
+
+var settings = []setting{
+	{"addr", "HTTP listen address", func(c *Config) flag.Value { return (*stringValue)(&c.HTTP.Addr) }},
+	{"read-timeout", "HTTP read timeout", func(c *Config) flag.Value { return &c.HTTP.ReadTimeout }},
+	{"write-timeout", "HTTP write timeout", func(c *Config) flag.Value { return &c.HTTP.WriteTimeout }},
+	{"shutdown-timeout", "Time allowed for in-flight requests on shutdown", func(c *Config) flag.Value { return &c.HTTP.ShutdownTimeout }},
+
+	{"tls", "Serve HTTPS in addition to HTTP", func(c *Config) flag.Value { return (*boolValue)(&c.TLS.Enabled) }},
+	{"tls-addr", "HTTPS listen address", func(c *Config) flag.Value { return (*stringValue)(&c.TLS.Addr) }},
+	{"tls-cert", "TLS certificate file, a self-signed certificate is generated here if it doesn't exist", func(c *Config) flag.Value { return (*stringValue)(&c.TLS.CertFile) }},
+	{"tls-key", "TLS private key file", func(c *Config) flag.Value { return (*stringValue)(&c.TLS.KeyFile) }},
+	{"redirect-http", "Redirect HTTP requests to HTTPS when -tls is set", func(c *Config) flag.Value { return (*boolValue)(&c.TLS.RedirectHTTP) }},
+
+	{"auto", "Enable automatic AP mode with no internet connection", func(c *Config) flag.Value { return (*boolValue)(&c.AP.Auto) }},
+	{"timeout", "Offline time before re-enabling AP mode, plain numbers are seconds", func(c *Config) flag.Value { return &c.AP.Timeout }},
+	{"monitor-interval", "How often the connection is checked when -auto is set", func(c *Config) flag.Value { return &c.AP.MonitorInterval }},
+	{"interface", "WiFi interface used for client and AP mode", func(c *Config) flag.Value { return (*stringValue)(&c.AP.Interface) }},
+	{"ap-ssid-prefix", "AP SSID prefix, followed by 4 random characters", func(c *Config) flag.Value { return (*stringValue)(&c.AP.SSIDPrefix) }},
+	{"ap-band", "AP band, bg (2.4GHz) or a (5GHz)", func(c *Config) flag.Value { return (*stringValue)(&c.AP.Band) }},
+
+	{"session-ttl", "Maximum lifetime of a login session", func(c *Config) flag.Value { return &c.Auth.SessionTTL }},
+	{"session-idle-timeout", "Idle time before a login session expires", func(c *Config) flag.Value { return &c.Auth.SessionIdleTimeout }},
+	{"max-login-failures", "Failed logins before a client is locked out", func(c *Config) flag.Value { return (*intValue)(&c.Auth.MaxLoginFailures) }},
+	{"login-lockout", "How long a client is locked out after too many failed logins", func(c *Config) flag.Value { return &c.Auth.LoginLockout }},
+
+	{"encrypt-secrets", "Keep secret environment variables encrypted with the device key instead of in /etc/environment", func(c *Config) flag.Value { return (*boolValue)(&c.Env.EncryptSecrets) }},
+	{"env-sources", "Comma separated files read for managed variables their target file doesn't set", func(c *Config) flag.Value { return (*listValue)(&c.Env.Sources) }},
+
+	{"desired-state-file", "Desired state file reconciled at startup, such as " + desired.DefaultFile + ", empty disables it", func(c *Config) flag.Value { return (*stringValue)(&c.Desired.File) }},
+	{"desired-state-watch", "How often the desired state file is checked for changes, 0 disables", func(c *Config) flag.Value { return &c.Desired.WatchInterval }},
+
+	{"state-file", "State file holding the password, managed variables, secrets, history, tokens and users", func(c *Config) flag.Value { return (*stringValue)(&c.Files.State) }},
+	{"password-file", "Legacy environment password hash file, migrated into the state file", func(c *Config) flag.Value { return (*stringValue)(&c.Files.EnvPassword) }},
+	{"managed-vars-file", "Legacy managed environment variable list file, migrated into the state file", func(c *Config) flag.Value { return (*stringValue)(&c.Files.ManagedEnvVars) }},
+	{"device-key-file", "Key secret environment variables are encrypted with, generated if it doesn't exist", func(c *Config) flag.Value { return (*stringValue)(&c.Files.DeviceKey) }},
+	{"secret-env-file", "File encrypted secrets are decrypted to for services, with -encrypt-secrets", func(c *Config) flag.Value { return (*stringValue)(&c.Files.SecretEnv) }},
+	{"env-schema-file", "Schema environment variables are validated against, if it exists", func(c *Config) flag.Value { return (*stringValue)(&c.Files.EnvSchema) }},
+}
+
+// Load returns the effective configuration for the command line arguments.
+// Values are applied in order of precedence: defaults, the config file, PIFI_* environment variables, then flags.
+// flag.ErrHelp is returned when -h is passed.
+func Load(args []string) (*Config, error) {
+	fs := flag.NewFlagSet("pifi", flag.ContinueOnError)
+	configFile := fs.String("config", DefaultFile, "Path to the YAML config file, also set by PIFI_CONFIG")
+	flagged := Default()
+	for _, s := range settings {
+		fs.Var(s.value(flagged), s.flag, fmt.Sprintf("%s (%s)", s.usage, s.envName()))
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	// A missing config file is only an error when one was asked for
+	path, required := DefaultFile, false
+	if env, ok := os.LookupEnv("PIFI_CONFIG"); ok {
+		path, required = env, true
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "config" {
+			path, required = *configFile, true
+		}
+	})
+
+	cfg := Default()
+	if err := cfg.loadFile(path, required); err != nil {
+		return nil, err
+	}
+
+	for _, s := range settings {
+		if value, ok := os.LookupEnv(s.envName()); ok {
+			if err := s.value(cfg).Set(value); err != nil {
+				return nil, fmt.Errorf("invalid %s=%q: %v", s.envName(), value, err)
+			}
+		}
+	}
+
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "config" || flagErr != nil {
+			return
+		}
+		for _, s := range settings {
+			if s.flag == f.Name {
+				flagErr = s.value(cfg).Set(f.Value.String())
+			}
+		}
+	})
+	if flagErr != nil {
+		return nil, flagErr
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// loadFile decodes the YAML config file over the current values, unknown keys are rejected
+func (c *Config) loadFile(path string, required bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && !required {
+			return nil
+		}
+		return fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	if err := c.decode(data); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+	c.File = path
+	return nil
+}
+
+// decode decodes a YAML config file over the current values, unknown keys are rejected
+func (c *Config) decode(data []byte) error {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// MarshalBackup returns the effective configuration as a config file, for backups
+func (c *Config) MarshalBackup() ([]byte, error) {
+	return yaml.Marshal(c)
+}
+
+// RestoreBackup validates a config file from a backup and writes it over the loaded config file,
+// or /etc/pifi/config.yaml if none was loaded. It takes effect when PiFi restarts.
+func (c *Config) RestoreBackup(data []byte) error {
+	restored := Default()
+	if err := restored.decode(data); err != nil {
+		return fmt.Errorf("invalid config in the backup: %v", err)
+	}
+	if err := restored.Validate(); err != nil {
+		return fmt.Errorf("invalid config in the backup: %v", err)
+	}
+
+	path := c.File
+	if path == "" {
+		path = DefaultFile
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %v", filepath.Dir(path), err)
+	}
+	return filestore.Write(path, data, 0644)
+}
+
+// Validate checks every value and reports all problems at once
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, field, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+		}
+	}
+
+	check(validAddr(c.HTTP.Addr), "http.addr", "%q is not a valid host:port address", c.HTTP.Addr)
+	check(c.HTTP.ReadTimeout > 0, "http.read_timeout", "must be greater than 0")
+	check(c.HTTP.WriteTimeout > 0, "http.write_timeout", "must be greater than 0")
+	check(c.HTTP.ShutdownTimeout > 0, "http.shutdown_timeout", "must be greater than 0")
+
+	if c.TLS.Enabled {
+		check(validAddr(c.TLS.Addr), "tls.addr", "%q is not a valid host:port address", c.TLS.Addr)
+		check(c.TLS.Addr != c.HTTP.Addr, "tls.addr", "must be different from http.addr")
+		check(filepath.IsAbs(c.TLS.CertFile), "tls.cert_file", "%q must be an absolute path", c.TLS.CertFile)
+		check(filepath.IsAbs(c.TLS.KeyFile), "tls.key_file", "%q must be an absolute path", c.TLS.KeyFile)
+	} else {
+		check(!c.TLS.RedirectHTTP, "tls.redirect_http", "requires tls.enabled")
+	}
+
+	check(c.AP.Timeout >= Duration(time.Second), "ap.timeout", "must be at least 1s")
+	check(c.AP.MonitorInterval >= Duration(time.Second), "ap.monitor_interval", "must be at least 1s")
+	check(c.AP.Interface != "" && !strings.ContainsAny(c.AP.Interface, " /:"), "ap.interface", "%q is not a valid interface name", c.AP.Interface)
+	check(c.AP.SSIDPrefix != "", "ap.ssid_prefix", "must not be empty")
+	check(len(c.AP.SSIDPrefix)+4 <= 32, "ap.ssid_prefix", "must be at most 28 bytes, SSIDs are limited to 32")
+	check(c.AP.Band == "bg" || c.AP.Band == "a", "ap.band", "%q must be bg or a", c.AP.Band)
+
+	check(c.Auth.SessionTTL > 0, "auth.session_ttl", "must be greater than 0")
+	check(c.Auth.SessionIdleTimeout > 0, "auth.session_idle_timeout", "must be greater than 0")
+	check(c.Auth.MaxLoginFailures >= 1, "auth.max_login_failures", "must be at least 1")
+	check(c.Auth.LoginLockout > 0, "auth.login_lockout", "must be greater than 0")
+
+	for _, source := range c.Env.Sources {
+		check(filepath.IsAbs(source), "env.sources", "%q must be an absolute path", source)
+	}
+
+	check(c.Desired.File == "" || filepath.IsAbs(c.Desired.File), "desired.file", "%q must be an absolute path", c.Desired.File)
+	check(c.Desired.WatchInterval == 0 || c.Desired.WatchInterval >= Duration(time.Second), "desired.watch_interval", "must be 0 or at least 1s")
+
+	check(filepath.IsAbs(c.Files.State), "files.state", "%q must be an absolute path", c.Files.State)
+	check(filepath.IsAbs(c.Files.EnvPassword), "files.env_password", "%q must be an absolute path", c.Files.EnvPassword)
+	check(filepath.IsAbs(c.Files.ManagedEnvVars), "files.managed_env_vars", "%q must be an absolute path", c.Files.ManagedEnvVars)
+	check(filepath.IsAbs(c.Files.DeviceKey), "files.device_key", "%q must be an absolute path", c.Files.DeviceKey)
+	check(filepath.IsAbs(c.Files.SecretEnv), "files.secret_env", "%q must be an absolute path", c.Files.SecretEnv)
+	check(filepath.IsAbs(c.Files.EnvSchema), "files.env_schema", "%q must be an absolute path", c.Files.EnvSchema)
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+func validAddr(addr string) bool {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n <= 65535
+}
+
+// Duration is a time.Duration written as "30s" or "5m" in config files and flags.
+// Plain numbers are read as seconds, so -timeout 30 keeps working.
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d *Duration) Set(s string) error {
+	return d.UnmarshalText([]byte(s))
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	s := strings.TrimSpace(string(text))
+	if seconds, err := strconv.Atoi(s); err == nil {
+		*d = Duration(time.Duration(seconds) * time.Second)
+		return nil
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", s)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// UnmarshalYAML reads durations through UnmarshalText, so plain numbers are seconds rather than nanoseconds
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.ScalarNode {
+		return fmt.Errorf("line %d: expected a duration", node.Line)
+	}
+	if err := d.UnmarshalText([]byte(node.Value)); err != nil {
+		return fmt.Errorf("line %d: %v", node.Line, err)
+	}
+	return nil
+}
+
+type stringValue string
+
+func (v *stringValue) String() string {
+	if v == nil {
+		return ""
+	}
+	return string(*v)
+}
+
+func (v *stringValue) Set(s string) error {
+	*v = stringValue(s)
+	return nil
+}
+
+// listValue is a comma separated list, empty items are dropped
+type listValue []string
+
+func (v *listValue) String() string {
+	if v == nil {
+		return ""
+	}
+	return strings.Join(*v, ",")
+}
+
+func (v *listValue) Set(s string) error {
+	*v = listValue{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*v = append(*v, item)
+		}
+	}
+	return nil
+}
+
+type boolValue bool
+
+func (v *boolValue) String() string {
+	if v == nil {
+		return "false"
+	}
+	return strconv.FormatBool(bool(*v))
+}
+
+func (v *boolValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return fmt.Errorf("invalid boolean %q", s)
+	}
+	*v = boolValue(b)
+	return nil
+}
+
+func (v *boolValue) IsBoolFlag() bool { return true }
+
+type intValue int
+
+func (v *intValue) String() string {
+	if v == nil {
+		return "0"
+	}
+	return strconv.Itoa(int(*v))
+}
+
+func (v *intValue) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("invalid number %q", s)
+	}
+	*v = intValue(n)
+	return nil
+}
@@ -0,0 +1,168 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadPrecedence(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		file    string
+		env     map[string]string
+		args    []string
+		addr    string
+		timeout time.Duration
+	}{
+		{"defaults", "", nil, nil, "0.0.0.0:8088", 30 * time.Second},
+		{"file", "http:\n  addr: 127.0.0.1:9000\nap:\n  timeout: 45\n", nil, nil, "127.0.0.1:9000", 45 * time.Second},
+		{"env over file", "http:\n  addr: 127.0.0.1:9000\n", map[string]string{"PIFI_ADDR": "127.0.0.1:9001", "PIFI_TIMEOUT": "1m"}, nil, "127.0.0.1:9001", time.Minute},
+		{"flag over env", "http:\n  addr: 127.0.0.1:9000\n", map[string]string{"PIFI_ADDR": "127.0.0.1:9001"}, []string{"-addr", "127.0.0.1:9002", "-timeout", "20"}, "127.0.0.1:9002", 20 * time.Second},
+		{"flag without file", "", nil, []string{"-timeout=2m"}, "0.0.0.0:8088", 2 * time.Minute},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(tc.file), 0644); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("PIFI_CONFIG", path)
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+
+			cfg, err := Load(tc.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.HTTP.Addr != tc.addr {
+				t.Errorf("http.addr = %q, want %q", cfg.HTTP.Addr, tc.addr)
+			}
+			if time.Duration(cfg.AP.Timeout) != tc.timeout {
+				t.Errorf("ap.timeout = %v, want %v", cfg.AP.Timeout, tc.timeout)
+			}
+		})
+	}
+}
+
+func TestDesiredStateOptIn(t *testing.T) {
+	t.Setenv("PIFI_CONFIG", filepath.Join(t.TempDir(), "config.yaml"))
+	os.WriteFile(os.Getenv("PIFI_CONFIG"), nil, 0644)
+	cfg, err := Load(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Desired.File != "" || cfg.ServerOptions().DesiredState != "" {
+		t.Errorf("desired state file = %q by default, want it disabled", cfg.Desired.File)
+	}
+
+	cfg, err = Load([]string{"-desired-state-file", "/etc/pifi/desired.yaml"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ServerOptions().DesiredState != "/etc/pifi/desired.yaml" {
+		t.Errorf("desired state file = %q, want the one set", cfg.ServerOptions().DesiredState)
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	os.WriteFile(path, []byte("http:\n  addr: 127.0.0.1:9000\n"), 0644)
+
+	// -config takes precedence over PIFI_CONFIG
+	t.Setenv("PIFI_CONFIG", filepath.Join(dir, "missing.yaml"))
+	if cfg, err := Load([]string{"-config", path}); err != nil || cfg.File != path {
+		t.Errorf("Load(-config) = %v, %v", cfg, err)
+	}
+	// A config file that was asked for must exist
+	if _, err := Load(nil); err == nil {
+		t.Error("missing PIFI_CONFIG file accepted")
+	}
+	if _, err := Load([]string{"-config", filepath.Join(dir, "missing.yaml")}); err == nil {
+		t.Error("missing -config file accepted")
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+		want string
+	}{
+		{"unknown key", "http:\n  adress: 127.0.0.1:9000\n", nil, nil, "adress"},
+		{"bad duration in file", "ap:\n  timeout: soon\n", nil, nil, "invalid duration"},
+		{"bad env value", "", map[string]string{"PIFI_MAX_LOGIN_FAILURES": "many"}, nil, "PIFI_MAX_LOGIN_FAILURES"},
+		{"bad flag value", "", nil, []string{"-tls=maybe"}, "invalid boolean"},
+		{"unknown flag", "", nil, []string{"-colour"}, "colour"},
+		{"extra arguments", "", nil, []string{"serve"}, "unexpected arguments"},
+		{"invalid after flags", "", nil, []string{"-ap-band", "n"}, "ap.band"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			os.WriteFile(path, []byte(tc.file), 0644)
+			t.Setenv("PIFI_CONFIG", path)
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+
+			_, err := Load(tc.args)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("Load = %v, want an error mentioning %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		change func(c *Config)
+		want   []string
+	}{
+		{"defaults", func(c *Config) {}, nil},
+		{"bad address", func(c *Config) { c.HTTP.Addr = "localhost" }, []string{"http.addr"}},
+		{"port out of range", func(c *Config) { c.HTTP.Addr = ":70000" }, []string{"http.addr"}},
+		{"same tls address", func(c *Config) { c.TLS.Enabled = true; c.TLS.Addr = c.HTTP.Addr }, []string{"tls.addr"}},
+		{"redirect without tls", func(c *Config) { c.TLS.RedirectHTTP = true }, []string{"tls.redirect_http"}},
+		{"short timeout", func(c *Config) { c.AP.Timeout = Duration(time.Millisecond) }, []string{"ap.timeout"}},
+		{"long ssid prefix", func(c *Config) { c.AP.SSIDPrefix = strings.Repeat("x", 29) }, []string{"ap.ssid_prefix"}},
+		{"relative paths", func(c *Config) { c.Files.State = "state.json"; c.Env.Sources = []string{"pifi"} }, []string{"files.state", "env.sources"}},
+		{"every problem at once", func(c *Config) {
+			c.AP.Band = "n"
+			c.Auth.MaxLoginFailures = 0
+			c.Desired.WatchInterval = Duration(time.Millisecond)
+		}, []string{"ap.band", "auth.max_login_failures", "desired.watch_interval"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := Default()
+			tc.change(cfg)
+			err := cfg.Validate()
+			if len(tc.want) == 0 {
+				if err != nil {
+					t.Errorf("Validate = %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Validate accepted the config, want errors for %v", tc.want)
+			}
+			for _, field := range tc.want {
+				if !strings.Contains(err.Error(), field) {
+					t.Errorf("Validate = %v, want an error for %s", err, field)
+				}
+			}
+		})
+	}
+}
+
+func TestStateShared(t *testing.T) {
+	cfg := Default()
+	if cfg.ServerOptions().State != cfg.NetworkManagerOptions().State {
+		t.Error("the server and the NetworkManager use different state stores")
+	}
+}
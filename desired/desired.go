@@ -0,0 +1,107 @@
+// Package desired keeps a device at the state described by a desired state file: the saved networks,
+// the AP band and the managed environment variables. A Reconciler compares the file to the device
+// and applies the differences, so applying the same file twice changes nothing.
+package desired
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ztkent/pifi/networkmanager"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultFile is the suggested location of the desired state file, it is only read once configured
+const DefaultFile = "/etc/pifi/desired.yaml"
+
+// State is a desired state file. Parts left out of it are not managed.
+type State struct {
+	Networks []Network `yaml:"networks"`
+	AP       *AP       `yaml:"ap"`
+	Env      *Env      `yaml:"env"`
+	Prune    Prune     `yaml:"prune"`
+}
+
+// Network is a saved network. Without a Password an open network is added, or the saved password kept.
+// AutoConnect defaults to true, higher priorities are preferred.
+type Network struct {
+	SSID        string `yaml:"ssid"`
+	Password    string `yaml:"password"`
+	AutoConnect *bool  `yaml:"auto_connect"`
+	Priority    int    `yaml:"priority"`
+}
+
+// AP is the access point settings
+type AP struct {
+	Band string `yaml:"band"`
+}
+
+// Env is the managed environment variables, Secrets are stored as secrets
+type Env struct {
+	Variables map[string]string `yaml:"variables"`
+	Secrets   map[string]string `yaml:"secrets"`
+}
+
+// Prune removes what the file doesn't list, by default it is only added and updated
+type Prune struct {
+	Networks bool `yaml:"networks"` // Saved networks, the AP and the connected network are kept
+	Env      bool `yaml:"env"`      // Managed variables, secrets included
+}
+
+// Load reads the desired state file at path, unknown keys are rejected.
+// A missing file fails with an error matching fs.ErrNotExist.
+func Load(path string) (*State, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read desired state file: %w", err)
+	}
+	s := &State{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(s); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to parse desired state file %s: %v", path, err)
+	}
+	if err := s.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid desired state file %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// Validate reports every mistake in the file at once
+func (s *State) Validate() error {
+	var errs []error
+	seen := map[string]bool{}
+	for _, n := range s.Networks {
+		switch {
+		case n.SSID == "":
+			errs = append(errs, fmt.Errorf("networks: a network has no ssid"))
+		case seen[n.SSID]:
+			errs = append(errs, fmt.Errorf("networks: %s is listed twice", n.SSID))
+		case n.Priority < networkmanager.MinPriority || n.Priority > networkmanager.MaxPriority:
+			errs = append(errs, fmt.Errorf("networks: priority of %s must be %d to %d", n.SSID, networkmanager.MinPriority, networkmanager.MaxPriority))
+		}
+		seen[n.SSID] = true
+	}
+	if s.AP != nil && s.AP.Band != "bg" && s.AP.Band != "a" {
+		errs = append(errs, fmt.Errorf("ap.band: %q must be bg or a", s.AP.Band))
+	}
+	if s.Env != nil {
+		for key := range s.Env.Secrets {
+			if _, ok := s.Env.Variables[key]; ok {
+				errs = append(errs, fmt.Errorf("env: %s is both a variable and a secret", key))
+			}
+		}
+	}
+	if s.Prune.Env && s.Env == nil {
+		errs = append(errs, fmt.Errorf("prune.env: requires an env section, it would unset every variable"))
+	}
+	return errors.Join(errs...)
+}
+
+// autoConnect returns whether the network connects on its own
+func (n Network) autoConnect() bool {
+	return n.AutoConnect == nil || *n.AutoConnect
+}
@@ -0,0 +1,277 @@
+package desired
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ztkent/pifi/networkmanager"
+)
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := Load(filepath.Join(dir, "missing.yaml")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Load of a missing file = %v, want fs.ErrNotExist", err)
+	}
+
+	file := filepath.Join(dir, "desired.yaml")
+	write := func(content string) {
+		if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("networks:\n  - ssid: Home\n    auto_connect: false\nenv:\n  variables:\n    A: b\n")
+	s, err := Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Networks[0].autoConnect() || s.Env.Variables["A"] != "b" || s.AP != nil {
+		t.Errorf("Load = %+v", s)
+	}
+
+	write("netwerks: []\n")
+	if _, err := Load(file); err == nil {
+		t.Error("Load accepted an unknown key")
+	}
+
+	write(`
+networks:
+  - ssid: Home
+  - ssid: Home
+    priority: 5000
+ap:
+  band: n
+env:
+  variables: {A: "1"}
+  secrets: {A: "2"}
+`)
+	_, err = Load(file)
+	for _, want := range []string{"Home is listed twice", "ap.band", "both a variable and a secret"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Load error = %v, want it to mention %q", err, want)
+		}
+	}
+
+	write("prune:\n  env: true\n")
+	if _, err := Load(file); err == nil {
+		t.Error("Load accepted pruning the environment without an env section")
+	}
+}
+
+// fakeNM keeps saved networks and variables in memory, other methods aren't implemented
+type fakeNM struct {
+	networkmanager.NetworkManager
+	mu        sync.Mutex // Guards env, secrets and envErr
+	saved     []networkmanager.SavedConnection
+	connected string
+	env       map[string]string
+	secrets   []string
+	envErr    error
+	restarted []string
+	listing   chan struct{} // If set, GetSavedConnections waits until it is closed
+}
+
+func (f *fakeNM) WithActor(string) networkmanager.NetworkManager { return f }
+
+func (f *fakeNM) GetSavedConnections() ([]networkmanager.SavedConnection, error) {
+	if f.listing != nil {
+		<-f.listing
+	}
+	return slices.Clone(f.saved), nil
+}
+
+func (f *fakeNM) ModifyNetworkConnection(ssid, password string, autoConnect bool) error {
+	f.saved = append(f.saved, networkmanager.SavedConnection{SSID: ssid, Password: password, AutoConnect: autoConnect})
+	return nil
+}
+
+func (f *fakeNM) SetConnectionPriority(string, int) error { return nil }
+
+func (f *fakeNM) RemoveNetworkConnection(ssid string) error {
+	f.saved = slices.DeleteFunc(f.saved, func(c networkmanager.SavedConnection) bool { return c.SSID == ssid })
+	return nil
+}
+
+func (f *fakeNM) GetNetworkStatus() (networkmanager.NetworkStatus, error) {
+	return networkmanager.NetworkStatus{WifiSSID: "Cafe WiFi", WifiConnection: f.connected}, nil
+}
+
+func (f *fakeNM) GetEnvironmentVariables() (map[string]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return maps.Clone(f.env), nil
+}
+
+func (f *fakeNM) GetEnvironmentSecrets() ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.secrets), nil
+}
+
+func (f *fakeNM) GetEnvironmentSchema() (*networkmanager.EnvSchema, error) {
+	return &networkmanager.EnvSchema{}, nil
+}
+
+func (f *fakeNM) SetEnvironmentVariable(key, value string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.env[key] = value
+	f.secrets = slices.DeleteFunc(f.secrets, func(s string) bool { return s == key })
+	return nil
+}
+
+func (f *fakeNM) ApplyEnvironment(set map[string]string, unset []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.envErr != nil {
+		return f.envErr
+	}
+	maps.Copy(f.env, set)
+	return nil
+}
+
+func (f *fakeNM) RestartEnvironmentUnits(keys []string) []networkmanager.UnitResult {
+	f.restarted = append(f.restarted, keys...)
+	return nil
+}
+
+func TestReconcileRecordsPartialChanges(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "desired.yaml")
+	content := "networks:\n  - ssid: Home\nenv:\n  variables:\n    MODE: prod\n"
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	nm := &fakeNM{env: map[string]string{}, envErr: errors.New("disk full")}
+	r := &Reconciler{File: file, NetworkManager: nm, Networks: true, Environment: true}
+
+	status, err := r.Reconcile()
+	if err == nil {
+		t.Fatal("Reconcile succeeded although the environment couldn't be written")
+	}
+	if len(status.LastApplied) != 1 || status.LastApplied[0].Name != "Home" || status.LastError == "" {
+		t.Errorf("status = %+v, want the network recorded as applied and the error", status)
+	}
+	if len(status.Drift) != 1 || status.Drift[0].Name != "MODE" {
+		t.Errorf("drift = %+v, want only MODE left", status.Drift)
+	}
+
+	nm.envErr = nil
+	if status, err = r.Reconcile(); err != nil || len(status.LastApplied) != 1 || status.LastApplied[0].Name != "MODE" {
+		t.Errorf("second reconcile = %+v, %v, want MODE applied", status, err)
+	}
+	if !slices.Equal(nm.restarted, []string{"MODE"}) {
+		t.Errorf("units restarted for %v, want MODE", nm.restarted)
+	}
+}
+
+func TestStatusDoesNotBlockReconcile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "desired.yaml")
+	if err := os.WriteFile(file, []byte("networks:\n  - ssid: Home\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	nm := &fakeNM{listing: make(chan struct{})}
+	r := &Reconciler{File: file, NetworkManager: nm, Networks: true}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.Status()
+	}()
+	// Status is waiting for the saved networks, without holding the lock
+	time.Sleep(10 * time.Millisecond)
+	if !r.mu.TryLock() {
+		t.Error("Status holds the lock while listing networks")
+	} else {
+		r.mu.Unlock()
+	}
+	close(nm.listing)
+	<-done
+}
+
+func TestPruneKeepsConnectedNetwork(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "desired.yaml")
+	if err := os.WriteFile(file, []byte("networks:\n  - ssid: Home\nprune:\n  networks: true\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	nm := &fakeNM{
+		saved:     []networkmanager.SavedConnection{{SSID: "Home", AutoConnect: true}, {SSID: "Cafe"}, {SSID: "Old"}},
+		connected: "Cafe",
+	}
+	r := &Reconciler{File: file, NetworkManager: nm, Networks: true}
+
+	status, err := r.Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.LastApplied) != 1 || status.LastApplied[0].Name != "Old" || status.LastApplied[0].Action != "remove" {
+		t.Errorf("applied = %+v, want only Old removed", status.LastApplied)
+	}
+	if len(nm.saved) != 2 || nm.saved[1].SSID != "Cafe" {
+		t.Errorf("saved = %+v, want Home and the connected Cafe kept", nm.saved)
+	}
+}
+
+func TestWatchRetriesFailedReconcile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "desired.yaml")
+	if err := os.WriteFile(file, []byte("env:\n  variables:\n    MODE: prod\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	nm := &fakeNM{env: map[string]string{}, envErr: errors.New("nmcli timed out")}
+	r := &Reconciler{File: file, NetworkManager: nm, Environment: true}
+	if _, err := r.Reconcile(); err == nil {
+		t.Fatal("Reconcile succeeded although the environment couldn't be written")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Watch(ctx, 10*time.Millisecond)
+	time.Sleep(30 * time.Millisecond)
+	nm.mu.Lock()
+	nm.envErr = nil
+	nm.mu.Unlock()
+
+	// The unchanged file is reconciled again once the error is gone
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status, err := r.Status()
+		if err == nil && status.LastError == "" && len(status.Drift) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("status = %+v, %v, want the failed reconcile retried", status, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReconcileMakesSecretPlain(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "desired.yaml")
+	if err := os.WriteFile(file, []byte("env:\n  variables:\n    TOKEN: abc\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	nm := &fakeNM{env: map[string]string{"TOKEN": "abc"}, secrets: []string{"TOKEN"}}
+	r := &Reconciler{File: file, NetworkManager: nm, Environment: true}
+
+	status, err := r.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Drift) != 1 || status.Drift[0].Name != "TOKEN" {
+		t.Fatalf("drift = %+v, want TOKEN to become a plain variable", status.Drift)
+	}
+	if status, err = r.Reconcile(); err != nil || len(status.Drift) != 0 {
+		t.Errorf("after reconcile = %+v, %v, want no drift", status, err)
+	}
+	if len(nm.secrets) != 0 || nm.env["TOKEN"] != "abc" {
+		t.Errorf("secrets = %v, TOKEN = %q, want TOKEN plain", nm.secrets, nm.env["TOKEN"])
+	}
+}
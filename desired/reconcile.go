@@ -0,0 +1,378 @@
+package desired
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ztkent/pifi/api"
+	"github.com/ztkent/pifi/networkmanager"
+)
+
+// Actor is recorded as the author of the environment changes made by reconciling
+const Actor = "desired state"
+
+// Reconciler applies a desired state file to the device
+type Reconciler struct {
+	File           string
+	NetworkManager networkmanager.NetworkManager
+	Networks       bool // Manage saved networks and the AP
+	Environment    bool // Manage environment variables
+
+	mu       sync.Mutex // Serializes reconciles and guards the fields below
+	watching bool
+	last     *time.Time
+	applied  []api.DesiredChange
+	lastErr  string
+	units    []networkmanager.UnitResult
+}
+
+// plan is the changes that bring the device to the desired state
+type plan struct {
+	changes  []api.DesiredChange // As reported, passwords left out and secrets masked
+	networks []Network           // Added or updated
+	remove   []string            // Networks pruned
+	ap       *AP
+	set      map[string]string
+	secrets  map[string]string
+	plain    map[string]string // Secrets on the device listed as plain variables
+	unset    []string
+}
+
+// plan compares the desired state to the device
+func (r *Reconciler) plan(s *State) (*plan, error) {
+	nm := r.NetworkManager
+	p := &plan{changes: []api.DesiredChange{}, set: map[string]string{}, secrets: map[string]string{}, plain: map[string]string{}}
+
+	if r.Networks {
+		saved, err := nm.GetSavedConnections()
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range s.Networks {
+			i := slices.IndexFunc(saved, func(c networkmanager.SavedConnection) bool { return c.SSID == n.SSID })
+			if i < 0 {
+				p.networks = append(p.networks, n)
+				p.changes = append(p.changes, api.DesiredChange{Kind: "network", Name: n.SSID, Action: "add"})
+				continue
+			}
+			// Without a password the saved one is kept, as ModifyNetworkConnection does
+			var fields []string
+			if n.Password != "" && saved[i].Password != n.Password {
+				fields = append(fields, "password")
+			}
+			if saved[i].AutoConnect != n.autoConnect() {
+				fields = append(fields, "autoConnect")
+			}
+			if saved[i].Priority != n.Priority {
+				fields = append(fields, "priority")
+			}
+			if len(fields) > 0 {
+				p.networks = append(p.networks, n)
+				p.changes = append(p.changes, api.DesiredChange{Kind: "network", Name: n.SSID, Action: "update", Fields: fields})
+			}
+		}
+		if s.Prune.Networks {
+			// The connection the device is using is kept, removing it could cut the device off.
+			// Saved networks are named after their connection, which can differ from the SSID.
+			status, err := nm.GetNetworkStatus()
+			if err != nil {
+				return nil, err
+			}
+			for _, c := range saved {
+				if c.SSID == status.WifiConnection {
+					continue
+				}
+				if !slices.ContainsFunc(s.Networks, func(n Network) bool { return n.SSID == c.SSID }) {
+					p.remove = append(p.remove, c.SSID)
+					p.changes = append(p.changes, api.DesiredChange{Kind: "network", Name: c.SSID, Action: "remove"})
+				}
+			}
+		}
+
+		if s.AP != nil {
+			current, err := nm.GetAPSettings()
+			if err != nil {
+				return nil, err
+			}
+			if current.Band != s.AP.Band {
+				p.ap = s.AP
+				p.changes = append(p.changes, api.DesiredChange{Kind: "ap", Name: "band", Action: "update", Old: current.Band, New: s.AP.Band})
+			}
+		}
+	}
+
+	if r.Environment && s.Env != nil {
+		if err := p.planEnv(nm, s); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// planEnv compares the desired variables to the managed ones. Desired secrets that aren't
+// secrets on the device are set again to make them secret, and plain variables that are secrets
+// on the device to make them plain, unless the schema declares them secret.
+func (p *plan) planEnv(nm networkmanager.NetworkManager, s *State) error {
+	current, err := nm.GetEnvironmentVariables()
+	if err != nil {
+		return err
+	}
+	secrets, err := nm.GetEnvironmentSecrets()
+	if err != nil {
+		return err
+	}
+	schema, err := nm.GetEnvironmentSchema()
+	if err != nil {
+		return err
+	}
+	mask := func(key, value string) string {
+		_, secret := s.Env.Secrets[key]
+		if value != "" && (secret || slices.Contains(secrets, key)) {
+			return api.SecretMask
+		}
+		return value
+	}
+
+	add := func(key, value string, secret bool) {
+		if v, ok := schema.Lookup(key); ok && v.Secret {
+			secret = true
+		}
+		old, ok := current[key]
+		action := "update"
+		if !ok {
+			action = "add"
+		}
+		wasSecret := slices.Contains(secrets, key)
+		if ok && old == value && secret == wasSecret {
+			return
+		}
+		switch {
+		case secret:
+			p.secrets[key] = value
+		case wasSecret:
+			p.plain[key] = value
+		default:
+			p.set[key] = value
+		}
+		p.changes = append(p.changes, api.DesiredChange{Kind: "env", Name: key, Action: action, Old: mask(key, old), New: mask(key, value)})
+	}
+	for _, key := range slices.Sorted(maps.Keys(s.Env.Variables)) {
+		add(key, s.Env.Variables[key], false)
+	}
+	for _, key := range slices.Sorted(maps.Keys(s.Env.Secrets)) {
+		add(key, s.Env.Secrets[key], true)
+	}
+
+	if s.Prune.Env {
+		for _, key := range slices.Sorted(maps.Keys(current)) {
+			_, variable := s.Env.Variables[key]
+			_, secret := s.Env.Secrets[key]
+			if !variable && !secret {
+				p.unset = append(p.unset, key)
+				p.changes = append(p.changes, api.DesiredChange{Kind: "env", Name: key, Action: "remove", Old: mask(key, current[key])})
+			}
+		}
+	}
+	return nil
+}
+
+// apply makes the changes of the plan, stopping at the first that fails. It returns the changes
+// made before a failure too, and restarts the units of the variables they changed.
+func (p *plan) apply(nm networkmanager.NetworkManager) ([]api.DesiredChange, []networkmanager.UnitResult, error) {
+	applied := []api.DesiredChange{}
+	var changed []string
+	done := func(kind, name string) {
+		if i := slices.IndexFunc(p.changes, func(c api.DesiredChange) bool { return c.Kind == kind && c.Name == name }); i >= 0 {
+			applied = append(applied, p.changes[i])
+		}
+		if kind == "env" {
+			changed = append(changed, name)
+		}
+	}
+	err := p.applyChanges(nm, done)
+	if len(changed) == 0 {
+		return applied, nil, err
+	}
+	sort.Strings(changed)
+	return applied, nm.RestartEnvironmentUnits(changed), err
+}
+
+// applyChanges makes the changes of the plan in order, calling done for each change made
+func (p *plan) applyChanges(nm networkmanager.NetworkManager, done func(kind, name string)) error {
+	for _, n := range p.networks {
+		if err := nm.ModifyNetworkConnection(n.SSID, n.Password, n.autoConnect()); err != nil {
+			return fmt.Errorf("failed to save network %s: %v", n.SSID, err)
+		}
+		if err := nm.SetConnectionPriority(n.SSID, n.Priority); err != nil {
+			return err
+		}
+		done("network", n.SSID)
+	}
+	for _, ssid := range p.remove {
+		if err := nm.RemoveNetworkConnection(ssid); err != nil {
+			return fmt.Errorf("failed to remove network %s: %v", ssid, err)
+		}
+		done("network", ssid)
+	}
+	if p.ap != nil {
+		if err := nm.SetAPSettings(networkmanager.APSettings{Band: p.ap.Band}); err != nil {
+			return err
+		}
+		done("ap", "band")
+	}
+
+	// ApplyEnvironment changes every variable or none
+	if len(p.set) > 0 || len(p.unset) > 0 {
+		if err := nm.ApplyEnvironment(p.set, p.unset); err != nil {
+			return err
+		}
+		for _, key := range slices.Concat(slices.Sorted(maps.Keys(p.set)), p.unset) {
+			done("env", key)
+		}
+	}
+	for _, key := range slices.Sorted(maps.Keys(p.secrets)) {
+		if err := nm.SetSecretEnvironmentVariable(key, p.secrets[key]); err != nil {
+			return err
+		}
+		done("env", key)
+	}
+	for _, key := range slices.Sorted(maps.Keys(p.plain)) {
+		if err := nm.SetEnvironmentVariable(key, p.plain[key]); err != nil {
+			return err
+		}
+		done("env", key)
+	}
+	return nil
+}
+
+// Status returns the drift of the device from the desired state file, and the last reconcile.
+// The drift is computed without holding r.mu, so a slow nmcli doesn't block a reconcile.
+func (r *Reconciler) Status() (api.DesiredStateStatus, error) {
+	r.mu.Lock()
+	status := api.DesiredStateStatus{
+		File:          r.File,
+		Watching:      r.watching,
+		LastReconcile: r.last,
+		LastApplied:   r.applied,
+		LastError:     r.lastErr,
+		Units:         r.units,
+	}
+	r.mu.Unlock()
+	if status.LastApplied == nil {
+		status.LastApplied = []api.DesiredChange{}
+	}
+
+	s, err := Load(r.File)
+	if err != nil {
+		return status, err
+	}
+	p, err := r.plan(s)
+	if err != nil {
+		return status, err
+	}
+	status.Drift = p.changes
+	return status, nil
+}
+
+// Reconcile applies the desired state file, returning the changes it made. Changes made
+// before a failure are kept, reconciling again continues from there.
+func (r *Reconciler) Reconcile() (api.DesiredStateStatus, error) {
+	r.mu.Lock()
+	now := time.Now().UTC()
+	r.last, r.applied, r.lastErr, r.units = &now, []api.DesiredChange{}, "", nil
+
+	err := r.reconcile()
+	if err != nil {
+		r.lastErr = err.Error()
+	}
+	r.mu.Unlock()
+
+	status, statusErr := r.Status()
+	if err != nil {
+		return status, err
+	}
+	return status, statusErr
+}
+
+// reconcile plans and applies the file, holding r.mu. The changes made are recorded even if a later one fails.
+func (r *Reconciler) reconcile() error {
+	s, err := Load(r.File)
+	if err != nil {
+		return err
+	}
+	p, err := r.plan(s)
+	if err != nil {
+		return err
+	}
+	r.applied, r.units, err = p.apply(r.NetworkManager.WithActor(Actor))
+	return err
+}
+
+// Watch reconciles whenever the desired state file changes, checking it every interval until ctx is cancelled.
+// The file is compared by content, so rewriting it unchanged doesn't reconcile. A failed reconcile,
+// including one before Watch started, is retried every interval until it succeeds.
+func (r *Reconciler) Watch(ctx context.Context, interval time.Duration) {
+	r.mu.Lock()
+	r.watching = true
+	retry, lastErr := r.lastErr != "", r.lastErr
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		r.watching = false
+		r.mu.Unlock()
+	}()
+
+	last := fileHash(r.File)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		hash := fileHash(r.File)
+		if bytes.Equal(hash, last) && !retry {
+			continue
+		}
+		// A removed file leaves the device as it is
+		last = hash
+		if hash == nil {
+			retry, lastErr = false, ""
+			continue
+		}
+		status, err := r.Reconcile()
+		retry = err != nil
+		if err != nil {
+			// Retries failing the same way are only logged once
+			if err.Error() != lastErr {
+				log.Printf("Failed to reconcile the desired state, retrying every %v: %v", interval, err)
+			}
+			lastErr = err.Error()
+			continue
+		}
+		lastErr = ""
+		if len(status.LastApplied) > 0 {
+			log.Printf("Reconciled the desired state, %d changes", len(status.LastApplied))
+		}
+	}
+}
+
+// fileHash returns the hash of the contents of path, nil if it can't be read
+func fileHash(path string) []byte {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
@@ -0,0 +1,171 @@
+// Package filestore writes the files PiFi manages so that a power cut or a concurrent request can't
+// leave them empty or half written. Every write goes to a temporary file that is synced and renamed
+// over the original, writers hold an advisory lock, and the previous version is kept as a backup.
+// The lock and the backup are files next to the original, with LockSuffix and BackupSuffix.
+package filestore
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// BackupSuffix is appended to a file name to get its backup, the version before the last write
+const BackupSuffix = ".bak"
+
+// LockSuffix is appended to a file name to get the lock file its writers hold
+const LockSuffix = ".lock"
+
+// Write replaces the contents of path with data
+func Write(path string, data []byte, perm os.FileMode) error {
+	return Update(path, perm, func([]byte) ([]byte, error) { return data, nil })
+}
+
+// Update replaces the contents of path with the result of update, called with the current
+// contents, or nil if the file doesn't exist. Other writers wait until the file is replaced.
+// Nothing is written if update returns an error or the contents don't change, a missing file
+// counts as empty.
+func Update(path string, perm os.FileMode, update func(data []byte) ([]byte, error)) error {
+	unlock, err := lock(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	old, err := os.ReadFile(path)
+	exists := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	data, err := update(old)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(data, old) {
+		return nil
+	}
+	return replace(path, old, exists, data, perm)
+}
+
+// Revert undoes a write by putting back data, the contents before it, without touching the
+// backup. A rollback then doesn't replace the backup with the version it is rolling back.
+func Revert(path string, data []byte, perm os.FileMode) error {
+	unlock, err := lock(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if info, err := os.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	}
+	if err := writeAtomic(path, data, perm); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return nil
+}
+
+// Restore replaces path with its backup. The replaced version becomes the backup, so restoring
+// twice undoes the restore.
+func Restore(path string) error {
+	unlock, err := lock(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	backup, err := os.ReadFile(path + BackupSuffix)
+	if err != nil {
+		return fmt.Errorf("no backup of %s: %v", path, err)
+	}
+	perm := os.FileMode(0600)
+	if info, err := os.Stat(path + BackupSuffix); err == nil {
+		perm = info.Mode().Perm()
+	}
+	old, err := os.ReadFile(path)
+	exists := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return replace(path, old, exists, backup, perm)
+}
+
+// replace backs up old, if the file exists, and atomically writes data in its place.
+// The file keeps its permissions, perm is used for new files.
+func replace(path string, old []byte, exists bool, data []byte, perm os.FileMode) error {
+	if exists {
+		if info, err := os.Stat(path); err == nil {
+			perm = info.Mode().Perm()
+		}
+		if err := writeAtomic(path+BackupSuffix, old, perm); err != nil {
+			return fmt.Errorf("failed to back up %s: %v", path, err)
+		}
+	}
+	if err := writeAtomic(path, data, perm); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return nil
+}
+
+// writeAtomic writes data to a temporary file next to path, syncs it and renames it over path
+func writeAtomic(path string, data []byte, perm os.FileMode) error {
+	dir, name := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := os.CreateTemp(dir, "."+name+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir makes a rename in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// lock takes an exclusive advisory lock for path, blocking until it is available. The lock is
+// held on a separate lock file, since path itself is replaced by every write, so writers of
+// other files in the same directory don't wait for each other.
+func lock(path string) (func(), error) {
+	f, err := os.OpenFile(path+LockSuffix, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock %s: %v", path, err)
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
@@ -0,0 +1,108 @@
+package filestore
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUpdateIsSerialized(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "counter")
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := Update(path, 0644, func(data []byte) ([]byte, error) {
+				n, _ := strconv.Atoi(string(data))
+				return []byte(strconv.Itoa(n + 1)), nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if data, _ := os.ReadFile(path); string(data) != "20" {
+		t.Errorf("counter = %q, want 20", data)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 3 {
+		t.Errorf("%d files left, want the file, its backup and its lock", len(entries))
+	}
+}
+
+func TestNestedUpdateInSameDirectory(t *testing.T) {
+	dir := t.TempDir()
+	done := make(chan error, 1)
+	go func() {
+		done <- Update(filepath.Join(dir, "a"), 0644, func([]byte) ([]byte, error) {
+			return []byte("a"), Write(filepath.Join(dir, "b"), []byte("b"), 0644)
+		})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nested Update of another file in the same directory deadlocked")
+	}
+	for name, want := range map[string]string{"a": "a", "b": "b"} {
+		if data, _ := os.ReadFile(filepath.Join(dir, name)); string(data) != want {
+			t.Errorf("%s = %q, want %q", name, data, want)
+		}
+	}
+}
+
+func TestRevert(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "environment")
+	if err := Write(path, []byte("A=1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := Write(path, []byte("A=2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Revert(path, []byte("A=1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{path: "A=1\n", path + BackupSuffix: "A=1\n"} {
+		if data, _ := os.ReadFile(name); string(data) != want {
+			t.Errorf("%s = %q, want %q", name, data, want)
+		}
+	}
+	if info, err := os.Stat(path); err != nil {
+		t.Error(err)
+	} else if info.Mode().Perm() != 0600 {
+		t.Errorf("mode = %v, want 0600", info.Mode().Perm())
+	}
+}
+
+func TestRestore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "environment")
+	if err := Restore(path); err == nil {
+		t.Error("Restore without a backup succeeded")
+	}
+	for _, data := range []string{"A=1\n", "A=2\n"} {
+		if err := Write(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, want := range []string{"A=1\n", "A=2\n"} {
+		if err := Restore(path); err != nil {
+			t.Fatal(err)
+		}
+		if data, _ := os.ReadFile(path); string(data) != want {
+			t.Errorf("after Restore = %q, want %q", data, want)
+		}
+	}
+	if info, err := os.Stat(path); err != nil {
+		t.Error(err)
+	} else if info.Mode().Perm() != 0600 {
+		t.Errorf("mode = %v, want 0600", info.Mode().Perm())
+	}
+}
@@ -4,5 +4,7 @@ go 1.23.4
 
 require (
 	github.com/gorilla/mux v1.8.1
+	golang.org/x/crypto v0.39.0
 	golang.org/x/text v0.26.0
+	gopkg.in/yaml.v3 v3.0.1
 )
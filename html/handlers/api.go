@@ -4,15 +4,12 @@ import (
 	"encoding/json"
 	"net/http"
 
+	"github.com/ztkent/pifi/api"
 	"github.com/ztkent/pifi/networkmanager"
 )
 
-// API Response types
-type APIResponse struct {
-	Success bool        `json:"success"`
-	Data    interface{} `json:"data,omitempty"`
-	Error   string      `json:"error,omitempty"`
-}
+// APIResponse wraps every API response, the request and response types live in the api package
+type APIResponse = api.Response
 
 // GetNetworkStatusAPI returns the current network status as JSON
 func GetNetworkStatusAPI(nm networkmanager.NetworkManager) http.HandlerFunc {
@@ -43,9 +40,7 @@ func SetWifiModeAPI(nm networkmanager.NetworkManager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
-		var request struct {
-			Mode string `json:"mode"`
-		}
+		var request api.ModeRequest
 
 		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
 			response := APIResponse{
@@ -80,7 +75,7 @@ func SetWifiModeAPI(nm networkmanager.NetworkManager) http.HandlerFunc {
 
 		response := APIResponse{
 			Success: true,
-			Data:    map[string]string{"mode": request.Mode},
+			Data:    api.ModeResponse{Mode: request.Mode},
 		}
 		json.NewEncoder(w).Encode(response)
 	}
@@ -104,7 +99,7 @@ func FindAvailableNetworksAPI(nm networkmanager.NetworkManager) http.HandlerFunc
 
 		response := APIResponse{
 			Success: true,
-			Data:    map[string][]string{"networks": networks},
+			Data:    api.AvailableNetworksResponse{Networks: networks},
 		}
 		json.NewEncoder(w).Encode(response)
 	}
@@ -128,7 +123,7 @@ func GetConfiguredConnectionsAPI(nm networkmanager.NetworkManager) http.HandlerF
 
 		response := APIResponse{
 			Success: true,
-			Data:    map[string][]networkmanager.ConnectionInfo{"connections": connections},
+			Data:    api.ConfiguredNetworksResponse{Connections: connections},
 		}
 		json.NewEncoder(w).Encode(response)
 	}
@@ -139,11 +134,7 @@ func ModifyNetworkConnectionAPI(nm networkmanager.NetworkManager) http.HandlerFu
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
-		var request struct {
-			SSID        string `json:"ssid"`
-			Password    string `json:"password"`
-			AutoConnect bool   `json:"autoConnect"`
-		}
+		var request api.ModifyNetworkRequest
 
 		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
 			response := APIResponse{
@@ -178,7 +169,7 @@ func ModifyNetworkConnectionAPI(nm networkmanager.NetworkManager) http.HandlerFu
 
 		response := APIResponse{
 			Success: true,
-			Data:    map[string]string{"ssid": request.SSID, "status": "modified"},
+			Data:    api.NetworkResult{SSID: request.SSID, Status: "modified"},
 		}
 		json.NewEncoder(w).Encode(response)
 	}
@@ -189,9 +180,7 @@ func RemoveNetworkConnectionAPI(nm networkmanager.NetworkManager) http.HandlerFu
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
-		var request struct {
-			SSID string `json:"ssid"`
-		}
+		var request api.SSIDRequest
 
 		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
 			response := APIResponse{
@@ -226,7 +215,7 @@ func RemoveNetworkConnectionAPI(nm networkmanager.NetworkManager) http.HandlerFu
 
 		response := APIResponse{
 			Success: true,
-			Data:    map[string]string{"ssid": request.SSID, "status": "removed"},
+			Data:    api.NetworkResult{SSID: request.SSID, Status: "removed"},
 		}
 		json.NewEncoder(w).Encode(response)
 	}
@@ -237,10 +226,7 @@ func SetAutoConnectConnectionAPI(nm networkmanager.NetworkManager) http.HandlerF
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
-		var request struct {
-			SSID        string `json:"ssid"`
-			AutoConnect bool   `json:"autoConnect"`
-		}
+		var request api.AutoConnectRequest
 
 		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
 			response := APIResponse{
@@ -275,11 +261,7 @@ func SetAutoConnectConnectionAPI(nm networkmanager.NetworkManager) http.HandlerF
 
 		response := APIResponse{
 			Success: true,
-			Data: map[string]interface{}{
-				"ssid":        request.SSID,
-				"autoConnect": request.AutoConnect,
-				"status":      "updated",
-			},
+			Data:    api.NetworkResult{SSID: request.SSID, Status: "updated", AutoConnect: &request.AutoConnect},
 		}
 		json.NewEncoder(w).Encode(response)
 	}
@@ -290,9 +272,7 @@ func ConnectNetworkAPI(nm networkmanager.NetworkManager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
-		var request struct {
-			SSID string `json:"ssid"`
-		}
+		var request api.SSIDRequest
 
 		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
 			response := APIResponse{
@@ -327,8 +307,19 @@ func ConnectNetworkAPI(nm networkmanager.NetworkManager) http.HandlerFunc {
 
 		response := APIResponse{
 			Success: true,
-			Data:    map[string]string{"ssid": request.SSID, "status": "connected"},
+			Data:    api.NetworkResult{SSID: request.SSID, Status: "connected"},
 		}
 		json.NewEncoder(w).Encode(response)
 	}
 }
+
+// GetConfigAPI returns the effective configuration the server was started with
+func GetConfigAPI(config interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: true,
+			Data:    config,
+		})
+	}
+}
@@ -0,0 +1,470 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/ztkent/pifi/api"
+	"github.com/ztkent/pifi/networkmanager"
+)
+
+var envKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// EnvAPIRoutes returns the /api/v1 routes that manage environment variables
+func EnvAPIRoutes(nm networkmanager.NetworkManager) []APIRoute {
+	headers := []string{api.EnvPasswordHeader}
+	return []APIRoute{
+		{api.Endpoint{Method: http.MethodGet, Path: "/env", Summary: "List the managed environment variables", Scope: ScopeEnvManage,
+			Headers: headers, Response: api.EnvVariablesResponse{}}, listEnvV1(nm)},
+		{api.Endpoint{Method: http.MethodPatch, Path: "/env", Summary: "Set and unset several environment variables", Scope: ScopeEnvManage,
+			Headers: headers, Request: api.EnvBatchRequest{}, Response: api.EnvBatchResult{}}, batchEnvV1(nm)},
+		{api.Endpoint{Method: http.MethodGet, Path: "/env/export", Summary: "Download the managed environment variables as a .env file, with ?secrets=true including secret values", Scope: ScopeEnvManage,
+			Headers: headers, Raw: true}, exportEnvV1(nm)},
+		{api.Endpoint{Method: http.MethodPost, Path: "/env/import/preview", Summary: "Preview what importing a .env file changes", Scope: ScopeEnvManage,
+			Headers: headers, Request: api.EnvImportRequest{}, Response: api.EnvImportPreview{}}, previewEnvImportV1(nm)},
+		{api.Endpoint{Method: http.MethodPost, Path: "/env/import", Summary: "Import a .env file, applying every change or none", Scope: ScopeEnvManage,
+			Headers: headers, Request: api.EnvImportRequest{}, Response: api.EnvBatchResult{}}, envImportV1(nm)},
+		{api.Endpoint{Method: http.MethodGet, Path: "/env/history", Summary: "List the revisions of every managed environment variable, newest first", Scope: ScopeEnvManage,
+			Headers: headers, Response: []networkmanager.EnvRevision{}}, envHistoryV1(nm)},
+		{api.Endpoint{Method: http.MethodPost, Path: "/env/rollback", Summary: "Roll environment variables back to their values after a revision", Scope: ScopeEnvManage,
+			Headers: headers, Request: api.EnvRollbackRequest{}, Response: api.EnvRollbackResult{}}, envRollbackV1(nm)},
+		{api.Endpoint{Method: http.MethodGet, Path: "/env/schema", Summary: "Get the environment schema and the required variables that aren't set", Scope: ScopeEnvManage,
+			Headers: headers, Response: api.EnvSchemaResponse{}}, getEnvSchemaV1(nm)},
+		{api.Endpoint{Method: http.MethodGet, Path: "/env/{key}", Summary: "Get a managed environment variable", Scope: ScopeEnvManage,
+			Headers: headers, Response: api.EnvVariable{}}, getEnvV1(nm)},
+		{api.Endpoint{Method: http.MethodPut, Path: "/env/{key}", Summary: "Set an environment variable", Scope: ScopeEnvManage,
+			Headers: headers, Request: api.EnvValue{}, Response: api.EnvVariable{}}, putEnvV1(nm)},
+		{api.Endpoint{Method: http.MethodDelete, Path: "/env/{key}", Summary: "Unset an environment variable", Scope: ScopeEnvManage,
+			Headers: headers, Response: api.EnvVariable{}}, deleteEnvV1(nm)},
+		{api.Endpoint{Method: http.MethodGet, Path: "/env/{key}/history", Summary: "List the revisions of an environment variable, newest first", Scope: ScopeEnvManage,
+			Headers: headers, Response: []networkmanager.EnvRevision{}}, envHistoryV1(nm)},
+		{api.Endpoint{Method: http.MethodPut, Path: "/env/{key}/target", Summary: "Set the file a variable is written to and the units that read it", Scope: ScopeEnvManage,
+			Headers: headers, Request: networkmanager.EnvTarget{}, Response: networkmanager.EnvTarget{}}, putEnvTargetV1(nm)},
+	}
+}
+
+// RequireEnvPassword protects the environment API with the environment password, if one is set.
+// Requests authenticated with an API token don't need it, the env:manage scope grants access.
+// Wrong passwords are rate limited by limiter.
+func RequireEnvPassword(nm networkmanager.NetworkManager, limiter *LoginLimiter) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		checkPassword := limiter.Limit(func(w http.ResponseWriter, r *http.Request) {
+			if valid, err := nm.ValidateEnvPassword(r.Header.Get(api.EnvPasswordHeader)); err != nil || !valid {
+				WriteAPIError(w, http.StatusUnauthorized, api.CodeEnvPassword, "Invalid environment password")
+				return
+			}
+			next(w, r)
+		})
+
+		return func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := requestToken(r); ok {
+				next(w, r)
+				return
+			}
+			passwordSet, err := nm.IsEnvPasswordSet()
+			if err != nil {
+				WriteAPIError(w, http.StatusInternalServerError, api.CodeOperationFailed, err.Error())
+				return
+			}
+			if !passwordSet {
+				next(w, r)
+				return
+			}
+			if r.Header.Get(api.EnvPasswordHeader) == "" {
+				WriteAPIError(w, http.StatusUnauthorized, api.CodeEnvPassword, "Environment password required in the "+api.EnvPasswordHeader+" header")
+				return
+			}
+			checkPassword(w, r)
+		}
+	}
+}
+
+// envKeyParam returns the variable name from the request path, answering with an error if it is invalid
+func envKeyParam(w http.ResponseWriter, r *http.Request) (string, bool) {
+	key, err := url.PathUnescape(mux.Vars(r)["key"])
+	if err != nil {
+		WriteAPIError(w, http.StatusBadRequest, api.CodeInvalidParameter, "Invalid key in path")
+		return "", false
+	}
+	return key, validEnvKey(w, key)
+}
+
+// validEnvKey answers with an error unless key is a valid environment variable name
+func validEnvKey(w http.ResponseWriter, key string) bool {
+	if key == "" {
+		WriteAPIError(w, http.StatusBadRequest, api.CodeMissingParameter, "Environment variable key cannot be empty")
+		return false
+	}
+	if !envKeyPattern.MatchString(key) {
+		WriteAPIError(w, http.StatusBadRequest, api.CodeInvalidParameter, "Invalid environment variable key "+key+", use letters, digits and underscores")
+		return false
+	}
+	return true
+}
+
+// secretEnvVars returns the managed variables with the values of secrets masked, and the secrets
+func secretEnvVars(nm networkmanager.NetworkManager) (map[string]string, []string, error) {
+	vars, err := nm.GetEnvironmentVariables()
+	if err != nil {
+		return nil, nil, err
+	}
+	secrets, err := nm.GetEnvironmentSecrets()
+	if err != nil {
+		return nil, nil, err
+	}
+	if vars == nil {
+		vars = map[string]string{}
+	}
+	for _, key := range secrets {
+		if _, ok := vars[key]; ok {
+			vars[key] = api.SecretMask
+		}
+	}
+	return vars, secrets, nil
+}
+
+// maskedProvenance returns the provenance of the managed variables, with the values of secrets in drift masked
+func maskedProvenance(nm networkmanager.NetworkManager, secrets []string) (map[string]networkmanager.EnvProvenance, error) {
+	provenance, err := nm.GetEnvironmentProvenance()
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range secrets {
+		for i, drift := range provenance[key].Drift {
+			if drift.Value != nil {
+				mask := api.SecretMask
+				provenance[key].Drift[i].Value = &mask
+			}
+		}
+	}
+	return provenance, nil
+}
+
+// setEnv sets key as a secret or a plain variable, and reports whether it was stored as a secret.
+// Variables the environment schema declares secret always are.
+func setEnv(nm networkmanager.NetworkManager, key, value string, secret bool) (bool, error) {
+	if schema, err := nm.GetEnvironmentSchema(); err == nil {
+		if v, ok := schema.Lookup(key); ok && v.Secret {
+			secret = true
+		}
+	}
+	if secret {
+		return true, nm.SetSecretEnvironmentVariable(key, value)
+	}
+	return false, nm.SetEnvironmentVariable(key, value)
+}
+
+// writeEnvError answers with the reason a value was rejected by the environment schema, or a generic error
+func writeEnvError(w http.ResponseWriter, err error) {
+	var invalid *networkmanager.EnvValidationError
+	if !errors.As(err, &invalid) {
+		WriteAPIError(w, http.StatusInternalServerError, api.CodeOperationFailed, err.Error())
+		return
+	}
+	writeAPIResponse(w, http.StatusBadRequest, APIResponse{Success: false, Error: invalid.Error(), Code: api.CodeInvalidValue, Details: invalid})
+}
+
+// maskedEnvVariable returns the response for a variable that was set
+func maskedEnvVariable(key, value string, secret bool) api.EnvVariable {
+	if secret {
+		value = api.SecretMask
+	}
+	return api.EnvVariable{Key: key, Value: value, Secret: secret}
+}
+
+func listEnvV1(nm networkmanager.NetworkManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars, secrets, err := secretEnvVars(nm)
+		if err != nil {
+			WriteAPIError(w, http.StatusInternalServerError, api.CodeOperationFailed, err.Error())
+			return
+		}
+		targets, err := nm.GetEnvironmentTargets()
+		if err != nil {
+			WriteAPIError(w, http.StatusInternalServerError, api.CodeOperationFailed, err.Error())
+			return
+		}
+		provenance, err := maskedProvenance(nm, secrets)
+		if err != nil {
+			WriteAPIError(w, http.StatusInternalServerError, api.CodeOperationFailed, err.Error())
+			return
+		}
+		response := api.EnvVariablesResponse{Variables: vars, Secrets: secrets, Targets: targets, Provenance: provenance}
+		if schema, err := nm.GetEnvironmentSchema(); err == nil {
+			response.Missing = schema.Missing(vars)
+		}
+		WriteAPIData(w, response)
+	}
+}
+
+func getEnvSchemaV1(nm networkmanager.NetworkManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		schema, err := nm.GetEnvironmentSchema()
+		if err != nil {
+			WriteAPIError(w, http.StatusInternalServerError, api.CodeOperationFailed, err.Error())
+			return
+		}
+		vars, err := nm.GetEnvironmentVariables()
+		if err != nil {
+			WriteAPIError(w, http.StatusInternalServerError, api.CodeOperationFailed, err.Error())
+			return
+		}
+		response := api.EnvSchemaResponse{Strict: schema.Strict, Variables: schema.Variables, Missing: schema.Missing(vars)}
+		if response.Variables == nil {
+			response.Variables = []networkmanager.EnvSchemaVar{}
+		}
+		WriteAPIData(w, response)
+	}
+}
+
+func getEnvV1(nm networkmanager.NetworkManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, ok := envKeyParam(w, r)
+		if !ok {
+			return
+		}
+		vars, secrets, err := secretEnvVars(nm)
+		if err != nil {
+			WriteAPIError(w, http.StatusInternalServerError, api.CodeOperationFailed, err.Error())
+			return
+		}
+		value, ok := vars[key]
+		if !ok {
+			WriteAPIError(w, http.StatusNotFound, api.CodeNotFound, "Environment variable "+key+" is not managed by PiFi")
+			return
+		}
+		variable := api.EnvVariable{Key: key, Value: value, Secret: slices.Contains(secrets, key)}
+		if targets, err := nm.GetEnvironmentTargets(); err == nil {
+			if target, ok := targets[key]; ok {
+				variable.Target = &target
+			}
+		}
+		if provenance, err := maskedProvenance(nm, secrets); err == nil {
+			if p, ok := provenance[key]; ok {
+				variable.Provenance = &p
+			}
+		}
+		WriteAPIData(w, variable)
+	}
+}
+
+func putEnvV1(nm networkmanager.NetworkManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		nm := nm.WithActor(requestActor(r))
+		key, ok := envKeyParam(w, r)
+		if !ok {
+			return
+		}
+		var request api.EnvValue
+		if !decodeAPIRequest(w, r, &request) {
+			return
+		}
+		secret, err := setEnv(nm, key, request.Value, request.Secret)
+		if err != nil {
+			writeEnvError(w, err)
+			return
+		}
+		variable := maskedEnvVariable(key, request.Value, secret)
+		variable.Units = nm.RestartEnvironmentUnits([]string{key})
+		WriteAPIData(w, variable)
+	}
+}
+
+func deleteEnvV1(nm networkmanager.NetworkManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		nm := nm.WithActor(requestActor(r))
+		key, ok := envKeyParam(w, r)
+		if !ok {
+			return
+		}
+		if err := nm.UnsetEnvironmentVariable(key); err != nil {
+			WriteAPIError(w, http.StatusInternalServerError, api.CodeOperationFailed, err.Error())
+			return
+		}
+		WriteAPIData(w, api.EnvVariable{Key: key, Units: nm.RestartEnvironmentUnits([]string{key})})
+	}
+}
+
+func putEnvTargetV1(nm networkmanager.NetworkManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		nm := nm.WithActor(requestActor(r))
+		key, ok := envKeyParam(w, r)
+		if !ok {
+			return
+		}
+		var target networkmanager.EnvTarget
+		if !decodeAPIRequest(w, r, &target) {
+			return
+		}
+		if err := nm.SetEnvironmentTarget(key, target); err != nil {
+			WriteAPIError(w, http.StatusBadRequest, api.CodeInvalidParameter, err.Error())
+			return
+		}
+		WriteAPIData(w, target)
+	}
+}
+
+// batchEnvV1 validates every key and value before changing anything. If a change fails, the keys applied
+// before it are returned in the details of the error.
+func batchEnvV1(nm networkmanager.NetworkManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		nm := nm.WithActor(requestActor(r))
+		var request api.EnvBatchRequest
+		if !decodeAPIRequest(w, r, &request) {
+			return
+		}
+		if len(request.Set) == 0 && len(request.Unset) == 0 {
+			WriteAPIError(w, http.StatusBadRequest, api.CodeMissingParameter, "Nothing to set or unset")
+			return
+		}
+
+		keys := make([]string, 0, len(request.Set))
+		for key := range request.Set {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range append(slices.Clone(keys), request.Unset...) {
+			if !validEnvKey(w, key) {
+				return
+			}
+		}
+		for _, key := range request.Unset {
+			if _, ok := request.Set[key]; ok {
+				WriteAPIError(w, http.StatusBadRequest, api.CodeInvalidParameter, "Environment variable "+key+" is both set and unset")
+				return
+			}
+		}
+		for _, key := range request.Secrets {
+			if _, ok := request.Set[key]; !ok {
+				WriteAPIError(w, http.StatusBadRequest, api.CodeInvalidParameter, "Secret "+key+" is not set")
+				return
+			}
+		}
+		for _, key := range keys {
+			if err := nm.ValidateEnvironmentVariable(key, request.Set[key]); err != nil {
+				writeEnvError(w, err)
+				return
+			}
+		}
+
+		result := api.EnvBatchResult{Set: []string{}, Unset: []string{}}
+		fail := func(err error) {
+			writeAPIResponse(w, http.StatusInternalServerError, APIResponse{Success: false, Error: err.Error(), Code: api.CodeOperationFailed, Details: result})
+		}
+		for _, key := range keys {
+			if _, err := setEnv(nm, key, request.Set[key], slices.Contains(request.Secrets, key)); err != nil {
+				fail(err)
+				return
+			}
+			result.Set = append(result.Set, key)
+		}
+		for _, key := range request.Unset {
+			if err := nm.UnsetEnvironmentVariable(key); err != nil {
+				fail(err)
+				return
+			}
+			result.Unset = append(result.Unset, key)
+		}
+		result.Units = nm.RestartEnvironmentUnits(slices.Concat(result.Set, result.Unset))
+		WriteAPIData(w, result)
+	}
+}
+
+func exportEnvV1(nm networkmanager.NetworkManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data, err := exportEnv(nm, r.URL.Query().Get("secrets") == "true")
+		if err != nil {
+			WriteAPIError(w, http.StatusInternalServerError, api.CodeOperationFailed, err.Error())
+			return
+		}
+		writeEnvFile(w, data)
+	}
+}
+
+func previewEnvImportV1(nm networkmanager.NetworkManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, 2*maxEnvImportSize)
+		var request api.EnvImportRequest
+		if !decodeAPIRequest(w, r, &request) {
+			return
+		}
+		plan, err := planEnvImport(nm, request.Content, request.Mode)
+		if err != nil {
+			WriteAPIError(w, http.StatusBadRequest, api.CodeInvalidParameter, err.Error())
+			return
+		}
+		WriteAPIData(w, plan.preview)
+	}
+}
+
+// envImportV1 applies an import. Without a base from a preview the current variables are overwritten.
+func envImportV1(nm networkmanager.NetworkManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		nm := nm.WithActor(requestActor(r))
+		r.Body = http.MaxBytesReader(w, r.Body, 2*maxEnvImportSize)
+		var request api.EnvImportRequest
+		if !decodeAPIRequest(w, r, &request) {
+			return
+		}
+		plan, err := planEnvImport(nm, request.Content, request.Mode)
+		if err != nil {
+			WriteAPIError(w, http.StatusBadRequest, api.CodeInvalidParameter, err.Error())
+			return
+		}
+		result, err := plan.apply(nm, request.Base, request.Keep)
+		if errors.Is(err, errImportConflict) {
+			writeAPIResponse(w, http.StatusConflict, APIResponse{Success: false, Error: err.Error(), Code: api.CodeConflict, Details: plan.preview})
+			return
+		} else if err != nil {
+			writeEnvError(w, err)
+			return
+		}
+		WriteAPIData(w, result)
+	}
+}
+
+// envHistoryV1 lists the revisions of the variable in the path, or of every variable
+func envHistoryV1(nm networkmanager.NetworkManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var key string
+		if _, ok := mux.Vars(r)["key"]; ok {
+			if key, ok = envKeyParam(w, r); !ok {
+				return
+			}
+		}
+		revisions, err := nm.GetEnvironmentHistory(key)
+		if err != nil {
+			WriteAPIError(w, http.StatusInternalServerError, api.CodeOperationFailed, err.Error())
+			return
+		}
+		WriteAPIData(w, revisions)
+	}
+}
+
+func envRollbackV1(nm networkmanager.NetworkManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		nm := nm.WithActor(requestActor(r))
+		var request api.EnvRollbackRequest
+		if !decodeAPIRequest(w, r, &request) {
+			return
+		}
+		if request.Key != "" && !validEnvKey(w, request.Key) {
+			return
+		}
+		result, err := rollbackEnv(nm, request.Revision, request.Key)
+		if errors.Is(err, errRevisionNotFound) {
+			WriteAPIError(w, http.StatusNotFound, api.CodeNotFound, "Revision "+strconv.Itoa(request.Revision)+" not found")
+			return
+		} else if err != nil {
+			writeEnvError(w, err)
+			return
+		}
+		WriteAPIData(w, result)
+	}
+}
@@ -0,0 +1,283 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/gorilla/mux"
+	"github.com/ztkent/pifi/api"
+	"github.com/ztkent/pifi/networkmanager"
+)
+
+// APIRoute is a route of the versioned API together with its description in the OpenAPI document
+type APIRoute struct {
+	api.Endpoint
+	Handler http.HandlerFunc
+}
+
+// NetworkAPIRoutes returns the /api/v1 routes that read and change the network configuration
+func NetworkAPIRoutes(nm networkmanager.NetworkManager) []APIRoute {
+	return []APIRoute{
+		{api.Endpoint{Method: http.MethodGet, Path: "/status", Summary: "Get the current network status", Scope: ScopeStatusRead,
+			Response: networkmanager.NetworkStatus{}}, getStatusV1(nm)},
+		{api.Endpoint{Method: http.MethodGet, Path: "/mode", Summary: "Get the WiFi mode", Scope: ScopeStatusRead,
+			Response: api.ModeResponse{}}, getModeV1(nm)},
+		{api.Endpoint{Method: http.MethodPut, Path: "/mode", Summary: "Set the WiFi mode, client or ap", Scope: ScopeNetworksManage,
+			Request: api.ModeRequest{}, Response: api.ModeResponse{}}, setModeV1(nm)},
+	}
+}
+
+// SavedNetworkAPIRoutes returns the /api/v1 routes for nearby and saved networks
+func SavedNetworkAPIRoutes(nm networkmanager.NetworkManager) []APIRoute {
+	return []APIRoute{
+		{api.Endpoint{Method: http.MethodGet, Path: "/networks/available", Summary: "Scan for nearby networks", Scope: ScopeStatusRead,
+			Response: api.AvailableNetworksResponse{}}, findNetworksV1(nm)},
+		{api.Endpoint{Method: http.MethodGet, Path: "/networks", Summary: "List saved networks", Scope: ScopeNetworksManage,
+			Response: api.ConfiguredNetworksResponse{}}, listNetworksV1(nm)},
+		{api.Endpoint{Method: http.MethodPut, Path: "/networks/{ssid}", Summary: "Create or replace a saved network", Scope: ScopeNetworksManage,
+			Request: api.NetworkSettings{}, Response: api.NetworkResult{}, Connects: true}, putNetworkV1(nm)},
+		{api.Endpoint{Method: http.MethodPatch, Path: "/networks/{ssid}", Summary: "Change whether a saved network connects automatically", Scope: ScopeNetworksManage,
+			Request: api.AutoConnectSettings{}, Response: api.NetworkResult{}}, patchNetworkV1(nm)},
+		{api.Endpoint{Method: http.MethodDelete, Path: "/networks/{ssid}", Summary: "Remove a saved network", Scope: ScopeNetworksManage,
+			Response: api.NetworkResult{}}, deleteNetworkV1(nm)},
+		{api.Endpoint{Method: http.MethodPost, Path: "/networks/{ssid}/connect", Summary: "Connect to a saved network", Scope: ScopeNetworksManage,
+			Response: api.NetworkResult{}, Connects: true}, connectNetworkV1(nm)},
+	}
+}
+
+// ConfigAPIRoute returns the /api/v1 route serving the effective configuration
+func ConfigAPIRoute(config interface{}) APIRoute {
+	return APIRoute{api.Endpoint{Method: http.MethodGet, Path: "/config", Summary: "Get the effective configuration", Scope: ScopeAdmin,
+		Response: config}, GetConfigAPI(config)}
+}
+
+// OpenAPIRoute returns the route serving the OpenAPI document of routes, which is added to the document itself
+func OpenAPIRoute(serverURL string, routes []APIRoute) APIRoute {
+	route := APIRoute{Endpoint: api.Endpoint{Method: http.MethodGet, Path: "/openapi.json", Summary: "Get this OpenAPI document",
+		Raw: true}}
+
+	endpoints := make([]api.Endpoint, 0, len(routes)+1)
+	for _, r := range routes {
+		endpoints = append(endpoints, r.Endpoint)
+	}
+	doc, err := json.MarshalIndent(api.NewOpenAPI(serverURL, append(endpoints, route.Endpoint)), "", "  ")
+	route.Handler = func(w http.ResponseWriter, r *http.Request) {
+		if err != nil {
+			WriteAPIError(w, http.StatusInternalServerError, api.CodeOperationFailed, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(doc)
+	}
+	return route
+}
+
+// APINotFound answers requests for /api/v1 routes that don't exist
+func APINotFound(w http.ResponseWriter, r *http.Request) {
+	WriteAPIError(w, http.StatusNotFound, api.CodeNotFound, "No such API route "+r.Method+" "+r.URL.Path)
+}
+
+// Deprecated marks a legacy API route, pointing clients at the versioned API described by docURL
+func Deprecated(docURL string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Deprecation", "true")
+			w.Header().Set("Link", "<"+docURL+`>; rel="deprecation"`)
+			next(w, r)
+		}
+	}
+}
+
+// WriteAPIData writes a successful API response
+func WriteAPIData(w http.ResponseWriter, data interface{}) {
+	writeAPIResponse(w, http.StatusOK, APIResponse{Success: true, Data: data})
+}
+
+// WriteAPIError writes a failed API response with one of the api.Code* error codes
+func WriteAPIError(w http.ResponseWriter, status int, code, message string) {
+	writeAPIResponse(w, status, APIResponse{Success: false, Error: message, Code: code})
+}
+
+func writeAPIResponse(w http.ResponseWriter, status int, response APIResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// writeNetworkError answers with the diagnosis of a failed network change, or a generic error
+func writeNetworkError(w http.ResponseWriter, err error) {
+	var connErr *networkmanager.ConnectionError
+	if !errors.As(err, &connErr) {
+		WriteAPIError(w, http.StatusInternalServerError, api.CodeOperationFailed, err.Error())
+		return
+	}
+
+	status := http.StatusUnprocessableEntity
+	if connErr.Code == networkmanager.FailureNMNotRunning || connErr.Code == networkmanager.FailureRadioDisabled {
+		status = http.StatusServiceUnavailable
+	}
+	writeAPIResponse(w, status, APIResponse{Success: false, Error: connErr.Error(), Code: connErr.Code, Details: connErr})
+}
+
+// decodeAPIRequest decodes the JSON body into v, answering with an error if it is invalid
+func decodeAPIRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		WriteAPIError(w, http.StatusBadRequest, api.CodeInvalidRequest, "Invalid JSON request body")
+		return false
+	}
+	return true
+}
+
+// ssidParam returns the SSID from the request path, answering with an error if it is missing
+func ssidParam(w http.ResponseWriter, r *http.Request) (string, bool) {
+	ssid, err := url.PathUnescape(mux.Vars(r)["ssid"])
+	if err != nil {
+		WriteAPIError(w, http.StatusBadRequest, api.CodeInvalidParameter, "Invalid SSID in path")
+		return "", false
+	}
+	if ssid == "" {
+		WriteAPIError(w, http.StatusBadRequest, api.CodeMissingParameter, "SSID parameter is required")
+		return "", false
+	}
+	return ssid, true
+}
+
+func getStatusV1(nm networkmanager.NetworkManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status, err := nm.GetNetworkStatus()
+		if err != nil {
+			WriteAPIError(w, http.StatusInternalServerError, api.CodeOperationFailed, err.Error())
+			return
+		}
+		WriteAPIData(w, status)
+	}
+}
+
+func getModeV1(nm networkmanager.NetworkManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status, err := nm.GetNetworkStatus()
+		if err != nil {
+			WriteAPIError(w, http.StatusInternalServerError, api.CodeOperationFailed, err.Error())
+			return
+		}
+		WriteAPIData(w, api.ModeResponse{Mode: status.Mode})
+	}
+}
+
+func setModeV1(nm networkmanager.NetworkManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request api.ModeRequest
+		if !decodeAPIRequest(w, r, &request) {
+			return
+		}
+		switch request.Mode {
+		case "":
+			WriteAPIError(w, http.StatusBadRequest, api.CodeMissingParameter, "Mode parameter is required")
+			return
+		case networkmanager.ModeClient, networkmanager.ModeAP:
+		default:
+			WriteAPIError(w, http.StatusBadRequest, api.CodeInvalidParameter, "Mode must be client or ap")
+			return
+		}
+
+		if err := nm.SetWifiMode(request.Mode); err != nil {
+			WriteAPIError(w, http.StatusInternalServerError, api.CodeOperationFailed, err.Error())
+			return
+		}
+		WriteAPIData(w, api.ModeResponse{Mode: request.Mode})
+	}
+}
+
+func findNetworksV1(nm networkmanager.NetworkManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		networks, err := nm.FindAvailableNetworks()
+		if err != nil {
+			WriteAPIError(w, http.StatusInternalServerError, api.CodeOperationFailed, err.Error())
+			return
+		}
+		WriteAPIData(w, api.AvailableNetworksResponse{Networks: networks})
+	}
+}
+
+func listNetworksV1(nm networkmanager.NetworkManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		connections, err := nm.GetConfiguredConnections()
+		if err != nil {
+			WriteAPIError(w, http.StatusInternalServerError, api.CodeOperationFailed, err.Error())
+			return
+		}
+		WriteAPIData(w, api.ConfiguredNetworksResponse{Connections: connections})
+	}
+}
+
+func putNetworkV1(nm networkmanager.NetworkManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ssid, ok := ssidParam(w, r)
+		if !ok {
+			return
+		}
+		var request api.NetworkSettings
+		if !decodeAPIRequest(w, r, &request) {
+			return
+		}
+
+		if err := nm.ModifyNetworkConnection(ssid, request.Password, request.AutoConnect); err != nil {
+			writeNetworkError(w, err)
+			return
+		}
+		WriteAPIData(w, api.NetworkResult{SSID: ssid, Status: "modified", AutoConnect: &request.AutoConnect})
+	}
+}
+
+func patchNetworkV1(nm networkmanager.NetworkManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ssid, ok := ssidParam(w, r)
+		if !ok {
+			return
+		}
+		var request api.AutoConnectSettings
+		if !decodeAPIRequest(w, r, &request) {
+			return
+		}
+		if request.AutoConnect == nil {
+			WriteAPIError(w, http.StatusBadRequest, api.CodeMissingParameter, "autoConnect parameter is required")
+			return
+		}
+
+		if err := nm.SetAutoConnectConnection(ssid, *request.AutoConnect); err != nil {
+			WriteAPIError(w, http.StatusInternalServerError, api.CodeOperationFailed, err.Error())
+			return
+		}
+		WriteAPIData(w, api.NetworkResult{SSID: ssid, Status: "updated", AutoConnect: request.AutoConnect})
+	}
+}
+
+func deleteNetworkV1(nm networkmanager.NetworkManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ssid, ok := ssidParam(w, r)
+		if !ok {
+			return
+		}
+		if err := nm.RemoveNetworkConnection(ssid); err != nil {
+			WriteAPIError(w, http.StatusInternalServerError, api.CodeOperationFailed, err.Error())
+			return
+		}
+		WriteAPIData(w, api.NetworkResult{SSID: ssid, Status: "removed"})
+	}
+}
+
+func connectNetworkV1(nm networkmanager.NetworkManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ssid, ok := ssidParam(w, r)
+		if !ok {
+			return
+		}
+		if err := nm.ConnectNetwork(ssid); err != nil {
+			writeNetworkError(w, err)
+			return
+		}
+		WriteAPIData(w, api.NetworkResult{SSID: ssid, Status: "connected"})
+	}
+}
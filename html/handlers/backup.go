@@ -0,0 +1,470 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/ztkent/pifi/api"
+	"github.com/ztkent/pifi/backup"
+	"github.com/ztkent/pifi/html"
+	"github.com/ztkent/pifi/networkmanager"
+)
+
+const (
+	// maxBackupSize limits the size of an uploaded backup
+	maxBackupSize = 4 << 20
+	// restoreTTL is how long a previewed restore can be applied before the backup must be uploaded again
+	restoreTTL = 15 * time.Minute
+)
+
+// BackupSource is what backups of this device cover, disabled parts are left out and not restored
+type BackupSource struct {
+	NetworkManager networkmanager.NetworkManager
+	Networks       bool          // Saved networks
+	Environment    bool          // Managed environment variables
+	Config         backup.Config // nil leaves the configuration out
+}
+
+// BackupResponse renders the backup card, or the preview of a restore
+type BackupResponse struct {
+	api.BackupPreview
+	CSRFToken string
+	RestoreID string // Names the decoded backup kept in the session until it is restored
+}
+
+// create collects the backup of the device
+func (s BackupSource) create() (backup.Bundle, error) {
+	nm := s.NetworkManager
+	b := backup.Bundle{CreatedAt: time.Now().UTC(), Networks: []networkmanager.SavedConnection{}}
+	b.Hostname, _ = os.Hostname()
+
+	var err error
+	if s.Networks {
+		if b.Networks, err = nm.GetSavedConnections(); err != nil {
+			return b, err
+		}
+	}
+	if s.Environment {
+		env := &backup.Env{}
+		if env.Variables, err = nm.GetEnvironmentVariables(); err != nil {
+			return b, err
+		}
+		if env.Secrets, err = nm.GetEnvironmentSecrets(); err != nil {
+			return b, err
+		}
+		if env.Targets, err = nm.GetEnvironmentTargets(); err != nil {
+			return b, err
+		}
+		b.Env = env
+	}
+	if s.Config != nil {
+		data, err := s.Config.MarshalBackup()
+		if err != nil {
+			return b, err
+		}
+		b.Config = string(data)
+	}
+	return b, nil
+}
+
+// restorePlan is a decoded backup and what restoring it changes
+type restorePlan struct {
+	preview  api.BackupPreview // Passwords and the values of secrets are left out
+	bundle   backup.Bundle
+	networks []networkmanager.SavedConnection
+	targets  map[string]networkmanager.EnvTarget
+	set      map[string]string
+	secrets  map[string]string
+	config   bool
+}
+
+// plan decodes a backup and compares it to the device
+func (s BackupSource) plan(content, passphrase string) (*restorePlan, error) {
+	b, err := backup.Decode([]byte(content), passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return s.planBundle(b)
+}
+
+// planBundle compares a decoded backup to the device. Restoring only adds and updates, networks
+// and variables missing from the backup are kept.
+func (s BackupSource) planBundle(b backup.Bundle) (*restorePlan, error) {
+	nm := s.NetworkManager
+	p := &restorePlan{
+		bundle:  b,
+		preview: api.BackupPreview{CreatedAt: b.CreatedAt, Hostname: b.Hostname, Networks: []api.BackupNetworkChange{}},
+		targets: map[string]networkmanager.EnvTarget{},
+		set:     map[string]string{},
+		secrets: map[string]string{},
+	}
+
+	if !s.Networks && len(b.Networks) > 0 {
+		p.preview.Skipped = append(p.preview.Skipped, "networks")
+	} else if s.Networks {
+		saved, err := nm.GetSavedConnections()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range b.Networks {
+			action := "add"
+			if i := slices.IndexFunc(saved, func(s networkmanager.SavedConnection) bool { return s.SSID == c.SSID }); i >= 0 {
+				action = "update"
+				if saved[i] == c {
+					action = "unchanged"
+				}
+			}
+			if action != "unchanged" {
+				p.networks = append(p.networks, c)
+			}
+			p.preview.Networks = append(p.preview.Networks, api.BackupNetworkChange{SSID: c.SSID, Action: action})
+		}
+	}
+
+	if !s.Environment && b.Env != nil {
+		p.preview.Skipped = append(p.preview.Skipped, "environment")
+	} else if b.Env != nil {
+		if err := p.planEnv(nm, b.Env); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.Config == nil && b.Config != "" {
+		p.preview.Skipped = append(p.preview.Skipped, "config")
+	} else if b.Config != "" {
+		current, err := s.Config.MarshalBackup()
+		if err != nil {
+			return nil, err
+		}
+		p.preview.Config = "unchanged"
+		if string(current) != b.Config {
+			p.preview.Config, p.config = "changed", true
+		}
+	}
+	return p, nil
+}
+
+// planEnv compares the variables of a backup to the managed ones. Secrets of the backup that
+// aren't secrets on the device are set again, to make them secret.
+func (p *restorePlan) planEnv(nm networkmanager.NetworkManager, env *backup.Env) error {
+	current, err := nm.GetEnvironmentVariables()
+	if err != nil {
+		return err
+	}
+	secrets, err := nm.GetEnvironmentSecrets()
+	if err != nil {
+		return err
+	}
+	targets, err := nm.GetEnvironmentTargets()
+	if err != nil {
+		return err
+	}
+
+	diff := networkmanager.DiffEnv(current, env.Variables, false)
+	for _, c := range slices.Concat(diff.Added, diff.Changed) {
+		if slices.Contains(env.Secrets, c.Key) {
+			p.secrets[c.Key] = c.New
+		} else {
+			p.set[c.Key] = c.New
+		}
+	}
+	for _, key := range env.Secrets {
+		if value, ok := env.Variables[key]; ok && !slices.Contains(secrets, key) {
+			p.secrets[key] = value
+		}
+	}
+	for key, target := range env.Targets {
+		if !reflect.DeepEqual(targets[key], target) {
+			p.targets[key] = target
+		}
+	}
+
+	for _, changes := range [][]networkmanager.EnvChange{diff.Added, diff.Changed} {
+		for i, c := range changes {
+			if slices.Contains(env.Secrets, c.Key) || slices.Contains(secrets, c.Key) {
+				changes[i] = networkmanager.EnvChange{Key: c.Key, Old: maskValue(c.Old), New: maskValue(c.New), Secret: true}
+			}
+		}
+	}
+	p.preview.Env = &diff
+	return nil
+}
+
+// apply restores the plan: the networks, then the targets and values of the variables, restarting
+// the units that read them, and last the configuration
+func (p *restorePlan) apply(s BackupSource, nm networkmanager.NetworkManager) (api.BackupRestoreResult, error) {
+	result := api.BackupRestoreResult{Networks: []string{}, Env: []string{}}
+	for _, c := range p.networks {
+		if err := nm.ModifyNetworkConnection(c.SSID, c.Password, c.AutoConnect); err != nil {
+			return result, fmt.Errorf("failed to restore network %s: %v", c.SSID, err)
+		}
+		if err := nm.SetConnectionPriority(c.SSID, c.Priority); err != nil {
+			return result, fmt.Errorf("failed to restore network %s: %v", c.SSID, err)
+		}
+		result.Networks = append(result.Networks, c.SSID)
+	}
+
+	// Targets first, so the values are written to their files
+	for key, target := range p.targets {
+		if err := nm.SetEnvironmentTarget(key, target); err != nil {
+			return result, fmt.Errorf("failed to restore the target of %s: %v", key, err)
+		}
+	}
+	if len(p.set) > 0 {
+		if err := nm.ApplyEnvironment(p.set, nil); err != nil {
+			return result, err
+		}
+	}
+	for key, value := range p.secrets {
+		if err := nm.SetSecretEnvironmentVariable(key, value); err != nil {
+			return result, err
+		}
+	}
+	for key := range p.set {
+		result.Env = append(result.Env, key)
+	}
+	for key := range p.secrets {
+		result.Env = append(result.Env, key)
+	}
+	sort.Strings(result.Env)
+	if len(result.Env) > 0 {
+		result.Units = nm.RestartEnvironmentUnits(result.Env)
+	}
+
+	if p.config {
+		if err := s.Config.RestoreBackup([]byte(p.bundle.Config)); err != nil {
+			return result, err
+		}
+		result.Config = true
+	}
+	return result, nil
+}
+
+// backupError returns the status for a failed backup or restore
+func backupError(err error) int {
+	var invalid *networkmanager.EnvValidationError
+	switch {
+	case errors.Is(err, backup.ErrPassphraseRequired), errors.Is(err, backup.ErrWrongPassphrase), errors.As(err, &invalid):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeBackupFile answers with a backup file download
+func writeBackupFile(w http.ResponseWriter, data []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="pifi-backup-%s.json"`, time.Now().Format("2006-01-02")))
+	w.Write(data)
+}
+
+// BackupHandler renders the backup card
+func BackupHandler(sm *SessionManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		csrfToken, err := sm.CSRFToken(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		tmpl, err := template.ParseFS(html.Templates, "templates/backup.gohtml")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := tmpl.Execute(w, BackupResponse{CSRFToken: csrfToken}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// DownloadBackupHandler downloads a backup of the device, encrypted with the passphrase if one is given
+func DownloadBackupHandler(s BackupSource) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		b, err := s.create()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data, err := backup.Encode(b, r.Form.Get("passphrase"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeBackupFile(w, data)
+	}
+}
+
+// backupContent returns the uploaded backup file
+func backupContent(r *http.Request) (string, error) {
+	if err := r.ParseMultipartForm(maxBackupSize); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		return "", fmt.Errorf("failed to read the upload: %v", err)
+	}
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		return "", fmt.Errorf("choose a backup file")
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, maxBackupSize+1))
+	if err != nil {
+		return "", fmt.Errorf("failed to read the upload: %v", err)
+	}
+	if len(data) > maxBackupSize {
+		return "", fmt.Errorf("the file is larger than %d bytes", maxBackupSize)
+	}
+	return string(data), nil
+}
+
+// PreviewRestoreHandler renders what restoring an uploaded backup would change. The decoded backup
+// is kept in the session, the page only gets its id.
+func PreviewRestoreHandler(s BackupSource, sm *SessionManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, 2*maxBackupSize)
+		content, err := backupContent(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		plan, err := s.plan(content, r.FormValue("passphrase"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		restoreID, err := sm.Stash(w, r, plan.bundle, restoreTTL)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		tmpl, err := template.ParseFS(html.Templates, "templates/backup_restore.gohtml")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		err = tmpl.Execute(w, BackupResponse{BackupPreview: plan.preview, RestoreID: restoreID})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// RestoreBackupHandler restores the backup previewed in the same session
+func RestoreBackupHandler(s BackupSource, sm *SessionManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		nm := s.NetworkManager.WithActor(requestActor(r))
+		r.ParseForm()
+		stashed, ok := sm.Unstash(r, r.Form.Get("restore"))
+		b, isBundle := stashed.(backup.Bundle)
+		if !ok || !isBundle {
+			http.Error(w, "The preview expired, upload the backup again", http.StatusBadRequest)
+			return
+		}
+		plan, err := s.planBundle(b)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result, err := plan.apply(s, nm)
+		if err != nil {
+			http.Error(w, "Restore stopped, "+err.Error(), backupError(err))
+			return
+		}
+		var lines []string
+		if len(result.Networks) > 0 {
+			lines = append(lines, fmt.Sprintf("Restored %d network(s)", len(result.Networks)))
+		}
+		if len(result.Env) > 0 {
+			lines = append(lines, fmt.Sprintf("Restored %d environment variable(s)", len(result.Env)))
+		}
+		lines = append(lines, unitResultLines(w, result.Units)...)
+		if result.Config {
+			lines = append(lines, "Restored the configuration, restart PiFi to apply it")
+		}
+		writeResultLines(w, lines)
+	}
+}
+
+// BackupAPIRoutes returns the /api/v1 routes that back up and restore the device
+func BackupAPIRoutes(s BackupSource) []APIRoute {
+	return []APIRoute{
+		{api.Endpoint{Method: http.MethodPost, Path: "/backup", Summary: "Download a backup of the device, encrypted if a passphrase is given", Scope: ScopeAdmin,
+			Request: api.BackupRequest{}, Raw: true}, backupV1(s)},
+		{api.Endpoint{Method: http.MethodPost, Path: "/backup/restore/preview", Summary: "Preview what restoring a backup changes", Scope: ScopeAdmin,
+			Request: api.BackupRestoreRequest{}, Response: api.BackupPreview{}}, previewRestoreV1(s)},
+		{api.Endpoint{Method: http.MethodPost, Path: "/backup/restore", Summary: "Restore a backup, adding and updating networks and environment variables", Scope: ScopeAdmin,
+			Request: api.BackupRestoreRequest{}, Response: api.BackupRestoreResult{}}, restoreV1(s)},
+	}
+}
+
+func backupV1(s BackupSource) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request api.BackupRequest
+		if r.ContentLength != 0 && !decodeAPIRequest(w, r, &request) {
+			return
+		}
+		b, err := s.create()
+		if err != nil {
+			WriteAPIError(w, http.StatusInternalServerError, api.CodeOperationFailed, err.Error())
+			return
+		}
+		data, err := backup.Encode(b, request.Passphrase)
+		if err != nil {
+			WriteAPIError(w, http.StatusInternalServerError, api.CodeOperationFailed, err.Error())
+			return
+		}
+		writeBackupFile(w, data)
+	}
+}
+
+func previewRestoreV1(s BackupSource) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, 2*maxBackupSize)
+		var request api.BackupRestoreRequest
+		if !decodeAPIRequest(w, r, &request) {
+			return
+		}
+		plan, err := s.plan(request.Backup, request.Passphrase)
+		if err != nil {
+			WriteAPIError(w, http.StatusBadRequest, api.CodeInvalidParameter, err.Error())
+			return
+		}
+		WriteAPIData(w, plan.preview)
+	}
+}
+
+func restoreV1(s BackupSource) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		nm := s.NetworkManager.WithActor(requestActor(r))
+		r.Body = http.MaxBytesReader(w, r.Body, 2*maxBackupSize)
+		var request api.BackupRestoreRequest
+		if !decodeAPIRequest(w, r, &request) {
+			return
+		}
+		plan, err := s.plan(request.Backup, request.Passphrase)
+		if err != nil {
+			WriteAPIError(w, http.StatusBadRequest, api.CodeInvalidParameter, err.Error())
+			return
+		}
+		result, err := plan.apply(s, nm)
+		if err != nil {
+			// What was restored before the failure stays, restoring again continues from there
+			code := api.CodeOperationFailed
+			if backupError(err) == http.StatusBadRequest {
+				code = api.CodeInvalidValue
+			}
+			writeAPIResponse(w, backupError(err), APIResponse{Success: false, Error: err.Error(), Code: code, Details: result})
+			return
+		}
+		WriteAPIData(w, result)
+	}
+}
@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ztkent/pifi/backup"
+	"github.com/ztkent/pifi/networkmanager"
+)
+
+// actorNM only supports WithActor, other methods aren't implemented
+type actorNM struct {
+	networkmanager.NetworkManager
+}
+
+func (nm actorNM) WithActor(string) networkmanager.NetworkManager { return nm }
+
+func TestRestoreKeepsBackupOnServer(t *testing.T) {
+	data, err := backup.Encode(backup.Bundle{
+		CreatedAt: time.Now(),
+		Networks:  []networkmanager.SavedConnection{{SSID: "Home", Password: "wifi-secret"}},
+	}, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("file", "backup.json")
+	part.Write(data)
+	form.WriteField("passphrase", "correct horse")
+	form.Close()
+
+	sm := newTestSessionManager(t)
+	s := BackupSource{NetworkManager: actorNM{}}
+	preview := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/backup/preview", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	PreviewRestoreHandler(s, sm)(preview, r)
+	if preview.Code != http.StatusOK {
+		t.Fatalf("preview = %d: %s", preview.Code, preview.Body)
+	}
+	page := preview.Body.String()
+	for _, secret := range []string{"wifi-secret", "correct horse", string(data[:20])} {
+		if strings.Contains(page, secret) {
+			t.Errorf("preview page contains %q", secret)
+		}
+	}
+	match := regexp.MustCompile(`name="restore" value="([^"]+)"`).FindStringSubmatch(page)
+	if match == nil {
+		t.Fatalf("no restore id in the preview:\n%s", page)
+	}
+
+	restore := func(r *http.Request) int {
+		r.Form = map[string][]string{"restore": {match[1]}}
+		w := httptest.NewRecorder()
+		RestoreBackupHandler(s, sm)(w, r)
+		return w.Code
+	}
+	if code := restore(httptest.NewRequest("POST", "/backup/restore", nil)); code != http.StatusBadRequest {
+		t.Errorf("restore from another session = %d, want 400", code)
+	}
+	if code := restore(withCookies(preview, "POST", "/backup/restore")); code != http.StatusOK {
+		t.Errorf("restore = %d, want 200", code)
+	}
+	if code := restore(withCookies(preview, "POST", "/backup/restore")); code != http.StatusBadRequest {
+		t.Errorf("second restore of the same preview = %d, want 400", code)
+	}
+}
@@ -0,0 +1,21 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+)
+
+type basePathKey struct{}
+
+// WithBasePath records the path PiFi is mounted under, so redirects stay inside it
+func WithBasePath(basePath string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), basePathKey{}, basePath)))
+	})
+}
+
+// pathFor returns the absolute path of a PiFi page, such as /login, for the request
+func pathFor(r *http.Request, path string) string {
+	basePath, _ := r.Context().Value(basePathKey{}).(string)
+	return basePath + path
+}
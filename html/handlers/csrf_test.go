@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRequireCSRF(t *testing.T) {
+	sm := newTestSessionManager(t)
+	page := httptest.NewRecorder()
+	token, err := sm.CSRFToken(page, httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := newTestSessionManager(t).CSRFToken(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	post := func(form url.Values, header map[string]string) *http.Request {
+		r := httptest.NewRequest("POST", "/network/connect", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, c := range page.Result().Cookies() {
+			r.AddCookie(c)
+		}
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		return r
+	}
+	noCookie := httptest.NewRequest("POST", "/network/connect", nil)
+	noCookie.Header.Set(csrfHeaderName, token)
+
+	for _, tc := range []struct {
+		name string
+		r    *http.Request
+		want int
+	}{
+		{"safe method", httptest.NewRequest("GET", "/network/connect", nil), http.StatusOK},
+		{"header token", post(nil, map[string]string{csrfHeaderName: token}), http.StatusOK},
+		{"form token", post(url.Values{csrfFormField: {token}}, nil), http.StatusOK},
+		{"same origin", post(nil, map[string]string{csrfHeaderName: token, "Origin": "http://example.com"}), http.StatusOK},
+		{"missing token", post(nil, nil), http.StatusForbidden},
+		{"wrong token", post(nil, map[string]string{csrfHeaderName: token + "x"}), http.StatusForbidden},
+		{"token of another key", post(nil, map[string]string{csrfHeaderName: other}), http.StatusForbidden},
+		{"missing cookie", noCookie, http.StatusForbidden},
+		{"cross origin", post(nil, map[string]string{csrfHeaderName: token, "Origin": "http://evil.example"}), http.StatusForbidden},
+		{"cross origin referer", post(nil, map[string]string{csrfHeaderName: token, "Referer": "http://evil.example/page"}), http.StatusForbidden},
+		{"null origin", post(nil, map[string]string{csrfHeaderName: token, "Origin": "null"}), http.StatusForbidden},
+	} {
+		w := httptest.NewRecorder()
+		RequireCSRF(sm)(func(http.ResponseWriter, *http.Request) {})(w, tc.r)
+		if w.Code != tc.want {
+			t.Errorf("%s: status = %d, want %d", tc.name, w.Code, tc.want)
+		}
+	}
+}
+
+func TestRequireSameOrigin(t *testing.T) {
+	for _, tc := range []struct {
+		name, method, origin string
+		want                 int
+	}{
+		{"script without origin", "POST", "", http.StatusOK},
+		{"same origin", "PUT", "http://example.com", http.StatusOK},
+		{"cross origin", "DELETE", "http://evil.example", http.StatusForbidden},
+		{"cross origin read", "GET", "http://evil.example", http.StatusOK},
+	} {
+		r := httptest.NewRequest(tc.method, "/api/v1/env/FOO", nil)
+		if tc.origin != "" {
+			r.Header.Set("Origin", tc.origin)
+		}
+		w := httptest.NewRecorder()
+		RequireSameOrigin(func(http.ResponseWriter, *http.Request) {})(w, r)
+		if w.Code != tc.want {
+			t.Errorf("%s: status = %d, want %d", tc.name, w.Code, tc.want)
+		}
+	}
+}
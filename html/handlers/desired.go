@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+
+	"github.com/ztkent/pifi/api"
+	"github.com/ztkent/pifi/desired"
+)
+
+// DesiredStateAPIRoutes returns the /api/v1 routes reporting and reconciling the desired state file
+func DesiredStateAPIRoutes(r *desired.Reconciler) []APIRoute {
+	return []APIRoute{
+		{api.Endpoint{Method: http.MethodGet, Path: "/desired", Summary: "Get the drift from the desired state file and the last reconcile", Scope: ScopeAdmin,
+			Response: api.DesiredStateStatus{}}, getDesiredStateV1(r)},
+		{api.Endpoint{Method: http.MethodPost, Path: "/desired/reconcile", Summary: "Apply the desired state file now", Scope: ScopeAdmin,
+			Response: api.DesiredStateStatus{}}, reconcileV1(r)},
+	}
+}
+
+// writeDesiredStateError answers with a failed status or reconcile, the status is in the details
+func writeDesiredStateError(w http.ResponseWriter, status api.DesiredStateStatus, err error) {
+	if errors.Is(err, fs.ErrNotExist) {
+		WriteAPIError(w, http.StatusNotFound, api.CodeNotFound, "No desired state file at "+status.File)
+		return
+	}
+	writeAPIResponse(w, http.StatusInternalServerError, APIResponse{Success: false, Error: err.Error(), Code: api.CodeOperationFailed, Details: status})
+}
+
+func getDesiredStateV1(r *desired.Reconciler) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		status, err := r.Status()
+		if err != nil {
+			writeDesiredStateError(w, status, err)
+			return
+		}
+		WriteAPIData(w, status)
+	}
+}
+
+func reconcileV1(r *desired.Reconciler) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		status, err := r.Reconcile()
+		if err != nil {
+			writeDesiredStateError(w, status, err)
+			return
+		}
+		WriteAPIData(w, status)
+	}
+}
@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/ztkent/pifi/api"
+	"github.com/ztkent/pifi/html"
+	"github.com/ztkent/pifi/networkmanager"
+)
+
+// EnvHistoryResponse renders the revisions of one variable, or of all of them if Key is empty
+type EnvHistoryResponse struct {
+	Key       string
+	Revisions []networkmanager.EnvRevision
+}
+
+// requestActor names who made a request: the signed-in user, the API token, or else the client address
+func requestActor(r *http.Request) string {
+	if username, ok := requestUser(r); ok {
+		return username
+	}
+	if token, ok := requestToken(r); ok {
+		return "token " + token.Name
+	}
+	return clientIP(r)
+}
+
+// errRevisionNotFound is returned when rolling back to a revision that doesn't exist, or isn't of the given variable
+var errRevisionNotFound = errors.New("no such revision")
+
+// rollbackEnv rolls the variables back to revision and restarts the units that read the changed ones
+func rollbackEnv(nm networkmanager.NetworkManager, revision int, key string) (api.EnvRollbackResult, error) {
+	revisions, err := nm.GetEnvironmentHistory(key)
+	if err != nil {
+		return api.EnvRollbackResult{}, err
+	}
+	if !slices.ContainsFunc(revisions, func(rev networkmanager.EnvRevision) bool { return rev.ID == revision }) {
+		return api.EnvRollbackResult{}, errRevisionNotFound
+	}
+	rollback, err := nm.RollbackEnvironment(revision, key)
+	if err != nil {
+		return api.EnvRollbackResult{}, err
+	}
+	result := api.EnvRollbackResult{EnvRollback: rollback}
+	result.Units = nm.RestartEnvironmentUnits(slices.Concat(rollback.Set, rollback.Unset))
+	return result, nil
+}
+
+// EnvironmentHistoryHandler renders the revisions of the variable in ?key=, or of every variable
+func EnvironmentHistoryHandler(nm networkmanager.NetworkManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Query().Get("key")
+		revisions, err := nm.GetEnvironmentHistory(key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		tmpl, err := template.ParseFS(html.Templates, "templates/env_history.gohtml")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		err = tmpl.Execute(w, EnvHistoryResponse{Key: key, Revisions: revisions})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// RollbackEnvironmentHandler rolls the variables back to a revision, only the variable in key if it is set
+func RollbackEnvironmentHandler(nm networkmanager.NetworkManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		nm := nm.WithActor(requestActor(r))
+		r.ParseForm()
+		revision, err := strconv.Atoi(r.Form.Get("revision"))
+		if err != nil {
+			http.Error(w, "Invalid revision", http.StatusBadRequest)
+			return
+		}
+
+		result, err := rollbackEnv(nm, revision, r.Form.Get("key"))
+		var invalid *networkmanager.EnvValidationError
+		switch {
+		case errors.Is(err, errRevisionNotFound):
+			http.Error(w, "Revision not found, reload the history", http.StatusNotFound)
+			return
+		case errors.As(err, &invalid):
+			http.Error(w, "Not rolled back, "+invalid.Error(), http.StatusBadRequest)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(result.Skipped) > 0 {
+			w.Header().Set("X-PiFi-Skipped", strings.Join(result.Skipped, ", "))
+		}
+		writeUnitResults(w, result.Units)
+	}
+}
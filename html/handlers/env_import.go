@@ -0,0 +1,238 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+
+	"github.com/ztkent/pifi/api"
+	"github.com/ztkent/pifi/html"
+	"github.com/ztkent/pifi/networkmanager"
+)
+
+// maxEnvImportSize limits the size of an imported .env file
+const maxEnvImportSize = 1 << 20
+
+// errImportConflict is returned when the variables changed between the preview and the import
+var errImportConflict = errors.New("the environment variables changed since the import was previewed, preview it again")
+
+// EnvImportResponse renders the preview of an import
+type EnvImportResponse struct {
+	api.EnvImportPreview
+	Content string
+	Mode    string
+}
+
+// envImportPlan is a parsed .env file and the changes importing it makes
+type envImportPlan struct {
+	preview api.EnvImportPreview // Values of secrets are masked
+	set     map[string]string
+	unset   []string
+}
+
+// planEnvImport compares content to the managed variables. Mode "replace" also removes the variables
+// missing from content, except secrets, which an export without secret values doesn't list.
+func planEnvImport(nm networkmanager.NetworkManager, content, mode string) (*envImportPlan, error) {
+	if mode != "" && mode != "merge" && mode != "replace" {
+		return nil, fmt.Errorf("import mode must be merge or replace")
+	}
+	current, err := nm.GetEnvironmentVariables()
+	if err != nil {
+		return nil, err
+	}
+	secrets, err := nm.GetEnvironmentSecrets()
+	if err != nil {
+		return nil, err
+	}
+	if schema, err := nm.GetEnvironmentSchema(); err == nil {
+		for _, v := range schema.Variables {
+			if v.Secret {
+				secrets = append(secrets, v.Key)
+			}
+		}
+	}
+
+	imported, ignored := networkmanager.ParseEnv(content)
+	diff := networkmanager.DiffEnv(current, imported, mode == "replace")
+	diff.Removed = slices.DeleteFunc(diff.Removed, func(c networkmanager.EnvChange) bool { return slices.Contains(secrets, c.Key) })
+
+	plan := &envImportPlan{set: map[string]string{}, unset: []string{}}
+	for _, c := range slices.Concat(diff.Added, diff.Changed) {
+		plan.set[c.Key] = c.New
+	}
+	for _, c := range diff.Removed {
+		plan.unset = append(plan.unset, c.Key)
+	}
+	for _, changes := range [][]networkmanager.EnvChange{diff.Added, diff.Changed, diff.Removed} {
+		for i, c := range changes {
+			if slices.Contains(secrets, c.Key) {
+				changes[i] = networkmanager.EnvChange{Key: c.Key, Old: maskValue(c.Old), New: maskValue(c.New), Secret: true}
+			}
+		}
+	}
+	base, err := nm.EnvFingerprint(current)
+	if err != nil {
+		return nil, err
+	}
+	plan.preview = api.EnvImportPreview{EnvDiff: diff, Ignored: ignored, Base: base}
+	return plan, nil
+}
+
+// maskValue masks a secret value, empty values stay empty
+func maskValue(value string) string {
+	if value == "" {
+		return ""
+	}
+	return api.SecretMask
+}
+
+// apply applies the plan at once. The changed variables in keep keep their current value.
+// It fails with errImportConflict if base isn't empty and the variables changed since the preview.
+func (p *envImportPlan) apply(nm networkmanager.NetworkManager, base string, keep []string) (api.EnvBatchResult, error) {
+	if base != "" && base != p.preview.Base {
+		return api.EnvBatchResult{}, errImportConflict
+	}
+	for _, key := range keep {
+		delete(p.set, key)
+	}
+	if err := nm.ApplyEnvironment(p.set, p.unset); err != nil {
+		return api.EnvBatchResult{}, err
+	}
+
+	result := api.EnvBatchResult{Set: make([]string, 0, len(p.set)), Unset: p.unset}
+	for key := range p.set {
+		result.Set = append(result.Set, key)
+	}
+	sort.Strings(result.Set)
+	result.Units = nm.RestartEnvironmentUnits(slices.Concat(result.Set, result.Unset))
+	return result, nil
+}
+
+// exportEnv returns the managed variables as a .env file. Without withSecrets, secrets are only listed in comments.
+func exportEnv(nm networkmanager.NetworkManager, withSecrets bool) ([]byte, error) {
+	vars, err := nm.GetEnvironmentVariables()
+	if err != nil {
+		return nil, err
+	}
+	var omitted []string
+	if !withSecrets {
+		secrets, err := nm.GetEnvironmentSecrets()
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range secrets {
+			if _, ok := vars[key]; ok {
+				delete(vars, key)
+				omitted = append(omitted, key)
+			}
+		}
+		sort.Strings(omitted)
+	}
+	return networkmanager.FormatEnv(vars, omitted), nil
+}
+
+// writeEnvFile answers with data as a .env file download
+func writeEnvFile(w http.ResponseWriter, data []byte) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="pifi.env"`)
+	w.Write(data)
+}
+
+// ExportEnvironmentHandler downloads the managed variables as a .env file, with secrets=1 including the values of secrets
+func ExportEnvironmentHandler(nm networkmanager.NetworkManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data, err := exportEnv(nm, r.URL.Query().Get("secrets") == "1")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeEnvFile(w, data)
+	}
+}
+
+// importContent returns the uploaded .env file, or the pasted content if no file was uploaded
+func importContent(r *http.Request) (string, error) {
+	if err := r.ParseMultipartForm(maxEnvImportSize); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		return "", fmt.Errorf("failed to read the upload: %v", err)
+	}
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		return r.FormValue("content"), nil
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, maxEnvImportSize+1))
+	if err != nil {
+		return "", fmt.Errorf("failed to read the upload: %v", err)
+	}
+	if len(data) > maxEnvImportSize {
+		return "", fmt.Errorf("the file is larger than %d bytes", maxEnvImportSize)
+	}
+	return string(data), nil
+}
+
+// PreviewEnvironmentImportHandler renders what importing an uploaded or pasted .env file would change
+func PreviewEnvironmentImportHandler(nm networkmanager.NetworkManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, 2*maxEnvImportSize)
+		content, err := importContent(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mode := r.FormValue("mode")
+		plan, err := planEnvImport(nm, content, mode)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		tmpl, err := template.ParseFS(html.Templates, "templates/env_import.gohtml")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		err = tmpl.Execute(w, EnvImportResponse{EnvImportPreview: plan.preview, Content: content, Mode: mode})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// ImportEnvironmentHandler applies a previewed import. The changed variables checked as keep
+// keep their current value.
+func ImportEnvironmentHandler(nm networkmanager.NetworkManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		nm := nm.WithActor(requestActor(r))
+		r.Body = http.MaxBytesReader(w, r.Body, 2*maxEnvImportSize)
+		r.ParseForm()
+		plan, err := planEnvImport(nm, r.Form.Get("content"), r.Form.Get("mode"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.Form.Get("base") == "" {
+			http.Error(w, "Preview the import before applying it", http.StatusBadRequest)
+			return
+		}
+
+		result, err := plan.apply(nm, r.Form.Get("base"), r.Form["keep"])
+		var invalid *networkmanager.EnvValidationError
+		switch {
+		case errors.Is(err, errImportConflict):
+			http.Error(w, "Not imported, "+err.Error(), http.StatusConflict)
+			return
+		case errors.As(err, &invalid):
+			http.Error(w, "Not imported, "+invalid.Error(), http.StatusBadRequest)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeUnitResults(w, result.Units)
+	}
+}
@@ -0,0 +1,21 @@
+package handlers
+
+// Dashboard describes the index page, including tabs added by applications embedding PiFi
+type Dashboard struct {
+	Features
+	Tabs []DashboardTab
+}
+
+// DashboardTab is a navigation tab with cards loaded by htmx
+type DashboardTab struct {
+	ID    string
+	Title string
+	Role  string // Minimum role that sees the tab
+	Cards []DashboardCard
+}
+
+type DashboardCard struct {
+	Title   string
+	Path    string // Relative to the dashboard, such as ext/device
+	Trigger string // htmx trigger that loads the card
+}
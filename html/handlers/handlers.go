@@ -1,9 +1,11 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
 	"html/template"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/ztkent/pifi/html"
@@ -11,10 +13,12 @@ import (
 )
 
 type StatusResponse struct {
-	Status      string    `json:"status"`
-	Timestamp   time.Time `json:"timestamp"`
-	Version     string    `json:"version"`
-	NetworkInfo networkmanager.NetworkStatus
+	Status         string    `json:"status"`
+	Timestamp      time.Time `json:"timestamp"`
+	Version        string    `json:"version"`
+	TLSFingerprint string    `json:"tlsFingerprint,omitempty"`
+	NetworkInfo    networkmanager.NetworkStatus
+	MissingEnv     []string `json:"missingEnv,omitempty"` // Required environment variables that aren't set
 }
 
 type NetworkResponse struct {
@@ -24,10 +28,47 @@ type NetworkResponse struct {
 }
 
 type EnvironmentResponse struct {
-	EnvironmentVars map[string]string `json:"environmentVars"`
-	Timestamp       time.Time         `json:"timestamp"`
-	IsPasswordSet   bool              `json:"isPasswordSet"`
-	RequiresAuth    bool              `json:"requiresAuth"`
+	EnvironmentVars map[string]string                       `json:"environmentVars"` // Values of secrets are left empty
+	Secrets         map[string]bool                         `json:"secrets"`
+	Targets         map[string]networkmanager.EnvTarget     `json:"targets"`
+	Provenance      map[string]networkmanager.EnvProvenance `json:"provenance"` // Values of secrets in drift are masked
+	Schema          []EnvSchemaField                        `json:"schema,omitempty"`
+	SchemaError     string                                  `json:"schemaError,omitempty"`
+	Timestamp       time.Time                               `json:"timestamp"`
+	IsPasswordSet   bool                                    `json:"isPasswordSet"`
+	RequiresAuth    bool                                    `json:"requiresAuth"`
+}
+
+// EnvSchemaField is a variable declared by the environment schema, with its current value
+type EnvSchemaField struct {
+	networkmanager.EnvSchemaVar
+	Value   string // Empty for secrets
+	Set     bool
+	Missing bool // Required and not set
+}
+
+// Features selects the optional parts of the dashboard
+type Features struct {
+	Networks    bool // Saved and available networks
+	Environment bool // Environment variables
+	Accounts    bool // Users and API tokens
+}
+
+// AllFeatures enables every part of the dashboard
+var AllFeatures = Features{Networks: true, Environment: true, Accounts: true}
+
+type IndexResponse struct {
+	Features
+	Tabs         []DashboardTab
+	UsersEnabled bool
+	User         string
+	Role         string
+	CSRFToken    string
+}
+
+// CanManage reports whether the signed-in user holds role. Everything is allowed without accounts.
+func (r IndexResponse) CanManage(role string) bool {
+	return !r.UsersEnabled || User{Role: r.Role}.HasRole(role)
 }
 
 type PasswordResponse struct {
@@ -45,14 +86,38 @@ func SetMode(nm networkmanager.NetworkManager) http.HandlerFunc {
 	}
 }
 
-func PiFiHandler(nm networkmanager.NetworkManager) http.HandlerFunc {
+func PiFiHandler(nm networkmanager.NetworkManager, users *UserStore, sm *SessionManager, dashboard *Dashboard) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		csrfToken, err := sm.CSRFToken(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		usersEnabled, err := users.Enabled()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response := IndexResponse{
+			Features:     dashboard.Features,
+			Tabs:         dashboard.Tabs,
+			UsersEnabled: usersEnabled,
+			CSRFToken:    csrfToken,
+		}
+		if username, ok := sm.User(r); ok {
+			if user, err := users.Get(username); err == nil {
+				response.User = user.Username
+				response.Role = user.Role
+			}
+		}
+
 		tmpl, err := template.ParseFS(html.Templates, "templates/index.gohtml")
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		err = tmpl.Execute(w, nil)
+		err = tmpl.Execute(w, response)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -60,18 +125,25 @@ func PiFiHandler(nm networkmanager.NetworkManager) http.HandlerFunc {
 	}
 }
 
-func StatusHandler(nm networkmanager.NetworkManager) http.HandlerFunc {
+// StatusHandler renders the status card. tlsFingerprint is shown when HTTPS is enabled,
+// with checkEnv required environment variables that aren't set are flagged for sessions
+// that may open the environment page.
+func StatusHandler(nm networkmanager.NetworkManager, users *UserStore, sm *SessionManager, tlsFingerprint string, checkEnv bool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		status := StatusResponse{
-			Status:    "operational",
-			Timestamp: time.Now(),
-			Version:   "1.0.0",
+			Status:         "operational",
+			Timestamp:      time.Now(),
+			Version:        "1.0.0",
+			TLSFingerprint: tlsFingerprint,
 		}
 		netStatus, err := nm.GetNetworkStatus()
 		if err != nil {
 			status.Status = fmt.Sprintf("error: %v", err)
 		}
 		status.NetworkInfo = netStatus
+		if checkEnv && envAccess(r, nm, users, sm) {
+			status.MissingEnv = missingEnvironment(nm)
+		}
 
 		tmpl, err := template.ParseFS(html.Templates, "templates/status.gohtml")
 		if err != nil {
@@ -122,12 +194,22 @@ func ModifyNetworkHandler(nm networkmanager.NetworkManager) http.HandlerFunc {
 		r.ParseForm()
 		err := nm.ModifyNetworkConnection(r.Form.Get("ssid"), r.Form.Get("password"), false)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			networkError(w, err)
 			return
 		}
 	}
 }
 
+// networkError reports a failed network change, with a suggested fix when NetworkManager explained the failure
+func networkError(w http.ResponseWriter, err error) {
+	var connErr *networkmanager.ConnectionError
+	if errors.As(err, &connErr) {
+		http.Error(w, connErr.SSID+": "+connErr.Summary+". "+connErr.Suggestion, http.StatusUnprocessableEntity)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
 func RemoveNetworkConnectionHandler(nm networkmanager.NetworkManager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		r.ParseForm()
@@ -155,99 +237,87 @@ func ConnectNetworkHandler(nm networkmanager.NetworkManager) http.HandlerFunc {
 		r.ParseForm()
 		err := nm.ConnectNetwork(r.Form.Get("network"))
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			networkError(w, err)
 			return
 		}
 	}
 }
 
-func EnvironmentHandler(nm networkmanager.NetworkManager) http.HandlerFunc {
+func EnvironmentHandler(nm networkmanager.NetworkManager, sm *SessionManager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		isPasswordSet := nm.IsEnvPasswordSet()
-
-		// Check if password is required and validate session/password
-		if isPasswordSet {
-			// Check if password was provided
-			r.ParseForm()
-			password := r.Form.Get("password")
-
-			if password == "" {
-				// Show password prompt
-				response := EnvironmentResponse{
-					EnvironmentVars: nil,
-					Timestamp:       time.Now(),
-					IsPasswordSet:   true,
-					RequiresAuth:    true,
-				}
-
-				tmpl, err := template.ParseFS(html.Templates, "templates/envs.gohtml")
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-
-				err = tmpl.Execute(w, response)
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-				return
-			}
+		renderEnvironment(w, nm, sm.EnvUnlocked(r))
+	}
+}
 
-			// Validate password
-			valid, err := nm.ValidateEnvPassword(password)
-			if err != nil || !valid {
-				http.Error(w, "Invalid password", http.StatusUnauthorized)
-				return
-			}
-		}
+// renderEnvironment renders the environment page, or the login prompt if a password is set and
+// the session hasn't unlocked it
+func renderEnvironment(w http.ResponseWriter, nm networkmanager.NetworkManager, unlocked bool) {
+	passwordSet, err := nm.IsEnvPasswordSet()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response := EnvironmentResponse{
+		Timestamp:     time.Now(),
+		IsPasswordSet: passwordSet,
+		RequiresAuth:  passwordSet && !unlocked,
+	}
 
-		// Password validated or not required, show environment variables
+	if !response.RequiresAuth {
 		envVars, err := nm.GetEnvironmentVariables()
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-
-		response := EnvironmentResponse{
-			EnvironmentVars: envVars,
-			Timestamp:       time.Now(),
-			IsPasswordSet:   isPasswordSet,
-			RequiresAuth:    false,
-		}
-
-		tmpl, err := template.ParseFS(html.Templates, "templates/envs.gohtml")
+		secrets, err := nm.GetEnvironmentSecrets()
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-
-		err = tmpl.Execute(w, response)
-		if err != nil {
+		// Secret values never reach the page
+		response.Secrets = make(map[string]bool, len(secrets))
+		for _, key := range secrets {
+			if _, ok := envVars[key]; ok {
+				envVars[key] = ""
+				response.Secrets[key] = true
+			}
+		}
+		response.EnvironmentVars = envVars
+		if response.Targets, err = nm.GetEnvironmentTargets(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if response.Provenance, err = maskedProvenance(nm, secrets); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		// A broken schema is shown on the page, the variables can still be managed
+		if schema, err := nm.GetEnvironmentSchema(); err != nil {
+			response.SchemaError = err.Error()
+		} else {
+			for _, v := range schema.Variables {
+				value, ok := envVars[v.Key]
+				response.Schema = append(response.Schema, EnvSchemaField{EnvSchemaVar: v, Value: value, Set: ok, Missing: v.Required && !ok})
+			}
+		}
+	}
+
+	tmpl, err := template.ParseFS(html.Templates, "templates/envs.gohtml")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = tmpl.Execute(w, response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 }
 
 func SetEnvironmentHandler(nm networkmanager.NetworkManager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Check password protection
-		if nm.IsEnvPasswordSet() {
-			r.ParseForm()
-			password := r.Form.Get("auth_password")
-			if password == "" {
-				http.Error(w, "Authentication required", http.StatusUnauthorized)
-				return
-			}
-
-			valid, err := nm.ValidateEnvPassword(password)
-			if err != nil || !valid {
-				http.Error(w, "Invalid password", http.StatusUnauthorized)
-				return
-			}
-		}
-
+		nm := nm.WithActor(requestActor(r))
 		r.ParseForm()
 		key := r.Form.Get("key")
 		value := r.Form.Get("value")
@@ -257,34 +327,23 @@ func SetEnvironmentHandler(nm networkmanager.NetworkManager) http.HandlerFunc {
 			return
 		}
 
-		err := nm.SetEnvironmentVariable(key, value)
-		if err != nil {
+		_, err := setEnv(nm, key, value, r.Form.Get("secret") != "")
+		var invalid *networkmanager.EnvValidationError
+		if errors.As(err, &invalid) {
+			http.Error(w, invalid.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		w.WriteHeader(http.StatusOK)
+		writeUnitResults(w, nm.RestartEnvironmentUnits([]string{key}))
 	}
 }
 
 func UnsetEnvironmentHandler(nm networkmanager.NetworkManager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Check password protection
-		if nm.IsEnvPasswordSet() {
-			r.ParseForm()
-			password := r.Form.Get("auth_password")
-			if password == "" {
-				http.Error(w, "Authentication required", http.StatusUnauthorized)
-				return
-			}
-
-			valid, err := nm.ValidateEnvPassword(password)
-			if err != nil || !valid {
-				http.Error(w, "Invalid password", http.StatusUnauthorized)
-				return
-			}
-		}
-
+		nm := nm.WithActor(requestActor(r))
 		r.ParseForm()
 		key := r.Form.Get("key")
 
@@ -299,11 +358,105 @@ func UnsetEnvironmentHandler(nm networkmanager.NetworkManager) http.HandlerFunc
 			return
 		}
 
+		writeUnitResults(w, nm.RestartEnvironmentUnits([]string{key}))
+	}
+}
+
+// SetEnvironmentTargetHandler sets the file a variable is written to and the units restarted or
+// reloaded after it changes. Units are separated by spaces or commas.
+func SetEnvironmentTargetHandler(nm networkmanager.NetworkManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		nm := nm.WithActor(requestActor(r))
+		r.ParseForm()
+		key := r.Form.Get("key")
+		if key == "" {
+			http.Error(w, "Environment variable key cannot be empty", http.StatusBadRequest)
+			return
+		}
+
+		units := func(field string) []string {
+			return strings.FieldsFunc(r.Form.Get(field), func(c rune) bool { return c == ',' || c == ' ' })
+		}
+		target := networkmanager.EnvTarget{
+			File:    strings.TrimSpace(r.Form.Get("file")),
+			Restart: units("restart"),
+			Reload:  units("reload"),
+		}
+		if err := nm.SetEnvironmentTarget(key, target); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		w.WriteHeader(http.StatusOK)
 	}
 }
 
-func SetEnvPasswordHandler(nm networkmanager.NetworkManager) http.HandlerFunc {
+// missingEnvironment returns the required environment variables that aren't set, nil if they can't be read
+func missingEnvironment(nm networkmanager.NetworkManager) []string {
+	schema, err := nm.GetEnvironmentSchema()
+	if err != nil || len(schema.Variables) == 0 {
+		return nil
+	}
+	vars, err := nm.GetEnvironmentVariables()
+	if err != nil {
+		return nil
+	}
+	return schema.Missing(vars)
+}
+
+// envAccess reports whether the request passes the checks of the environment page: an admin
+// while accounts exist, and the environment password if one is set. Errors deny access.
+func envAccess(r *http.Request, nm networkmanager.NetworkManager, users *UserStore, sm *SessionManager) bool {
+	enabled, err := users.Enabled()
+	if err != nil {
+		return false
+	}
+	if enabled {
+		username, ok := sm.User(r)
+		if !ok {
+			return false
+		}
+		if user, err := users.Get(username); err != nil || !user.HasRole(RoleAdmin) {
+			return false
+		}
+	}
+	passwordSet, err := nm.IsEnvPasswordSet()
+	if err != nil {
+		return false
+	}
+	return !passwordSet || sm.EnvUnlocked(r)
+}
+
+// writeUnitResults answers an environment change with one line per unit restarted or reloaded for it.
+// The X-PiFi-Unit-Failed header is set if a unit failed, the change itself was still saved.
+func writeUnitResults(w http.ResponseWriter, results []networkmanager.UnitResult) {
+	writeResultLines(w, unitResultLines(w, results))
+}
+
+// unitResultLines returns one line per unit result, setting X-PiFi-Unit-Failed if a unit failed
+func unitResultLines(w http.ResponseWriter, results []networkmanager.UnitResult) []string {
+	var lines []string
+	for _, result := range results {
+		if result.Error != "" {
+			w.Header().Set("X-PiFi-Unit-Failed", "true")
+			lines = append(lines, fmt.Sprintf("Failed to %s %s: %s", result.Action, result.Unit, result.Error))
+		} else if result.Action == "reload" {
+			lines = append(lines, "Reloaded "+result.Unit)
+		} else {
+			lines = append(lines, "Restarted "+result.Unit)
+		}
+	}
+	return lines
+}
+
+// writeResultLines answers with the lines of a summary as plain text
+func writeResultLines(w http.ResponseWriter, lines []string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(strings.Join(lines, "\n")))
+}
+
+func SetEnvPasswordHandler(nm networkmanager.NetworkManager, sm *SessionManager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		r.ParseForm()
 		password := r.Form.Get("new_password")
@@ -325,11 +478,18 @@ func SetEnvPasswordHandler(nm networkmanager.NetworkManager) http.HandlerFunc {
 			return
 		}
 
+		// Existing sessions were unlocked with the old password, keep only the caller unlocked
+		sm.LockEnvAll()
+		if err := sm.UnlockEnv(w, r); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
 		w.WriteHeader(http.StatusOK)
 	}
 }
 
-func RemoveEnvPasswordHandler(nm networkmanager.NetworkManager) http.HandlerFunc {
+func RemoveEnvPasswordHandler(nm networkmanager.NetworkManager, sm *SessionManager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Verify current password before removing
 		r.ParseForm()
@@ -351,6 +511,7 @@ func RemoveEnvPasswordHandler(nm networkmanager.NetworkManager) http.HandlerFunc
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		sm.LockEnvAll()
 
 		w.WriteHeader(http.StatusOK)
 	}
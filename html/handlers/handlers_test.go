@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ztkent/pifi/networkmanager"
+)
+
+// statusNM has a schema requiring APP_TOKEN, which isn't set
+type statusNM struct {
+	envPasswordNM
+}
+
+func (statusNM) GetNetworkStatus() (networkmanager.NetworkStatus, error) {
+	return networkmanager.NetworkStatus{}, nil
+}
+
+func (statusNM) GetEnvironmentSchema() (*networkmanager.EnvSchema, error) {
+	return &networkmanager.EnvSchema{Variables: []networkmanager.EnvSchemaVar{{Key: "APP_TOKEN", Required: true}}}, nil
+}
+
+func (statusNM) GetEnvironmentVariables() (map[string]string, error) {
+	return map[string]string{}, nil
+}
+
+func TestStatusHidesMissingEnv(t *testing.T) {
+	users := NewUserStore(newTestState(t))
+	sm := newTestSessionManager(t)
+	status := func(nm statusNM, r *http.Request) bool {
+		w := httptest.NewRecorder()
+		StatusHandler(nm, users, sm, "", true)(w, r)
+		return strings.Contains(w.Body.String(), "APP_TOKEN")
+	}
+
+	// Without accounts or an environment password everyone may open the environment page
+	if !status(statusNM{}, httptest.NewRequest("GET", "/status", nil)) {
+		t.Error("missing variable not shown without accounts")
+	}
+	locked := statusNM{envPasswordNM{set: true}}
+	if status(locked, httptest.NewRequest("GET", "/status", nil)) {
+		t.Error("missing variable shown to a session without the environment password")
+	}
+
+	sessions := map[string]*httptest.ResponseRecorder{}
+	for _, u := range []struct{ name, role string }{{"admin", RoleAdmin}, {"viewer", RoleViewer}} {
+		if err := users.Save(u.name, u.name+"-password", u.role); err != nil {
+			t.Fatal(err)
+		}
+		sessions[u.name] = httptest.NewRecorder()
+		if err := sm.Create(sessions[u.name], httptest.NewRequest("POST", "/login", nil), u.name); err != nil {
+			t.Fatal(err)
+		}
+		if err := sm.UnlockEnv(httptest.NewRecorder(), withCookies(sessions[u.name], "POST", "/env/login")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !status(locked, withCookies(sessions["admin"], "GET", "/status")) {
+		t.Error("missing variable not shown to an admin who unlocked the environment")
+	}
+	if status(statusNM{}, withCookies(sessions["viewer"], "GET", "/status")) {
+		t.Error("missing variable shown to a viewer")
+	}
+	if status(statusNM{}, httptest.NewRequest("GET", "/status", nil)) {
+		t.Error("missing variable shown without signing in")
+	}
+}
@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMaxLoginFailures = 5
+	DefaultLoginLockout     = 15 * time.Minute
+
+	// Delay after the first failure, doubled for each consecutive failure
+	loginBaseBackoff = time.Second
+	// Failures are forgotten after this long without another attempt
+	loginFailureWindow = time.Hour
+	// Failed attempts allowed across all clients per globalLoginWindow, successful ones don't count
+	// so a single client signing in repeatedly can't lock everyone out
+	globalLoginLimit  = 30
+	globalLoginWindow = time.Minute
+)
+
+// LoginLimiter throttles password-checking endpoints.
+// Each client backs off exponentially after a failed attempt and is locked out after repeated failures,
+// and a global limit caps failed attempts across all clients.
+type LoginLimiter struct {
+	mu          sync.Mutex
+	clients     map[string]*loginAttempts
+	recent      []time.Time // Failed attempts of all clients within globalLoginWindow
+	maxFailures int
+	lockout     time.Duration
+}
+
+type loginAttempts struct {
+	failures     int
+	lastAttempt  time.Time
+	blockedUntil time.Time
+}
+
+// NewLoginLimiter locks a client out for lockout after maxFailures consecutive failed attempts
+func NewLoginLimiter(maxFailures int, lockout time.Duration) *LoginLimiter {
+	return &LoginLimiter{
+		clients:     make(map[string]*loginAttempts),
+		maxFailures: maxFailures,
+		lockout:     lockout,
+	}
+}
+
+// Limit wraps a handler that answers failed password checks with 401 Unauthorized.
+// Requests from blocked clients are rejected with 429 Too Many Requests and a Retry-After header.
+func (l *LoginLimiter) Limit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client := clientIP(r)
+
+		if wait := l.allow(client); wait > 0 {
+			retryAfter := int((wait + time.Second - 1) / time.Second)
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			http.Error(w, "Too many attempts, try again later", http.StatusTooManyRequests)
+			return
+		}
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+
+		switch {
+		case rec.status == http.StatusUnauthorized:
+			l.recordFailure(client, r.URL.Path)
+		case rec.status < http.StatusBadRequest:
+			l.recordSuccess(client)
+		}
+	}
+}
+
+// allow returns how long the client must wait before its next attempt, or zero if it may proceed
+func (l *LoginLimiter) allow(client string) time.Duration {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if a, ok := l.clients[client]; ok && now.Before(a.blockedUntil) {
+		return a.blockedUntil.Sub(now)
+	}
+
+	l.pruneRecentLocked(now)
+	if len(l.recent) >= globalLoginLimit {
+		return l.recent[0].Add(globalLoginWindow).Sub(now)
+	}
+	return 0
+}
+
+// pruneRecentLocked drops failed attempts that have left the global window
+func (l *LoginLimiter) pruneRecentLocked(now time.Time) {
+	cutoff := now.Add(-globalLoginWindow)
+	kept := l.recent[:0]
+	for _, t := range l.recent {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	l.recent = kept
+}
+
+func (l *LoginLimiter) recordFailure(client, path string) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.pruneLocked(now)
+	l.pruneRecentLocked(now)
+	l.recent = append(l.recent, now)
+
+	a, ok := l.clients[client]
+	if !ok {
+		a = &loginAttempts{}
+		l.clients[client] = a
+	}
+	a.failures++
+	a.lastAttempt = now
+
+	if a.failures >= l.maxFailures {
+		a.blockedUntil = now.Add(l.lockout)
+		log.Printf("Failed password attempt %d from %s on %s, locked out for %v", a.failures, client, path, l.lockout)
+		return
+	}
+
+	backoff := loginBaseBackoff << (a.failures - 1)
+	a.blockedUntil = now.Add(backoff)
+	log.Printf("Failed password attempt %d from %s on %s, next attempt allowed in %v", a.failures, client, path, backoff)
+}
+
+func (l *LoginLimiter) recordSuccess(client string) {
+	l.mu.Lock()
+	delete(l.clients, client)
+	l.mu.Unlock()
+}
+
+func (l *LoginLimiter) pruneLocked(now time.Time) {
+	for client, a := range l.clients {
+		if now.After(a.blockedUntil) && now.Sub(a.lastAttempt) > loginFailureWindow {
+			delete(l.clients, client)
+		}
+	}
+}
+
+// clientIP returns the remote address of the request without its port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLoginLimiterLockout(t *testing.T) {
+	l := NewLoginLimiter(3, time.Hour)
+	password := "right"
+	handler := l.Limit(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("password") != password {
+			http.Error(w, "Invalid password", http.StatusUnauthorized)
+		}
+	})
+	attempt := func(client, password string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/env/login?password="+password, nil)
+		r.RemoteAddr = client + ":1234"
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+	// Skips the backoff between failures, leaving a lockout in place
+	skipBackoff := func(client string) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if a := l.clients[client]; a.failures < l.maxFailures {
+			a.blockedUntil = time.Time{}
+		}
+	}
+
+	if w := attempt("192.0.2.1", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("first failure = %d, want 401", w.Code)
+	}
+	if w := attempt("192.0.2.1", "right"); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("attempt during backoff = %d, Retry-After %q, want 429 with Retry-After", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	skipBackoff("192.0.2.1")
+	attempt("192.0.2.1", "wrong")
+	skipBackoff("192.0.2.1")
+	if w := attempt("192.0.2.1", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("third failure = %d, want 401", w.Code)
+	}
+	skipBackoff("192.0.2.1")
+	if w := attempt("192.0.2.1", "right"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("right password while locked out = %d, want 429", w.Code)
+	}
+	if w := attempt("192.0.2.2", "right"); w.Code != http.StatusOK {
+		t.Errorf("other client = %d, want 200", w.Code)
+	}
+}
+
+func TestLoginLimiterGlobalLimit(t *testing.T) {
+	l := NewLoginLimiter(DefaultMaxLoginFailures, DefaultLoginLockout)
+	status := http.StatusOK
+	handler := l.Limit(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	})
+	attempt := func(client string) int {
+		r := httptest.NewRequest("POST", "/login", nil)
+		r.RemoteAddr = client + ":1234"
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Code
+	}
+
+	// Successful sign ins don't use up the global limit
+	for i := 0; i < 2*globalLoginLimit; i++ {
+		if code := attempt("192.0.2.1"); code != http.StatusOK {
+			t.Fatalf("successful attempt %d = %d, want 200", i, code)
+		}
+	}
+
+	// Failures spread over many clients do
+	status = http.StatusUnauthorized
+	for i := 0; i < globalLoginLimit; i++ {
+		if code := attempt(fmt.Sprintf("198.51.100.%d", i)); code != http.StatusUnauthorized {
+			t.Fatalf("failure %d = %d, want 401", i, code)
+		}
+	}
+	status = http.StatusOK
+	if code := attempt("192.0.2.1"); code != http.StatusTooManyRequests {
+		t.Errorf("attempt after %d failures = %d, want 429", globalLoginLimit, code)
+	}
+}
@@ -0,0 +1,352 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ztkent/pifi/networkmanager"
+)
+
+const (
+	sessionCookieName = "pifi_session"
+
+	DefaultSessionTTL         = 12 * time.Hour
+	DefaultSessionIdleTimeout = 30 * time.Minute
+)
+
+// SessionManager issues and validates signed session cookies.
+// A session belongs to a signed-in user, has unlocked the environment page, or both.
+// Sessions are kept in memory, so restarting the service logs everyone out.
+type SessionManager struct {
+	mu          sync.Mutex
+	key         []byte
+	sessions    map[string]*session
+	ttl         time.Duration
+	idleTimeout time.Duration
+}
+
+type session struct {
+	expires     time.Time
+	lastSeen    time.Time
+	user        string
+	envUnlocked bool
+	stash       map[string]stashed
+}
+
+// stashed is a value kept in a session between two requests
+type stashed struct {
+	value   any
+	expires time.Time
+}
+
+// NewSessionManager creates a session manager with a random signing key.
+// Sessions expire after ttl, or after idleTimeout without a request.
+func NewSessionManager(ttl, idleTimeout time.Duration) (*SessionManager, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate session key: %v", err)
+	}
+	return &SessionManager{
+		key:         key,
+		sessions:    make(map[string]*session),
+		ttl:         ttl,
+		idleTimeout: idleTimeout,
+	}, nil
+}
+
+// Create starts a new session for user, which may be empty, and sets the session cookie on the response.
+// Any existing session on the request is replaced. Its environment access is only kept if it
+// belongs to the same user, another user has to enter the environment password again.
+func (sm *SessionManager) Create(w http.ResponseWriter, r *http.Request, user string) error {
+	s := &session{user: user}
+	sm.mu.Lock()
+	if old, ok := sm.lookupLocked(r); ok {
+		s.envUnlocked = old.envUnlocked && old.user == user
+		if id, ok := sm.sessionID(r); ok {
+			delete(sm.sessions, id)
+		}
+	}
+	sm.mu.Unlock()
+	return sm.create(w, r, s)
+}
+
+func (sm *SessionManager) create(w http.ResponseWriter, r *http.Request, s *session) error {
+	idBytes := make([]byte, 24)
+	if _, err := rand.Read(idBytes); err != nil {
+		return fmt.Errorf("failed to generate session id: %v", err)
+	}
+	id := base64.RawURLEncoding.EncodeToString(idBytes)
+
+	now := time.Now()
+	expires := now.Add(sm.ttl)
+
+	s.expires = expires
+	s.lastSeen = now
+	sm.mu.Lock()
+	sm.pruneLocked(now)
+	sm.sessions[id] = s
+	sm.mu.Unlock()
+
+	payload := id + "." + strconv.FormatInt(expires.Unix(), 10)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    payload + "." + sm.sign(payload),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return nil
+}
+
+// Valid reports whether the request carries a live session, and refreshes its idle timer
+func (sm *SessionManager) Valid(r *http.Request) bool {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	_, ok := sm.lookupLocked(r)
+	return ok
+}
+
+// User returns the signed-in user of the request's session
+func (sm *SessionManager) User(r *http.Request) (string, bool) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	s, ok := sm.lookupLocked(r)
+	if !ok || s.user == "" {
+		return "", false
+	}
+	return s.user, true
+}
+
+// EnvUnlocked reports whether the request's session has entered the environment password
+func (sm *SessionManager) EnvUnlocked(r *http.Request) bool {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	s, ok := sm.lookupLocked(r)
+	return ok && s.envUnlocked
+}
+
+// UnlockEnv marks the request's session as having entered the environment password,
+// starting a new session if there is none
+func (sm *SessionManager) UnlockEnv(w http.ResponseWriter, r *http.Request) error {
+	sm.mu.Lock()
+	if s, ok := sm.lookupLocked(r); ok {
+		s.envUnlocked = true
+		sm.mu.Unlock()
+		return nil
+	}
+	sm.mu.Unlock()
+	return sm.create(w, r, &session{envUnlocked: true})
+}
+
+// Stash keeps value in the request's session for ttl, starting a new session if there is none.
+// It returns the id to take the value back with, so the value itself never goes to the browser.
+func (sm *SessionManager) Stash(w http.ResponseWriter, r *http.Request, value any, ttl time.Duration) (string, error) {
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", fmt.Errorf("failed to generate id: %v", err)
+	}
+	id := base64.RawURLEncoding.EncodeToString(idBytes)
+	now := time.Now()
+
+	sm.mu.Lock()
+	s, ok := sm.lookupLocked(r)
+	if ok {
+		for key, v := range s.stash {
+			if now.After(v.expires) {
+				delete(s.stash, key)
+			}
+		}
+		if s.stash == nil {
+			s.stash = map[string]stashed{}
+		}
+		s.stash[id] = stashed{value: value, expires: now.Add(ttl)}
+		sm.mu.Unlock()
+		return id, nil
+	}
+	sm.mu.Unlock()
+	s = &session{stash: map[string]stashed{id: {value: value, expires: now.Add(ttl)}}}
+	return id, sm.create(w, r, s)
+}
+
+// Unstash removes and returns a value stashed in the request's session, false if it is missing or expired
+func (sm *SessionManager) Unstash(r *http.Request, id string) (any, bool) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	s, ok := sm.lookupLocked(r)
+	if !ok {
+		return nil, false
+	}
+	v, ok := s.stash[id]
+	delete(s.stash, id)
+	if !ok || time.Now().After(v.expires) {
+		return nil, false
+	}
+	return v.value, true
+}
+
+// LockEnv removes environment access from the request's session, leaving any user signed in
+func (sm *SessionManager) LockEnv(r *http.Request) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if s, ok := sm.lookupLocked(r); ok {
+		s.envUnlocked = false
+	}
+}
+
+// LockEnvAll removes environment access from every session, e.g. after the password changes
+func (sm *SessionManager) LockEnvAll() {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	for _, s := range sm.sessions {
+		s.envUnlocked = false
+	}
+}
+
+// DestroyUser ends every session belonging to user
+func (sm *SessionManager) DestroyUser(user string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	for id, s := range sm.sessions {
+		if s.user == user {
+			delete(sm.sessions, id)
+		}
+	}
+}
+
+// lookupLocked returns the live session for the request and refreshes its idle timer
+func (sm *SessionManager) lookupLocked(r *http.Request) (*session, bool) {
+	id, ok := sm.sessionID(r)
+	if !ok {
+		return nil, false
+	}
+
+	now := time.Now()
+	s, exists := sm.sessions[id]
+	if !exists {
+		return nil, false
+	}
+	if now.After(s.expires) || now.Sub(s.lastSeen) > sm.idleTimeout {
+		delete(sm.sessions, id)
+		return nil, false
+	}
+	s.lastSeen = now
+	return s, true
+}
+
+// Destroy ends the session on the request, if any, and clears the cookie
+func (sm *SessionManager) Destroy(w http.ResponseWriter, r *http.Request) {
+	if id, ok := sm.sessionID(r); ok {
+		sm.mu.Lock()
+		delete(sm.sessions, id)
+		sm.mu.Unlock()
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// sessionID verifies the cookie signature and expiry, returning the session id
+func (sm *SessionManager) sessionID(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return "", false
+	}
+
+	parts := strings.Split(cookie.Value, ".")
+	if len(parts) != 3 {
+		return "", false
+	}
+	payload := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(sm.sign(payload))) {
+		return "", false
+	}
+
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return "", false
+	}
+	return parts[0], true
+}
+
+func (sm *SessionManager) sign(payload string) string {
+	mac := hmac.New(sha256.New, sm.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (sm *SessionManager) pruneLocked(now time.Time) {
+	for id, s := range sm.sessions {
+		if now.After(s.expires) || now.Sub(s.lastSeen) > sm.idleTimeout {
+			delete(sm.sessions, id)
+		}
+	}
+}
+
+// RequireEnvSession protects a handler with the environment password.
+// Requests pass through when no password is set, or when they carry a valid session.
+func RequireEnvSession(nm networkmanager.NetworkManager, sm *SessionManager) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			passwordSet, err := nm.IsEnvPasswordSet()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if passwordSet && !sm.EnvUnlocked(r) {
+				http.Error(w, "Authentication required", http.StatusUnauthorized)
+				return
+			}
+			next(w, r)
+		}
+	}
+}
+
+// EnvLoginHandler validates the environment password and starts a session
+func EnvLoginHandler(nm networkmanager.NetworkManager, sm *SessionManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		password := r.Form.Get("password")
+		if password == "" {
+			http.Error(w, "Password required", http.StatusBadRequest)
+			return
+		}
+
+		valid, err := nm.ValidateEnvPassword(password)
+		if err != nil || !valid {
+			http.Error(w, "Invalid password", http.StatusUnauthorized)
+			return
+		}
+
+		if err := sm.UnlockEnv(w, r); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("HX-Trigger", "sessionchange")
+		renderEnvironment(w, nm, true)
+	}
+}
+
+// EnvLogoutHandler locks the environment page again and shows the login prompt
+func EnvLogoutHandler(nm networkmanager.NetworkManager, sm *SessionManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sm.LockEnv(r)
+		w.Header().Set("HX-Trigger", "sessionchange")
+		renderEnvironment(w, nm, false)
+	}
+}
@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ztkent/pifi/networkmanager"
+)
+
+func newTestSessionManager(t *testing.T) *SessionManager {
+	t.Helper()
+	sm, err := NewSessionManager(DefaultSessionTTL, DefaultSessionIdleTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sm
+}
+
+// withCookies returns a request carrying the cookies set on w
+func withCookies(w *httptest.ResponseRecorder, method, target string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+// sessionCookie returns the session cookie set on w
+func sessionCookie(t *testing.T, w *httptest.ResponseRecorder) *http.Cookie {
+	t.Helper()
+	for _, c := range w.Result().Cookies() {
+		if c.Name == sessionCookieName {
+			return c
+		}
+	}
+	t.Fatal("no session cookie set")
+	return nil
+}
+
+func TestSessionCookie(t *testing.T) {
+	sm := newTestSessionManager(t)
+	w := httptest.NewRecorder()
+	if err := sm.Create(w, httptest.NewRequest("POST", "/login", nil), "alice"); err != nil {
+		t.Fatal(err)
+	}
+	cookie := sessionCookie(t, w)
+	if !cookie.HttpOnly || cookie.SameSite != http.SameSiteStrictMode {
+		t.Errorf("cookie = %+v, want HttpOnly and SameSite=Strict", cookie)
+	}
+	if user, ok := sm.User(withCookies(w, "GET", "/")); !ok || user != "alice" {
+		t.Errorf("User = %q, %v, want alice", user, ok)
+	}
+
+	id, rest, _ := strings.Cut(cookie.Value, ".")
+	expires, signature, _ := strings.Cut(rest, ".")
+	past := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+	for name, value := range map[string]string{
+		"tampered signature": id + "." + expires + "." + strings.Repeat("A", len(signature)),
+		"tampered id":        "x" + id[1:] + "." + expires + "." + signature,
+		"extended expiry":    id + "." + strconv.FormatInt(time.Now().Add(time.Hour*48).Unix(), 10) + "." + signature,
+		"expired":            id + "." + past + "." + sm.sign(id+"."+past),
+		"missing signature":  id + "." + expires,
+		"unknown session":    "unknown." + expires + "." + sm.sign("unknown."+expires),
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: value})
+		if sm.Valid(r) {
+			t.Errorf("%s: session accepted", name)
+		}
+	}
+
+	// Another manager, e.g. after a restart, doesn't know the session
+	if newTestSessionManager(t).Valid(withCookies(w, "GET", "/")) {
+		t.Error("session accepted by another session manager")
+	}
+}
+
+func TestSessionIdleTimeout(t *testing.T) {
+	sm, err := NewSessionManager(time.Hour, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	if err := sm.Create(w, httptest.NewRequest("POST", "/login", nil), "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if !sm.Valid(withCookies(w, "GET", "/")) {
+		t.Fatal("new session not valid")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if sm.Valid(withCookies(w, "GET", "/")) {
+		t.Error("idle session still valid")
+	}
+}
+
+// envPasswordNM reports whether an environment password is set, other methods aren't implemented
+type envPasswordNM struct {
+	networkmanager.NetworkManager
+	set bool
+	err error
+}
+
+func (nm envPasswordNM) IsEnvPasswordSet() (bool, error) { return nm.set, nm.err }
+
+func TestRequireEnvSession(t *testing.T) {
+	sm := newTestSessionManager(t)
+	unlocked := httptest.NewRecorder()
+	if err := sm.UnlockEnv(unlocked, httptest.NewRequest("POST", "/env/login", nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		nm   envPasswordNM
+		r    *http.Request
+		want int
+	}{
+		{"no password", envPasswordNM{}, httptest.NewRequest("GET", "/env", nil), http.StatusOK},
+		{"locked", envPasswordNM{set: true}, httptest.NewRequest("GET", "/env", nil), http.StatusUnauthorized},
+		{"unlocked", envPasswordNM{set: true}, withCookies(unlocked, "GET", "/env"), http.StatusOK},
+		{"unreadable state", envPasswordNM{err: errors.New("corrupt state file")}, httptest.NewRequest("GET", "/env", nil), http.StatusInternalServerError},
+	} {
+		w := httptest.NewRecorder()
+		RequireEnvSession(tc.nm, sm)(func(http.ResponseWriter, *http.Request) {})(w, tc.r)
+		if w.Code != tc.want {
+			t.Errorf("%s: status = %d, want %d", tc.name, w.Code, tc.want)
+		}
+	}
+}
+func TestSessionEnvUnlock(t *testing.T) {
+	sm := newTestSessionManager(t)
+	w := httptest.NewRecorder()
+	if err := sm.Create(w, httptest.NewRequest("POST", "/login", nil), "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.UnlockEnv(httptest.NewRecorder(), withCookies(w, "POST", "/env/login")); err != nil {
+		t.Fatal(err)
+	}
+	if !sm.EnvUnlocked(withCookies(w, "GET", "/env")) {
+		t.Fatal("environment not unlocked")
+	}
+
+	// Signing in again as the same user keeps the environment unlocked
+	again := httptest.NewRecorder()
+	if err := sm.Create(again, withCookies(w, "POST", "/login"), "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if !sm.EnvUnlocked(withCookies(again, "GET", "/env")) {
+		t.Error("environment locked after the same user signed in again")
+	}
+	if sm.Valid(withCookies(w, "GET", "/")) {
+		t.Error("replaced session still valid")
+	}
+
+	// Another user signing in on the same browser has to unlock it themselves
+	other := httptest.NewRecorder()
+	if err := sm.Create(other, withCookies(again, "POST", "/login"), "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if sm.EnvUnlocked(withCookies(other, "GET", "/env")) {
+		t.Error("environment access carried over to another user")
+	}
+}
+
+func TestSessionStash(t *testing.T) {
+	sm := newTestSessionManager(t)
+	w := httptest.NewRecorder()
+	if err := sm.Create(w, httptest.NewRequest("POST", "/login", nil), "alice"); err != nil {
+		t.Fatal(err)
+	}
+	id, err := sm.Stash(httptest.NewRecorder(), withCookies(w, "POST", "/"), "value", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sm.Unstash(httptest.NewRequest("POST", "/", nil), id); ok {
+		t.Error("value taken without the session")
+	}
+	if v, ok := sm.Unstash(withCookies(w, "POST", "/"), id); !ok || v != "value" {
+		t.Errorf("Unstash = %v, %v, want value", v, ok)
+	}
+	if _, ok := sm.Unstash(withCookies(w, "POST", "/"), id); ok {
+		t.Error("value taken twice")
+	}
+
+	expired, err := sm.Stash(httptest.NewRecorder(), withCookies(w, "POST", "/"), "value", -time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sm.Unstash(withCookies(w, "POST", "/"), expired); ok {
+		t.Error("expired value taken")
+	}
+}
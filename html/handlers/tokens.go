@@ -0,0 +1,345 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ztkent/pifi/api"
+	"github.com/ztkent/pifi/html"
+	"github.com/ztkent/pifi/state"
+)
+
+const (
+	ScopeStatusRead     = "status:read"
+	ScopeNetworksManage = "networks:manage"
+	ScopeEnvManage      = "env:manage"
+	ScopeAdmin          = "admin"
+
+	tokenPrefix = "pifi_"
+	// Last-used times are only written to disk this often, to spare the SD card
+	tokenLastUsedInterval = time.Minute
+)
+
+// TokenScopes lists every scope that can be granted to a token
+var TokenScopes = []string{ScopeStatusRead, ScopeNetworksManage, ScopeEnvManage, ScopeAdmin}
+
+// APIToken is a stored API token. Only a hash of the secret is kept.
+type APIToken struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Hash      string     `json:"hash"`
+	Scopes    []string   `json:"scopes"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	LastUsed  *time.Time `json:"lastUsed,omitempty"`
+}
+
+// HasScope reports whether the token grants the scope. Admin tokens grant every scope.
+func (t APIToken) HasScope(scope string) bool {
+	return slices.Contains(t.Scopes, ScopeAdmin) || slices.Contains(t.Scopes, scope)
+}
+
+// Expired reports whether the token is past its expiry
+func (t APIToken) Expired() bool {
+	return t.ExpiresAt != nil && time.Now().After(*t.ExpiresAt)
+}
+
+// TokenStore persists API tokens in the state file
+type TokenStore struct {
+	mu    sync.Mutex
+	state *state.Store
+}
+
+func NewTokenStore(store *state.Store) *TokenStore {
+	return &TokenStore{state: store}
+}
+
+// Create generates a new token. The returned secret is shown once and cannot be recovered.
+// A zero ttl creates a token that never expires.
+func (s *TokenStore) Create(name string, scopes []string, ttl time.Duration) (string, APIToken, error) {
+	if name == "" {
+		return "", APIToken{}, fmt.Errorf("token name cannot be empty")
+	}
+	if len(scopes) == 0 {
+		return "", APIToken{}, fmt.Errorf("token must have at least one scope")
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(TokenScopes, scope) {
+			return "", APIToken{}, fmt.Errorf("unknown scope: %s", scope)
+		}
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		return "", APIToken{}, err
+	}
+	secret, err := randomHex(24)
+	if err != nil {
+		return "", APIToken{}, err
+	}
+
+	token := APIToken{
+		ID:        id,
+		Name:      name,
+		Hash:      hashToken(secret),
+		Scopes:    scopes,
+		CreatedAt: time.Now(),
+	}
+	if ttl > 0 {
+		expires := token.CreatedAt.Add(ttl)
+		token.ExpiresAt = &expires
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tokens, err := s.load()
+	if err != nil {
+		return "", APIToken{}, err
+	}
+	tokens = append(tokens, token)
+	if err := s.save(tokens); err != nil {
+		return "", APIToken{}, err
+	}
+	return tokenPrefix + id + "_" + secret, token, nil
+}
+
+// List returns all stored tokens
+func (s *TokenStore) List() ([]APIToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.load()
+}
+
+// Revoke deletes the token with the given id
+func (s *TokenStore) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tokens, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	kept := slices.DeleteFunc(tokens, func(t APIToken) bool { return t.ID == id })
+	if len(kept) == len(tokens) {
+		return fmt.Errorf("token %s not found", id)
+	}
+	return s.save(kept)
+}
+
+// Enabled reports whether any tokens exist. The API is open until the first token is created.
+// It fails if the state can't be read, callers must not fall back to an open API then.
+func (s *TokenStore) Enabled() (bool, error) {
+	tokens, err := s.List()
+	if err != nil {
+		return false, err
+	}
+	return len(tokens) > 0, nil
+}
+
+// Authenticate returns the token matching the bearer value and records its use
+func (s *TokenStore) Authenticate(bearer string) (APIToken, error) {
+	id, secret, ok := strings.Cut(strings.TrimPrefix(bearer, tokenPrefix), "_")
+	if !ok || !strings.HasPrefix(bearer, tokenPrefix) {
+		return APIToken{}, fmt.Errorf("malformed token")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tokens, err := s.load()
+	if err != nil {
+		return APIToken{}, err
+	}
+
+	for i, t := range tokens {
+		if t.ID != id {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hashToken(secret))) != 1 {
+			break
+		}
+		if t.Expired() {
+			return APIToken{}, fmt.Errorf("token expired")
+		}
+
+		now := time.Now()
+		if t.LastUsed == nil || now.Sub(*t.LastUsed) > tokenLastUsedInterval {
+			tokens[i].LastUsed = &now
+			if err := s.save(tokens); err != nil {
+				return APIToken{}, err
+			}
+		}
+		return tokens[i], nil
+	}
+	return APIToken{}, fmt.Errorf("invalid token")
+}
+
+func (s *TokenStore) load() ([]APIToken, error) {
+	tokens := []APIToken{}
+	if err := s.state.Get(state.SectionAPITokens, &tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (s *TokenStore) save(tokens []APIToken) error {
+	return s.state.Update(func(tx *state.Tx) error {
+		return tx.Set(state.SectionAPITokens, tokens)
+	})
+}
+
+func hashToken(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate token: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// RequireToken protects an API handler with a bearer token holding the given scope.
+// Requests pass through while no tokens or user accounts have been created.
+func RequireToken(tokens *TokenStore, users *UserStore, scope string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			bearer, hasBearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !hasBearer {
+				open, err := apiOpen(tokens, users)
+				if err != nil {
+					WriteAPIError(w, http.StatusInternalServerError, api.CodeOperationFailed, err.Error())
+					return
+				}
+				if open {
+					next(w, r)
+					return
+				}
+				w.Header().Set("WWW-Authenticate", `Bearer realm="pifi"`)
+				WriteAPIError(w, http.StatusUnauthorized, api.CodeUnauthorized, "Bearer token required")
+				return
+			}
+
+			token, err := tokens.Authenticate(strings.TrimSpace(bearer))
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="pifi", error="invalid_token"`)
+				WriteAPIError(w, http.StatusUnauthorized, api.CodeInvalidToken, err.Error())
+				return
+			}
+			if !token.HasScope(scope) {
+				WriteAPIError(w, http.StatusForbidden, api.CodeInsufficientScope, "Token lacks scope "+scope)
+				return
+			}
+			next(w, r.WithContext(context.WithValue(r.Context(), tokenKey{}, token)))
+		}
+	}
+}
+
+// apiOpen reports whether the API is open, because neither tokens nor user accounts exist
+func apiOpen(tokens *TokenStore, users *UserStore) (bool, error) {
+	tokensEnabled, err := tokens.Enabled()
+	if err != nil {
+		return false, err
+	}
+	usersEnabled, err := users.Enabled()
+	if err != nil {
+		return false, err
+	}
+	return !tokensEnabled && !usersEnabled, nil
+}
+
+type tokenKey struct{}
+
+// requestToken returns the API token the request was authenticated with, if any
+func requestToken(r *http.Request) (APIToken, bool) {
+	token, ok := r.Context().Value(tokenKey{}).(APIToken)
+	return token, ok
+}
+
+type TokensResponse struct {
+	Tokens    []APIToken
+	Scopes    []string
+	NewSecret string
+	NewName   string
+	Timestamp time.Time
+}
+
+// TokensHandler renders the API token management card
+func TokensHandler(tokens *TokenStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		renderTokens(w, tokens, "", "")
+	}
+}
+
+// CreateTokenHandler creates a token from the form and shows its secret once
+func CreateTokenHandler(tokens *TokenStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		name := strings.TrimSpace(r.Form.Get("name"))
+
+		var ttl time.Duration
+		if days := r.Form.Get("expires_days"); days != "" && days != "0" {
+			var n int
+			if _, err := fmt.Sscanf(days, "%d", &n); err != nil || n < 0 {
+				http.Error(w, "Invalid expiry", http.StatusBadRequest)
+				return
+			}
+			ttl = time.Duration(n) * 24 * time.Hour
+		}
+
+		secret, _, err := tokens.Create(name, r.Form["scopes"], ttl)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		renderTokens(w, tokens, secret, name)
+	}
+}
+
+// RevokeTokenHandler deletes a token
+func RevokeTokenHandler(tokens *TokenStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if err := tokens.Revoke(r.Form.Get("id")); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		renderTokens(w, tokens, "", "")
+	}
+}
+
+func renderTokens(w http.ResponseWriter, tokens *TokenStore, newSecret, newName string) {
+	list, err := tokens.List()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tmpl, err := template.ParseFS(html.Templates, "templates/tokens.gohtml")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = tmpl.Execute(w, TokensResponse{
+		Tokens:    list,
+		Scopes:    TokenScopes,
+		NewSecret: newSecret,
+		NewName:   newName,
+		Timestamp: time.Now(),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ztkent/pifi/state"
+)
+
+// newTestState returns a state store in a temp dir, without legacy files
+func newTestState(t *testing.T) *state.Store {
+	t.Helper()
+	return state.New(filepath.Join(t.TempDir(), "state.json"), state.Legacy{})
+}
+
+func TestRequireToken(t *testing.T) {
+	store := newTestState(t)
+	tokens := NewTokenStore(store)
+	users := NewUserStore(store)
+	protected := func(scope string) http.HandlerFunc {
+		return RequireToken(tokens, users, scope)(func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := requestToken(r); !ok && r.Header.Get("Authorization") != "" {
+				t.Error("authenticated request has no token in its context")
+			}
+		})
+	}
+	call := func(scope, bearer string) int {
+		r := httptest.NewRequest("POST", "/api/v1/networks", nil)
+		if bearer != "" {
+			r.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		w := httptest.NewRecorder()
+		protected(scope)(w, r)
+		return w.Code
+	}
+
+	if code := call(ScopeNetworksManage, ""); code != http.StatusOK {
+		t.Errorf("without tokens = %d, want the API open", code)
+	}
+
+	status, _, err := tokens.Create("monitoring", []string{ScopeStatusRead}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, _, err := tokens.Create("automation", []string{ScopeAdmin}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, _, err := tokens.Create("old", []string{ScopeAdmin}, time.Nanosecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+
+	for _, tc := range []struct {
+		name, scope, bearer string
+		want                int
+	}{
+		{"no token", ScopeStatusRead, "", http.StatusUnauthorized},
+		{"granted scope", ScopeStatusRead, status, http.StatusOK},
+		{"missing scope", ScopeNetworksManage, status, http.StatusForbidden},
+		{"missing admin scope", ScopeAdmin, status, http.StatusForbidden},
+		{"admin grants every scope", ScopeEnvManage, admin, http.StatusOK},
+		{"expired", ScopeStatusRead, expired, http.StatusUnauthorized},
+		{"wrong secret", ScopeStatusRead, status[:len(status)-4] + "0000", http.StatusUnauthorized},
+		{"malformed", ScopeStatusRead, "not-a-token", http.StatusUnauthorized},
+	} {
+		if code := call(tc.scope, tc.bearer); code != tc.want {
+			t.Errorf("%s: status = %d, want %d", tc.name, code, tc.want)
+		}
+	}
+
+	// A state file that can't be read doesn't open the API
+	if err := os.WriteFile(store.Path(), []byte("{not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if code := call(ScopeStatusRead, ""); code != http.StatusInternalServerError {
+		t.Errorf("with a corrupt state file = %d, want 500", code)
+	}
+}
@@ -0,0 +1,404 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ztkent/pifi/html"
+	"github.com/ztkent/pifi/networkmanager"
+	"github.com/ztkent/pifi/state"
+)
+
+const (
+	// Viewers see status, operators also manage networks, admins manage everything
+	RoleViewer   = "viewer"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+// Roles lists every role from least to most privileged
+var Roles = []string{RoleViewer, RoleOperator, RoleAdmin}
+
+// User is a local PiFi account
+type User struct {
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"passwordHash"`
+	Role         string    `json:"role"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// HasRole reports whether the user's role is at least as privileged as role
+func (u User) HasRole(role string) bool {
+	return slices.Index(Roles, u.Role) >= slices.Index(Roles, role)
+}
+
+// UserStore persists user accounts in the state file
+type UserStore struct {
+	mu    sync.Mutex
+	state *state.Store
+}
+
+func NewUserStore(store *state.Store) *UserStore {
+	return &UserStore{state: store}
+}
+
+// Enabled reports whether any accounts exist. Without accounts the UI needs no sign in.
+// It fails if the state can't be read, callers must not fall back to an open UI then.
+func (s *UserStore) Enabled() (bool, error) {
+	users, err := s.List()
+	if err != nil {
+		return false, err
+	}
+	return len(users) > 0, nil
+}
+
+// List returns all accounts
+func (s *UserStore) List() ([]User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.load()
+}
+
+// Get returns the account with the given username
+func (s *UserStore) Get(username string) (User, error) {
+	users, err := s.List()
+	if err != nil {
+		return User{}, err
+	}
+	for _, u := range users {
+		if u.Username == username {
+			return u, nil
+		}
+	}
+	return User{}, fmt.Errorf("user %s not found", username)
+}
+
+// Save creates an account or updates an existing one.
+// An empty password keeps the existing password of an account.
+func (s *UserStore) Save(username, password, role string) error {
+	if username == "" || strings.ContainsAny(username, " \t\n") {
+		return fmt.Errorf("invalid username")
+	}
+	if !slices.Contains(Roles, role) {
+		return fmt.Errorf("unknown role: %s", role)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	users, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	idx := slices.IndexFunc(users, func(u User) bool { return u.Username == username })
+	if idx < 0 {
+		if password == "" {
+			return fmt.Errorf("password cannot be empty")
+		}
+		if len(users) == 0 && role != RoleAdmin {
+			return fmt.Errorf("the first account must be an admin")
+		}
+		users = append(users, User{Username: username, Role: role, CreatedAt: time.Now()})
+		idx = len(users) - 1
+	} else if users[idx].Role == RoleAdmin && role != RoleAdmin && countAdmins(users) == 1 {
+		return fmt.Errorf("cannot demote the last admin")
+	}
+
+	users[idx].Role = role
+	if password != "" {
+		hash, err := networkmanager.HashPassword(password)
+		if err != nil {
+			return fmt.Errorf("failed to hash password: %v", err)
+		}
+		users[idx].PasswordHash = hash
+	}
+	return s.save(users)
+}
+
+// Delete removes an account. The last admin cannot be removed while other accounts exist.
+func (s *UserStore) Delete(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	users, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	idx := slices.IndexFunc(users, func(u User) bool { return u.Username == username })
+	if idx < 0 {
+		return fmt.Errorf("user %s not found", username)
+	}
+	if users[idx].Role == RoleAdmin && countAdmins(users) == 1 && len(users) > 1 {
+		return fmt.Errorf("cannot delete the last admin")
+	}
+	return s.save(slices.Delete(users, idx, idx+1))
+}
+
+// Authenticate checks the username and password, upgrading outdated password hashes
+func (s *UserStore) Authenticate(username, password string) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	users, err := s.load()
+	if err != nil {
+		return User{}, err
+	}
+
+	idx := slices.IndexFunc(users, func(u User) bool { return u.Username == username })
+	if idx < 0 {
+		// Spend the same time as a real check so usernames can't be probed
+		networkmanager.VerifyPassword(password, dummyPasswordHash)
+		return User{}, fmt.Errorf("invalid username or password")
+	}
+
+	valid, needsUpgrade, err := networkmanager.VerifyPassword(password, users[idx].PasswordHash)
+	if err != nil || !valid {
+		return User{}, fmt.Errorf("invalid username or password")
+	}
+	if needsUpgrade {
+		if hash, err := networkmanager.HashPassword(password); err == nil {
+			users[idx].PasswordHash = hash
+			if err := s.save(users); err != nil {
+				log.Printf("Warning: failed to upgrade password hash for %s: %v", username, err)
+			}
+		}
+	}
+	return users[idx], nil
+}
+
+// A valid hash of a random password, used when the username doesn't exist
+const dummyPasswordHash = "$scrypt$ln=15,r=8,p=1$bbU1cWZGoLD7pYCHg6ANEg$32bRV9YV9Lx5QqcHr1MQpyCJTklgg1lRk66iwY4q5zw"
+
+func countAdmins(users []User) int {
+	n := 0
+	for _, u := range users {
+		if u.Role == RoleAdmin {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *UserStore) load() ([]User, error) {
+	users := []User{}
+	if err := s.state.Get(state.SectionUsers, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (s *UserStore) save(users []User) error {
+	return s.state.Update(func(tx *state.Tx) error {
+		return tx.Set(state.SectionUsers, users)
+	})
+}
+
+// RequireRole restricts a handler to signed-in users with at least the given role.
+// Requests pass through while no accounts exist.
+// Page loads are redirected to the login page, htmx requests are told to redirect.
+func RequireRole(users *UserStore, sm *SessionManager, role string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			enabled, err := users.Enabled()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !enabled {
+				next(w, r)
+				return
+			}
+
+			username, ok := sm.User(r)
+			if !ok {
+				if r.Method == http.MethodGet && r.Header.Get("HX-Request") == "" {
+					http.Redirect(w, r, pathFor(r, "/login"), http.StatusSeeOther)
+					return
+				}
+				w.Header().Set("HX-Redirect", pathFor(r, "/login"))
+				http.Error(w, "Sign in required", http.StatusUnauthorized)
+				return
+			}
+
+			user, err := users.Get(username)
+			if err != nil {
+				sm.Destroy(w, r)
+				http.Error(w, "Sign in required", http.StatusUnauthorized)
+				return
+			}
+			if !user.HasRole(role) {
+				http.Error(w, "Your account cannot perform this action", http.StatusForbidden)
+				return
+			}
+			next(w, r.WithContext(context.WithValue(r.Context(), userKey{}, user.Username)))
+		}
+	}
+}
+
+type userKey struct{}
+
+// requestUser returns the signed-in user who made the request, if any
+func requestUser(r *http.Request) (string, bool) {
+	username, ok := r.Context().Value(userKey{}).(string)
+	return username, ok
+}
+
+type LoginResponse struct {
+	Error     string
+	CSRFToken string
+}
+
+// LoginPageHandler renders the sign in page
+func LoginPageHandler(users *UserStore, sm *SessionManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		enabled, err := users.Enabled()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !enabled {
+			http.Redirect(w, r, pathFor(r, "/"), http.StatusSeeOther)
+			return
+		}
+		renderLogin(w, r, sm, http.StatusOK, "")
+	}
+}
+
+// LoginHandler signs a user in and redirects to the dashboard
+func LoginHandler(users *UserStore, sm *SessionManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		user, err := users.Authenticate(r.Form.Get("username"), r.Form.Get("password"))
+		if err != nil {
+			renderLogin(w, r, sm, http.StatusUnauthorized, "Invalid username or password")
+			return
+		}
+
+		if err := sm.Create(w, r, user.Username); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, pathFor(r, "/"), http.StatusSeeOther)
+	}
+}
+
+// LogoutHandler ends the session and returns to the login page
+func LogoutHandler(sm *SessionManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sm.Destroy(w, r)
+		http.Redirect(w, r, pathFor(r, "/login"), http.StatusSeeOther)
+	}
+}
+
+func renderLogin(w http.ResponseWriter, r *http.Request, sm *SessionManager, status int, message string) {
+	csrfToken, err := sm.CSRFToken(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tmpl, err := template.ParseFS(html.Templates, "templates/login.gohtml")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(status)
+	err = tmpl.Execute(w, LoginResponse{Error: message, CSRFToken: csrfToken})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+type UsersResponse struct {
+	Users       []User
+	Roles       []string
+	CurrentUser string
+	Timestamp   time.Time
+}
+
+// UsersHandler renders the account management card
+func UsersHandler(users *UserStore, sm *SessionManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		renderUsers(w, r, users, sm)
+	}
+}
+
+// SaveUserHandler creates or updates an account.
+// Creating the first account signs the caller in as that admin.
+func SaveUserHandler(users *UserStore, sm *SessionManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		username := strings.TrimSpace(r.Form.Get("username"))
+		enabled, err := users.Enabled()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		firstUser := !enabled
+
+		if err := users.Save(username, r.Form.Get("password"), r.Form.Get("role")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if firstUser {
+			if err := sm.Create(w, r, username); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			// Reload the dashboard so it picks up the signed-in account
+			w.Header().Set("HX-Refresh", "true")
+		}
+		renderUsers(w, r, users, sm)
+	}
+}
+
+// DeleteUserHandler removes an account and ends its sessions
+func DeleteUserHandler(users *UserStore, sm *SessionManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		username := r.Form.Get("username")
+		if err := users.Delete(username); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sm.DestroyUser(username)
+		current, _ := sm.User(r)
+		if enabled, err := users.Enabled(); current == "" || err != nil || !enabled {
+			w.Header().Set("HX-Refresh", "true")
+		}
+		renderUsers(w, r, users, sm)
+	}
+}
+
+func renderUsers(w http.ResponseWriter, r *http.Request, users *UserStore, sm *SessionManager) {
+	list, err := users.List()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	current, _ := sm.User(r)
+
+	tmpl, err := template.ParseFS(html.Templates, "templates/users.gohtml")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = tmpl.Execute(w, UsersResponse{
+		Users:       list,
+		Roles:       Roles,
+		CurrentUser: current,
+		Timestamp:   time.Now(),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
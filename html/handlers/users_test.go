@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestRequireRole(t *testing.T) {
+	store := newTestState(t)
+	users := NewUserStore(store)
+	sm := newTestSessionManager(t)
+	call := func(role string, r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		RequireRole(users, sm, role)(func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := requestUser(r); !ok {
+				t.Error("signed-in request has no user in its context")
+			}
+		})(w, r)
+		return w
+	}
+
+	open := httptest.NewRecorder()
+	RequireRole(users, sm, RoleAdmin)(func(http.ResponseWriter, *http.Request) {})(open, httptest.NewRequest("POST", "/users", nil))
+	if open.Code != http.StatusOK {
+		t.Errorf("without accounts = %d, want the UI open", open.Code)
+	}
+
+	if err := users.Save("admin", "admin-password", RoleViewer); err == nil {
+		t.Error("first account created without the admin role")
+	}
+	sessions := map[string]*httptest.ResponseRecorder{}
+	for _, u := range []struct{ name, role string }{{"admin", RoleAdmin}, {"operator", RoleOperator}, {"viewer", RoleViewer}} {
+		if err := users.Save(u.name, u.name+"-password", u.role); err != nil {
+			t.Fatal(err)
+		}
+		sessions[u.name] = httptest.NewRecorder()
+		if err := sm.Create(sessions[u.name], httptest.NewRequest("POST", "/login", nil), u.name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		user, role string
+		want       int
+	}{
+		{"viewer", RoleViewer, http.StatusOK},
+		{"viewer", RoleOperator, http.StatusForbidden},
+		{"viewer", RoleAdmin, http.StatusForbidden},
+		{"operator", RoleOperator, http.StatusOK},
+		{"operator", RoleAdmin, http.StatusForbidden},
+		{"admin", RoleAdmin, http.StatusOK},
+	} {
+		if w := call(tc.role, withCookies(sessions[tc.user], "POST", "/users")); w.Code != tc.want {
+			t.Errorf("%s on a %s route = %d, want %d", tc.user, tc.role, w.Code, tc.want)
+		}
+	}
+
+	// Without a session pages redirect to the login page, htmx requests are told to
+	if w := call(RoleViewer, httptest.NewRequest("GET", "/", nil)); w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/login" {
+		t.Errorf("page without session = %d to %q, want a redirect to /login", w.Code, w.Header().Get("Location"))
+	}
+	htmx := httptest.NewRequest("POST", "/network/connect", nil)
+	htmx.Header.Set("HX-Request", "true")
+	if w := call(RoleViewer, htmx); w.Code != http.StatusUnauthorized || w.Header().Get("HX-Redirect") != "/login" {
+		t.Errorf("htmx without session = %d, HX-Redirect %q, want 401 to /login", w.Code, w.Header().Get("HX-Redirect"))
+	}
+
+	// Sessions of deleted accounts stop working
+	if err := users.Delete("operator"); err != nil {
+		t.Fatal(err)
+	}
+	if w := call(RoleViewer, withCookies(sessions["operator"], "POST", "/users")); w.Code != http.StatusUnauthorized {
+		t.Errorf("deleted user = %d, want 401", w.Code)
+	}
+	if err := users.Delete("admin"); err == nil {
+		t.Error("deleted the last admin while other accounts exist")
+	}
+
+	// A state file that can't be read doesn't open the UI
+	if err := os.WriteFile(store.Path(), []byte(`{"version": 99}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if w := call(RoleViewer, httptest.NewRequest("GET", "/", nil)); w.Code != http.StatusInternalServerError {
+		t.Errorf("with a newer state file = %d, want 500", w.Code)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	users := NewUserStore(newTestState(t))
+	if err := users.Save("admin", "admin-password", RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	if user, err := users.Authenticate("admin", "admin-password"); err != nil || user.Role != RoleAdmin {
+		t.Errorf("Authenticate = %+v, %v", user, err)
+	}
+	if _, err := users.Authenticate("admin", "wrong"); err == nil {
+		t.Error("wrong password accepted")
+	}
+	if _, err := users.Authenticate("nobody", "admin-password"); err == nil {
+		t.Error("unknown user accepted")
+	}
+}
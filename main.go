@@ -2,84 +2,144 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"time"
 
-	"github.com/gorilla/mux"
-	"github.com/ztkent/pifi/html/handlers"
+	"github.com/ztkent/pifi/config"
+	"github.com/ztkent/pifi/filestore"
 	"github.com/ztkent/pifi/networkmanager"
+	"github.com/ztkent/pifi/server"
+	"github.com/ztkent/pifi/tlscert"
 )
 
 func main() {
-	nm := networkmanager.New()
-	err := nm.SetupAPConnection()
-	if err != nil {
-		log.Fatalf("Error setting up AP connection: %v", err)
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		restore(os.Args[2:])
+		return
 	}
 
-	autoAPFlag := flag.Bool("auto", true, "Enable automatic AP mode with no internet connection")
-	apTimeoutFlag := flag.Int("timeout", 30, "Offline time in seconds before re-enabling AP mode")
-	flag.Parse()
-
-	r := mux.NewRouter()
-
-	// UI routes
-	r.HandleFunc("/", handlers.PiFiHandler(nm)).Methods("GET")
-	r.HandleFunc("/status", handlers.StatusHandler(nm)).Methods("GET")
-	r.HandleFunc("/network", handlers.NetworksHandler(nm)).Methods("GET")
-	r.HandleFunc("/setmode", handlers.SetMode(nm)).Methods("POST")
+	cfg, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.File != "" {
+		log.Printf("Loaded config from %s", cfg.File)
+	}
 
-	r.HandleFunc("/add-network", handlers.ModifyNetworkHandler(nm)).Methods("POST")
-	r.HandleFunc("/remove-network", handlers.RemoveNetworkConnectionHandler(nm)).Methods("POST")
-	r.HandleFunc("/autoconnect-network", handlers.AutoConnectNetworkHandler(nm)).Methods("POST")
-	r.HandleFunc("/connect", handlers.ConnectNetworkHandler(nm)).Methods("POST")
+	var cert tls.Certificate
+	var fingerprint string
+	if cfg.TLS.Enabled {
+		cert, err = tlscert.LoadOrCreate(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		if err != nil {
+			log.Fatalf("Error loading TLS certificate: %v", err)
+		}
+		fingerprint = tlscert.Fingerprint(cert)
+		log.Printf("TLS certificate fingerprint (SHA-256): %s", fingerprint)
+	}
 
-	r.HandleFunc("/environment", handlers.EnvironmentHandler(nm)).Methods("GET", "POST")
-	r.HandleFunc("/env/set", handlers.SetEnvironmentHandler(nm)).Methods("POST")
-	r.HandleFunc("/env/unset", handlers.UnsetEnvironmentHandler(nm)).Methods("POST")
-	r.HandleFunc("/env/set-password", handlers.SetEnvPasswordHandler(nm)).Methods("POST")
-	r.HandleFunc("/env/remove-password", handlers.RemoveEnvPasswordHandler(nm)).Methods("POST")
+	// Fail here rather than on the first change if the state file can't be read or written
+	if err := cfg.State().Migrate(); err != nil {
+		log.Fatalf("Error opening state file: %v", err)
+	}
 
-	// API routes
-	r.HandleFunc("/api/status", handlers.GetNetworkStatusAPI(nm)).Methods("GET")
-	r.HandleFunc("/api/mode", handlers.SetWifiModeAPI(nm)).Methods("POST")
-	r.HandleFunc("/api/networks/available", handlers.FindAvailableNetworksAPI(nm)).Methods("GET")
-	r.HandleFunc("/api/networks/configured", handlers.GetConfiguredConnectionsAPI(nm)).Methods("GET")
-	r.HandleFunc("/api/networks/modify", handlers.ModifyNetworkConnectionAPI(nm)).Methods("POST")
-	r.HandleFunc("/api/networks/remove", handlers.RemoveNetworkConnectionAPI(nm)).Methods("DELETE")
-	r.HandleFunc("/api/networks/autoconnect", handlers.SetAutoConnectConnectionAPI(nm)).Methods("POST")
-	r.HandleFunc("/api/networks/connect", handlers.ConnectNetworkAPI(nm)).Methods("POST")
+	opts := cfg.ServerOptions()
+	opts.NetworkManager = networkmanager.NewWithOptions(cfg.NetworkManagerOptions())
+	opts.TLSFingerprint = fingerprint
+	pifi, err := server.New(opts)
+	if err != nil {
+		log.Fatalf("Error setting up server: %v", err)
+	}
+	if err := pifi.Start(context.Background()); err != nil {
+		log.Fatalf("Error starting server: %v", err)
+	}
 
 	srv := &http.Server{
-		Handler:      r,
-		Addr:         "0.0.0.0:8088",
-		WriteTimeout: 15 * time.Second,
-		ReadTimeout:  15 * time.Second,
+		Handler:      pifi,
+		Addr:         cfg.HTTP.Addr,
+		WriteTimeout: time.Duration(cfg.HTTP.WriteTimeout),
+		ReadTimeout:  time.Duration(cfg.HTTP.ReadTimeout),
 	}
 
-	if *autoAPFlag {
-		go func() {
-			nm.ManageOfflineAP(time.Duration(*apTimeoutFlag) * time.Second)
-		}()
+	var tlsSrv *http.Server
+	if cfg.TLS.Enabled {
+		tlsSrv = &http.Server{
+			Handler:      pifi,
+			Addr:         cfg.TLS.Addr,
+			WriteTimeout: time.Duration(cfg.HTTP.WriteTimeout),
+			ReadTimeout:  time.Duration(cfg.HTTP.ReadTimeout),
+			TLSConfig: &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				MinVersion:   tls.VersionTLS12,
+			},
+		}
+		if cfg.TLS.RedirectHTTP {
+			srv.Handler = redirectToHTTPS(cfg.TLS.Addr)
+		}
 	}
 
 	go func() {
 		log.Printf("Server starting on http://%s", srv.Addr)
-		if err := srv.ListenAndServe(); err != nil {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatal(err)
 		}
 	}()
 
+	if tlsSrv != nil {
+		go func() {
+			log.Printf("Server starting on https://%s", tlsSrv.Addr)
+			if err := tlsSrv.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	<-c
 
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.HTTP.ShutdownTimeout))
 	defer cancel()
 	srv.Shutdown(ctx)
+	if tlsSrv != nil {
+		tlsSrv.Shutdown(ctx)
+	}
+	pifi.Stop(ctx)
 	log.Println("PiFi Server Stopped")
 }
+
+// restore replaces each file with the backup kept by its last write, "pifi restore /etc/environment"
+func restore(files []string) {
+	if len(files) == 0 {
+		log.Fatal("usage: pifi restore <file>...")
+	}
+	for _, file := range files {
+		if err := filestore.Restore(file); err != nil {
+			log.Fatalf("Error restoring %s: %v", file, err)
+		}
+		log.Printf("Restored %s from %s", file, file+filestore.BackupSuffix)
+	}
+}
+
+// redirectToHTTPS sends every request to the same host on the HTTPS listener
+func redirectToHTTPS(tlsAddr string) http.Handler {
+	_, tlsPort, _ := net.SplitHostPort(tlsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if tlsPort != "" && tlsPort != "443" {
+			host = net.JoinHostPort(host, tlsPort)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
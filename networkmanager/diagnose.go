@@ -0,0 +1,146 @@
+package networkmanager
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Failure codes of a ConnectionError
+const (
+	FailureWrongPassword       = "wrong_password"
+	FailureInvalidPassword     = "invalid_password"
+	FailureSSIDNotFound        = "ssid_not_found"
+	FailureDHCPTimeout         = "dhcp_timeout"
+	FailureAssociationRejected = "association_rejected"
+	FailureRadioDisabled       = "radio_disabled"
+	FailureNMNotRunning        = "networkmanager_not_running"
+	FailureNotSaved            = "network_not_saved"
+	FailureUnknown             = "connection_failed"
+)
+
+// FailureCodes lists every code of a ConnectionError
+var FailureCodes = []string{
+	FailureWrongPassword, FailureInvalidPassword, FailureSSIDNotFound, FailureDHCPTimeout,
+	FailureAssociationRejected, FailureRadioDisabled, FailureNMNotRunning, FailureNotSaved, FailureUnknown,
+}
+
+// ConnectionError explains why NetworkManager failed to save or activate a connection
+type ConnectionError struct {
+	Code       string `json:"code"`
+	SSID       string `json:"ssid"`
+	Summary    string `json:"summary"`
+	Suggestion string `json:"suggestion"`
+	// Reason is the NetworkManager device state reason, if nmcli reported one
+	ReasonCode int    `json:"reasonCode,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+	Output     string `json:"output,omitempty"`
+	action     string
+}
+
+func (e *ConnectionError) Error() string {
+	action := e.action
+	if action == "" {
+		action = "connect to"
+	}
+	msg := fmt.Sprintf("failed to %s %s: %s", action, e.SSID, e.Summary)
+	if e.ReasonCode != 0 {
+		msg += fmt.Sprintf(" (NetworkManager reason %d: %s)", e.ReasonCode, e.Reason)
+	}
+	return msg
+}
+
+type failure struct {
+	summary    string
+	suggestion string
+}
+
+var failures = map[string]failure{
+	FailureWrongPassword:       {"Wrong password", "Check the password, it is case sensitive, and save the network again."},
+	FailureInvalidPassword:     {"Invalid password", "WPA passwords must be 8 to 63 characters long."},
+	FailureSSIDNotFound:        {"Network not found", "Check the SSID and that the network is in range. Hidden networks must be typed exactly."},
+	FailureDHCPTimeout:         {"No IP address received", "The network accepted the password but its DHCP server did not answer. Restart the router or check its address pool."},
+	FailureAssociationRejected: {"Access point rejected the connection", "The access point may be full, filter MAC addresses or require a security mode PiFi does not use. Check its settings."},
+	FailureRadioDisabled:       {"WiFi radio is disabled", "Enable WiFi with 'nmcli radio wifi on' and check 'rfkill list' for a blocked radio."},
+	FailureNMNotRunning:        {"NetworkManager is not running", "Start it with 'sudo systemctl start NetworkManager'."},
+	FailureNotSaved:            {"Network is not saved", "Add the network before connecting to it."},
+	FailureUnknown:             {"Connection failed", "See the NetworkManager output for details."},
+}
+
+// NetworkManager device state reasons, see NMDeviceStateReason
+var stateReasons = map[int]string{
+	5:  FailureDHCPTimeout,         // IP configuration could not be reserved
+	7:  FailureWrongPassword,       // secrets were required, but not provided
+	8:  FailureWrongPassword,       // 802.1X supplicant disconnected
+	9:  FailureAssociationRejected, // 802.1X supplicant configuration failed
+	10: FailureAssociationRejected, // 802.1X supplicant failed
+	11: FailureAssociationRejected, // 802.1X supplicant took too long to authenticate
+	15: FailureDHCPTimeout,         // DHCP client failed to start
+	16: FailureDHCPTimeout,         // DHCP client error
+	17: FailureDHCPTimeout,         // DHCP client failed
+	37: FailureRadioDisabled,       // device is sleeping
+	53: FailureSSIDNotFound,        // the WiFi network could not be found
+}
+
+// nmcli reports activation failures as "Error: Connection activation failed: (7) Secrets were required, but not provided."
+var stateReasonPattern = regexp.MustCompile(`\((\d+)\)\s*([^\n]*?)\.?\s*$`)
+
+// diagnose classifies a failed nmcli call for ssid from its output
+func diagnose(action, ssid string, output []byte, err error) *ConnectionError {
+	out := strings.TrimSpace(string(output))
+	e := &ConnectionError{Code: FailureUnknown, SSID: ssid, Output: out, action: action}
+	if out == "" && err != nil {
+		e.Output = err.Error()
+	}
+
+	for _, line := range strings.Split(out, "\n") {
+		if m := stateReasonPattern.FindStringSubmatch(strings.TrimSpace(line)); m != nil {
+			e.ReasonCode, _ = strconv.Atoi(m[1])
+			e.Reason = m[2]
+			if code, ok := stateReasons[e.ReasonCode]; ok {
+				e.Code = code
+			}
+			break
+		}
+	}
+
+	lower := strings.ToLower(out)
+	if e.Code == FailureUnknown {
+		switch {
+		case errors.Is(err, exec.ErrNotFound), strings.Contains(lower, "networkmanager is not running"):
+			e.Code = FailureNMNotRunning
+		case strings.Contains(lower, "secrets were required"):
+			e.Code = FailureWrongPassword
+		case strings.Contains(lower, "psk: property is invalid"):
+			e.Code = FailureInvalidPassword
+		case strings.Contains(lower, "no network with ssid"), strings.Contains(lower, "could not be found"):
+			e.Code = FailureSSIDNotFound
+		case strings.Contains(lower, "ip configuration could not be reserved"):
+			e.Code = FailureDHCPTimeout
+		case strings.Contains(lower, "unknown connection"):
+			e.Code = FailureNotSaved
+		case !nmRunning():
+			e.Code = FailureNMNotRunning
+		case !wifiRadioEnabled():
+			e.Code = FailureRadioDisabled
+		}
+	}
+
+	f := failures[e.Code]
+	e.Summary, e.Suggestion = f.summary, f.suggestion
+	return e
+}
+
+// nmRunning and wifiRadioEnabled are variables so tests can diagnose without nmcli
+var nmRunning = func() bool {
+	output, err := exec.Command("nmcli", "-t", "-f", "RUNNING", "general").Output()
+	return err == nil && strings.TrimSpace(string(output)) == "running"
+}
+
+var wifiRadioEnabled = func() bool {
+	output, err := exec.Command("nmcli", "radio", "wifi").Output()
+	return err != nil || strings.TrimSpace(string(output)) != "disabled"
+}
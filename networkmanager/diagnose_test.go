@@ -0,0 +1,85 @@
+package networkmanager
+
+import (
+	"errors"
+	"os/exec"
+	"slices"
+	"testing"
+)
+
+func TestDiagnose(t *testing.T) {
+	exitErr := errors.New("exit status 4")
+	for _, tc := range []struct {
+		name     string
+		output   string
+		err      error
+		running  bool
+		radio    bool
+		want     string
+		wantCode int
+	}{
+		{"secrets required", "Error: Connection activation failed: (7) Secrets were required, but not provided.", exitErr, true, true, FailureWrongPassword, 7},
+		{"supplicant disconnected", "Error: Connection activation failed: (8) The 802.1X supplicant disconnected.", exitErr, true, true, FailureWrongPassword, 8},
+		{"secrets required without reason", "Error: Connection activation failed: Secrets were required, but not provided.", exitErr, true, true, FailureWrongPassword, 0},
+		{"invalid psk", "Error: Failed to modify connection 'Cafe WiFi': 802-11-wireless-security.psk: property is invalid", exitErr, true, true, FailureInvalidPassword, 0},
+		{"ssid not in scan", "Error: No network with SSID 'Cafe WiFi' found.", exitErr, true, true, FailureSSIDNotFound, 0},
+		{"ssid reason", "Error: Connection activation failed: (53) The Wi-Fi network could not be found.", exitErr, true, true, FailureSSIDNotFound, 53},
+		{"ip configuration", "Error: Connection activation failed: (5) IP configuration could not be reserved (no available address, timeout, etc.).", exitErr, true, true, FailureDHCPTimeout, 5},
+		{"dhcp failed", "Error: Connection activation failed: (17) The DHCP client failed.", exitErr, true, true, FailureDHCPTimeout, 17},
+		{"supplicant failed", "Error: Connection activation failed: (10) The 802.1X supplicant failed.", exitErr, true, true, FailureAssociationRejected, 10},
+		{"supplicant timeout", "Error: Connection activation failed: (11) The 802.1X supplicant took too long to authenticate.", exitErr, true, true, FailureAssociationRejected, 11},
+		{"device sleeping", "Error: Connection activation failed: (37) The device is sleeping.", exitErr, true, true, FailureRadioDisabled, 37},
+		{"radio off", "Error: Connection activation failed: No suitable device found for this connection (device wlan0 not available because device is not available).", exitErr, true, false, FailureRadioDisabled, 0},
+		{"nm stopped", "Error: NetworkManager is not running.", exitErr, false, true, FailureNMNotRunning, 0},
+		{"nmcli missing", "", &exec.Error{Name: "nmcli", Err: exec.ErrNotFound}, false, true, FailureNMNotRunning, 0},
+		{"nm not answering", "Error: Timeout expired (90 seconds)", exitErr, false, true, FailureNMNotRunning, 0},
+		{"unknown connection", "Error: unknown connection 'Cafe WiFi'.", exitErr, true, true, FailureNotSaved, 0},
+		{"unmapped reason", "Error: Connection activation failed: (1) Unknown error.", exitErr, true, true, FailureUnknown, 1},
+		{"no output", "", exitErr, true, true, FailureUnknown, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			running, radio := nmRunning, wifiRadioEnabled
+			t.Cleanup(func() { nmRunning, wifiRadioEnabled = running, radio })
+			nmRunning = func() bool { return tc.running }
+			wifiRadioEnabled = func() bool { return tc.radio }
+
+			e := diagnose("connect to", "Cafe WiFi", []byte(tc.output+"\n"), tc.err)
+			if e.Code != tc.want || e.ReasonCode != tc.wantCode {
+				t.Errorf("diagnose(%q) = %s reason %d, want %s reason %d", tc.output, e.Code, e.ReasonCode, tc.want, tc.wantCode)
+			}
+			if e.Summary == "" || e.Suggestion == "" {
+				t.Errorf("diagnose(%q) has no summary or suggestion", tc.output)
+			}
+			if e.Output == "" {
+				t.Errorf("diagnose(%q) dropped the output", tc.output)
+			}
+		})
+	}
+}
+
+func TestDiagnoseReason(t *testing.T) {
+	e := diagnose("connect to", "Cafe WiFi", []byte("Error: Connection activation failed: (7) Secrets were required, but not provided.\n"), nil)
+	if e.Reason != "Secrets were required, but not provided" {
+		t.Errorf("Reason = %q", e.Reason)
+	}
+	want := "failed to connect to Cafe WiFi: Wrong password (NetworkManager reason 7: Secrets were required, but not provided)"
+	if e.Error() != want {
+		t.Errorf("Error() = %q, want %q", e.Error(), want)
+	}
+}
+
+func TestStateReasons(t *testing.T) {
+	for reason, code := range stateReasons {
+		if !slices.Contains(FailureCodes, code) {
+			t.Errorf("state reason %d maps to unknown code %q", reason, code)
+		}
+	}
+	for _, code := range FailureCodes {
+		if f, ok := failures[code]; !ok || f.summary == "" || f.suggestion == "" {
+			t.Errorf("%s has no summary or suggestion", code)
+		}
+	}
+	if _, ok := stateReasons[1]; ok {
+		t.Errorf("reason 1 is NetworkManager's unknown reason and should fall back to %s", FailureUnknown)
+	}
+}
@@ -0,0 +1,377 @@
+package networkmanager
+
+import (
+	"strings"
+)
+
+// pamEnvReason explains which values can't be written to /etc/environment
+const pamEnvReason = systemEnvFile + " can't hold line breaks, or a single quote together with one of \" \\ $ `, write the variable to another file"
+
+// envFile is a parsed environment file such as /etc/environment. It keeps the original text of
+// every line, so writing it back preserves comments, blank lines, ordering, export prefixes and
+// quoting of everything that wasn't changed.
+//
+// Values follow shell quoting rules: single quotes are literal, double quotes allow \" \\ \$ and \`
+// escapes, and quoted values may span lines.
+type envFile struct {
+	entries []envEntry
+	// pamEnv writes values in forms pam_env reads the same way, see quotePAMEnvValue
+	pamEnv bool
+}
+
+// envEntry is one logical line, or several physical lines for a quoted value containing newlines
+type envEntry struct {
+	raw string // original text including the newline, if any
+
+	// Set for assignments only
+	key    string
+	value  string
+	prefix string // text before the value, such as "export KEY="
+	suffix string // text after the value, such as a trailing comment and the newline
+	quote  byte   // quote style of the value, 0 if unquoted
+	// broken is set when a quote isn't closed, the value is taken up to the end of the line
+	broken bool
+}
+
+// parseEnvFile parses data. Lines that aren't assignments are kept as they are.
+func parseEnvFile(data string) *envFile {
+	f := &envFile{}
+	for len(data) > 0 {
+		entry, n := parseEnvEntry(data)
+		f.entries = append(f.entries, entry)
+		data = data[n:]
+	}
+	return f
+}
+
+// parseEnvFileAt parses data read from path. /etc/environment is read by pam_env, which knows
+// neither escapes nor values spanning lines, so values written to it avoid both.
+func parseEnvFileAt(path, data string) *envFile {
+	f := parseEnvFile(data)
+	f.pamEnv = path == systemEnvFile
+	return f
+}
+
+// checkEnvFileValue fails with an *EnvValidationError if value can't be written to file so that
+// every reader sees the same value
+func checkEnvFileValue(file, key, value string) error {
+	if file != systemEnvFile {
+		return nil
+	}
+	if _, ok := quotePAMEnvValue(value, 0); !ok {
+		return &EnvValidationError{Key: key, Reason: pamEnvReason}
+	}
+	return nil
+}
+
+// parseEnvEntry parses the entry at the start of data and returns it with its length
+func parseEnvEntry(data string) (envEntry, int) {
+	lineEnd := strings.IndexByte(data, '\n') + 1
+	if lineEnd == 0 {
+		lineEnd = len(data)
+	}
+	line := envEntry{raw: data[:lineEnd]}
+
+	i := skipBlanks(data, 0)
+	if word, ok := strings.CutPrefix(data[i:], "export"); ok && len(word) > 0 && (word[0] == ' ' || word[0] == '\t') {
+		i = skipBlanks(data, i+len("export"))
+	}
+	keyStart := i
+	for i < len(data) && isEnvKeyChar(data[i], i == keyStart) {
+		i++
+	}
+	key := data[keyStart:i]
+	i = skipBlanks(data, i)
+	if key == "" || i >= len(data) || data[i] != '=' {
+		return line, lineEnd
+	}
+	i = skipBlanks(data, i+1)
+	valueStart := i
+	value, quote, end, ok := parseEnvValue(data, i)
+
+	// The entry continues to the end of the line the value ended on
+	entryEnd := len(data)
+	if nl := strings.IndexByte(data[end:], '\n'); nl >= 0 {
+		entryEnd = end + nl + 1
+	}
+	return envEntry{
+		raw:    data[:entryEnd],
+		key:    key,
+		value:  value,
+		prefix: data[:valueStart],
+		suffix: data[end:entryEnd],
+		quote:  quote,
+		broken: !ok,
+	}, entryEnd
+}
+
+// parseEnvValue reads a value starting at data[i] up to unquoted whitespace or the end of the line.
+// It returns the value, its quote style, the index after it and false if a quote isn't closed,
+// in that case the rest of its line is taken literally.
+func parseEnvValue(data string, i int) (string, byte, int, bool) {
+	var b strings.Builder
+	var quote byte
+	closed := true
+	for i < len(data) {
+		c := data[i]
+		switch {
+		case c == '\'' || c == '"':
+			value, end, ok := parseQuoted(data, i)
+			if !ok {
+				end = i + 1 + strings.IndexAny(data[i+1:]+"\n", "\r\n")
+				value, closed = data[i+1:end], false
+			}
+			b.WriteString(value)
+			quote, i = c, end
+		case c == '\\' && i+1 < len(data):
+			if data[i+1] != '\n' {
+				b.WriteByte(data[i+1])
+			} else if i+2 == len(data) {
+				// A continuation at the end of the file would join the line appended after it
+				closed = false
+			}
+			i += 2
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			return b.String(), quote, i, closed
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return b.String(), quote, i, closed && !strings.HasSuffix(data, "\\")
+}
+
+// parseQuoted reads the quoted string starting at data[i] and returns it with the index after
+// the closing quote, or false if there is none
+func parseQuoted(data string, i int) (string, int, bool) {
+	q := data[i]
+	if q == '\'' {
+		end := strings.IndexByte(data[i+1:], '\'')
+		if end < 0 {
+			return "", 0, false
+		}
+		return data[i+1 : i+1+end], i + end + 2, true
+	}
+
+	var b strings.Builder
+	for i++; i < len(data); i++ {
+		switch c := data[i]; {
+		case c == '"':
+			return b.String(), i + 1, true
+		case c == '\\' && i+1 < len(data) && strings.IndexByte("\"\\$`\n", data[i+1]) >= 0:
+			i++
+			if data[i] != '\n' {
+				b.WriteByte(data[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, false
+}
+
+func skipBlanks(data string, i int) int {
+	for i < len(data) && (data[i] == ' ' || data[i] == '\t') {
+		i++
+	}
+	return i
+}
+
+func isEnvKeyChar(c byte, first bool) bool {
+	return c == '_' || 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || !first && '0' <= c && c <= '9'
+}
+
+// validEnvKey reports whether key can be written as an assignment
+func validEnvKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if !isEnvKeyChar(key[i], i == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// Get returns the value of the last assignment to key, the one a shell would see
+func (f *envFile) Get(key string) (string, bool) {
+	for i := len(f.entries) - 1; i >= 0; i-- {
+		if f.entries[i].key == key {
+			return f.entries[i].value, true
+		}
+	}
+	return "", false
+}
+
+// Vars returns every assigned variable
+func (f *envFile) Vars() map[string]string {
+	vars := make(map[string]string)
+	for _, e := range f.entries {
+		if e.key != "" {
+			vars[e.key] = e.value
+		}
+	}
+	return vars
+}
+
+// Keys returns the assigned variables in the order they first appear
+func (f *envFile) Keys() []string {
+	var keys []string
+	seen := make(map[string]bool)
+	for _, e := range f.entries {
+		if e.key != "" && !seen[e.key] {
+			seen[e.key] = true
+			keys = append(keys, e.key)
+		}
+	}
+	return keys
+}
+
+// Set assigns value to key. The last assignment is rewritten in place, keeping its export prefix,
+// quote style where possible and trailing comment, and earlier duplicates are removed.
+// New keys are appended.
+func (f *envFile) Set(key, value string) {
+	last := -1
+	for i, e := range f.entries {
+		if e.key == key {
+			last = i
+		}
+	}
+
+	f.repair()
+	if last < 0 {
+		if n := len(f.entries); n > 0 && !strings.HasSuffix(f.entries[n-1].raw, "\n") {
+			f.entries[n-1].raw += "\n"
+			f.entries[n-1].suffix += "\n"
+		}
+		f.entries = append(f.entries, f.newEntry(key, key+"=", value, '"', "\n"))
+	} else if e := f.entries[last]; e.value != value {
+		f.entries[last] = f.newEntry(key, e.prefix, value, e.quote, e.suffix)
+	}
+
+	entries := f.entries[:0]
+	for i, e := range f.entries {
+		if e.key != key || i >= last {
+			entries = append(entries, e)
+		}
+	}
+	f.entries = entries
+}
+
+// Unset removes every assignment to key and reports whether there was one
+func (f *envFile) Unset(key string) bool {
+	entries := f.entries[:0]
+	for _, e := range f.entries {
+		if e.key != key {
+			entries = append(entries, e)
+		}
+	}
+	removed := len(entries) != len(f.entries)
+	f.entries = entries
+	if removed {
+		f.repair()
+	}
+	return removed
+}
+
+// repair requotes broken assignments before the file is changed, keeping their values. Otherwise
+// a quote later in the file, such as one of a new assignment, would close an open quote and
+// swallow the lines in between, and a trailing continuation would join the next line.
+func (f *envFile) repair() {
+	for i, e := range f.entries {
+		if !e.broken {
+			continue
+		}
+		suffix := e.suffix
+		if strings.HasSuffix(e.raw, "\n") && !strings.HasSuffix(suffix, "\n") {
+			suffix += "\n"
+		}
+		f.entries[i] = f.newEntry(e.key, e.prefix, e.value, e.quote, suffix)
+	}
+}
+
+// String returns the file contents
+func (f *envFile) String() string {
+	var b strings.Builder
+	for _, e := range f.entries {
+		b.WriteString(e.raw)
+	}
+	return b.String()
+}
+
+func (f *envFile) newEntry(key, prefix, value string, quote byte, suffix string) envEntry {
+	quoted, ok := "", false
+	if f.pamEnv {
+		quoted, ok = quotePAMEnvValue(value, quote)
+	}
+	// Values pam_env can't read are rejected by checkEnvFileValue before they are set,
+	// broken lines requoted by repair fall back to shell quoting
+	if !ok {
+		quoted = quoteEnvValue(value, quote)
+	}
+	if quote = quoted[0]; quote != '"' && quote != '\'' {
+		quote = 0
+	}
+	return envEntry{
+		raw:    prefix + quoted + suffix,
+		key:    key,
+		value:  value,
+		prefix: prefix,
+		suffix: suffix,
+		quote:  quote,
+	}
+}
+
+// quoteEnvValue quotes value in the preferred style if that can represent it, in double quotes otherwise
+func quoteEnvValue(value string, preferred byte) string {
+	switch {
+	case preferred == 0 && value != "" && strings.IndexFunc(value, needsQuoting) < 0:
+		return value
+	case preferred == '\'' && !strings.ContainsRune(value, '\''):
+		return "'" + value + "'"
+	}
+
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '"', '\\', '$', '`':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// quotePAMEnvValue writes value without escapes or line breaks, which pam_env doesn't understand.
+// pam_env drops a quote at the start and the end of a value and keeps everything in between, so
+// single quotes hold any value without a single quote, double quotes any value without characters
+// the shell would need escaped in them. Other values can't be written.
+func quotePAMEnvValue(value string, preferred byte) (string, bool) {
+	if strings.ContainsAny(value, "\r\n") {
+		return "", false
+	}
+	single := !strings.ContainsRune(value, '\'')
+	double := !strings.ContainsAny(value, "\"\\$`")
+	switch {
+	case preferred == 0 && value != "" && strings.IndexFunc(value, needsQuoting) < 0:
+		return value, true
+	case preferred == '"' && double:
+		return `"` + value + `"`, true
+	case single:
+		return "'" + value + "'", true
+	case double:
+		return `"` + value + `"`, true
+	}
+	return "", false
+}
+
+// needsQuoting reports whether r can't appear in an unquoted value
+func needsQuoting(r rune) bool {
+	return !(r == '_' || r == '-' || r == '.' || r == '/' || r == ':' || r == ',' || r == '@' || r == '+' || r == '%' ||
+		'A' <= r && r <= 'Z' || 'a' <= r && r <= 'z' || '0' <= r && r <= '9')
+}
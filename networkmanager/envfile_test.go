@@ -0,0 +1,295 @@
+package networkmanager
+
+import (
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+// envText is a random environment file made of comments, blank lines, assignments in every quoting
+// style, export prefixes, duplicates and malformed lines
+type envText string
+
+func (envText) Generate(r *rand.Rand, size int) reflect.Value {
+	fragments := []func() string{
+		func() string { return "# " + randomValue(r, size) },
+		func() string { return "" },
+		func() string { return "   \t" },
+		func() string { return randomKey(r) + "=" + quoteEnvValue(randomValue(r, size), '"') },
+		func() string { return randomKey(r) + "=" + quoteEnvValue(randomValue(r, size), '\'') },
+		func() string { return randomKey(r) + "=" + quoteEnvValue(randomValue(r, size), 0) },
+		func() string { return "export " + randomKey(r) + "=" + quoteEnvValue(randomValue(r, size), '"') },
+		func() string { return "  " + randomKey(r) + " = value # trailing comment" },
+		func() string { return randomKey(r) + `="unterminated` },
+		func() string { return randomKey(r) + `=back\ slash\` },
+		func() string { return "not an assignment" },
+		func() string { return randomValue(r, size) },
+	}
+
+	var lines []string
+	for n := r.Intn(size + 1); n > 0; n-- {
+		lines = append(lines, fragments[r.Intn(len(fragments))]())
+	}
+	text := strings.Join(lines, "\n")
+	if r.Intn(2) == 0 {
+		text += "\n"
+	}
+	if r.Intn(4) == 0 {
+		text = strings.ReplaceAll(text, "\n", "\r\n")
+	}
+	return reflect.ValueOf(envText(text))
+}
+
+// envValue is a random value, biased towards characters that need quoting
+type envValue string
+
+func (envValue) Generate(r *rand.Rand, size int) reflect.Value {
+	return reflect.ValueOf(envValue(randomValue(r, size)))
+}
+
+// envKey is a random valid variable name
+type envKey string
+
+func (envKey) Generate(r *rand.Rand, size int) reflect.Value {
+	return reflect.ValueOf(envKey(randomKey(r)))
+}
+
+func randomKey(r *rand.Rand) string {
+	const first = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz_"
+	const rest = first + "0123456789"
+	key := []byte{first[r.Intn(len(first))]}
+	for n := r.Intn(4); n > 0; n-- {
+		key = append(key, rest[r.Intn(len(rest))])
+	}
+	return string(key)
+}
+
+func randomValue(r *rand.Rand, size int) string {
+	const special = "\"'\\$`#= \t\n\r!*?;&|<>(){}~"
+	var b strings.Builder
+	for n := r.Intn(size + 1); n > 0; n-- {
+		switch r.Intn(4) {
+		case 0:
+			b.WriteByte(special[r.Intn(len(special))])
+		case 1:
+			b.WriteRune(rune(r.Intn(0x3000) + 1))
+		default:
+			b.WriteByte(byte('a' + r.Intn(26)))
+		}
+	}
+	return b.String()
+}
+
+func TestEnvFileRoundTrip(t *testing.T) {
+	property := func(text envText) bool {
+		return parseEnvFile(string(text)).String() == string(text)
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEnvFileSetGet(t *testing.T) {
+	property := func(text envText, key envKey, value envValue) bool {
+		f := parseEnvFile(string(text))
+		f.Set(string(key), string(value))
+
+		got, ok := parseEnvFile(f.String()).Get(string(key))
+		return ok && got == string(value)
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEnvFileSetKeepsOtherLines(t *testing.T) {
+	property := func(text envText, key envKey, value envValue) bool {
+		before := parseEnvFile(string(text))
+		before.repair()
+		f := parseEnvFile(string(text))
+		f.Set(string(key), string(value))
+		after := parseEnvFile(f.String())
+
+		// Every other variable keeps its value and every other line its text, in order, apart
+		// from broken quoting that is repaired
+		want := before.Vars()
+		delete(want, string(key))
+		got := after.Vars()
+		delete(got, string(key))
+		return reflect.DeepEqual(want, got) && reflect.DeepEqual(otherLines(before, string(key)), otherLines(after, string(key)))
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEnvFileUnset(t *testing.T) {
+	property := func(text envText, key envKey) bool {
+		before := parseEnvFile(string(text))
+		f := parseEnvFile(string(text))
+		_, had := f.Get(string(key))
+		if had {
+			before.repair()
+		}
+		if f.Unset(string(key)) != had {
+			return false
+		}
+		after := parseEnvFile(f.String())
+
+		want := before.Vars()
+		delete(want, string(key))
+		_, stillSet := after.Get(string(key))
+		return !stillSet && reflect.DeepEqual(want, after.Vars()) &&
+			reflect.DeepEqual(otherLines(before, string(key)), otherLines(after, string(key)))
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEnvFileSetIsIdempotent(t *testing.T) {
+	property := func(text envText, key envKey, value envValue) bool {
+		f := parseEnvFile(string(text))
+		f.Set(string(key), string(value))
+		once := f.String()
+		f.Set(string(key), string(value))
+		return f.String() == once
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+// otherLines returns the text of every entry that doesn't assign key, ignoring a newline added
+// to the last line when a key is appended
+func otherLines(f *envFile, key string) []string {
+	var lines []string
+	for _, e := range f.entries {
+		if e.key != key {
+			lines = append(lines, strings.TrimSuffix(e.raw, "\n"))
+		}
+	}
+	return lines
+}
+
+func TestEnvFileFormatting(t *testing.T) {
+	const text = `# Set by the installer
+PATH="/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin"
+export API_URL='https://example.com'  # staging
+  LEVEL=debug
+GREETING="say \"hi\"
+to \$USER"
+`
+	f := parseEnvFile(text)
+	for key, want := range map[string]string{
+		"PATH":     "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin",
+		"API_URL":  "https://example.com",
+		"LEVEL":    "debug",
+		"GREETING": "say \"hi\"\nto $USER",
+	} {
+		if got, _ := f.Get(key); got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+
+	f.Set("API_URL", "https://example.org")
+	f.Set("LEVEL", "info warn")
+	f.Set("TOKEN", `a"b\c$d`)
+	want := `# Set by the installer
+PATH="/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin"
+export API_URL='https://example.org'  # staging
+  LEVEL="info warn"
+GREETING="say \"hi\"
+to \$USER"
+TOKEN="a\"b\\c\$d"
+`
+	if got := f.String(); got != want {
+		t.Errorf("after Set:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+// TestEnvFileShell checks that a shell sourcing the file sees the values that were set
+func TestEnvFileShell(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh not found")
+	}
+	path := filepath.Join(t.TempDir(), "environment")
+
+	property := func(value envValue) bool {
+		f := parseEnvFile("# comment\nexport OTHER=1\n")
+		f.Set("PIFI_TEST_VALUE", strings.ReplaceAll(string(value), "\x00", ""))
+		if err := os.WriteFile(path, []byte(f.String()), 0644); err != nil {
+			t.Fatal(err)
+		}
+		out, err := exec.Command(sh, "-c", `. "$1" && printf %s "$PIFI_TEST_VALUE"`, "sh", path).Output()
+		want, _ := f.Get("PIFI_TEST_VALUE")
+		return err == nil && string(out) == want
+	}
+	if err := quick.Check(property, &quick.Config{MaxCount: 50}); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestEnvFilePAMEnv checks that values written to /etc/environment read the same for pam_env,
+// which drops a quote at each end of a value and knows no escapes, and for a shell
+func TestEnvFilePAMEnv(t *testing.T) {
+	// pamValue reads a line of /etc/environment the way pam_env does
+	pamValue := func(line string) string {
+		_, value, _ := strings.Cut(strings.TrimSuffix(line, "\n"), "=")
+		if len(value) > 0 && (value[0] == '"' || value[0] == '\'') {
+			value = value[1:]
+			if n := len(value); n > 0 && (value[n-1] == '"' || value[n-1] == '\'') {
+				value = value[:n-1]
+			}
+		}
+		return value
+	}
+
+	property := func(value envValue) bool {
+		v := string(value)
+		if checkEnvFileValue(systemEnvFile, "PIFI_TEST", v) != nil {
+			_, ok := quotePAMEnvValue(v, 0)
+			return !ok
+		}
+		f := parseEnvFileAt(systemEnvFile, "# comment\n")
+		f.Set("PIFI_TEST", v)
+		line := f.entries[len(f.entries)-1].raw
+		got, _ := parseEnvFile(f.String()).Get("PIFI_TEST")
+		return strings.Count(line, "\n") == 1 && pamValue(line) == v && got == v
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Error(err)
+	}
+
+	for value, ok := range map[string]bool{
+		"plain":                true,
+		"two words":            true,
+		`a"b\c$d`:              true,
+		"it's":                 true,
+		`it's "quoted"`:        false,
+		"it's $HOME":           false,
+		"first\nsecond":        false,
+		"carriage\rreturn":     false,
+		"https://example.com/": true,
+	} {
+		if err := checkEnvFileValue(systemEnvFile, "PIFI_TEST", value); (err == nil) != ok {
+			t.Errorf("checkEnvFileValue(%q) = %v, want ok %v", value, err, ok)
+		}
+		if err := checkEnvFileValue("/etc/default/myapp", "PIFI_TEST", value); err != nil {
+			t.Errorf("checkEnvFileValue(%q) for another file = %v", value, err)
+		}
+	}
+
+	// Existing double quoted values are rewritten without escapes
+	f := parseEnvFileAt(systemEnvFile, "TOKEN=\"old\"\n")
+	f.Set("TOKEN", `a"b\c`)
+	if got := f.String(); got != "TOKEN='a\"b\\c'\n" {
+		t.Errorf("after Set = %q", got)
+	}
+}
@@ -0,0 +1,236 @@
+package networkmanager
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/ztkent/pifi/state"
+)
+
+// envHistoryLimit is the number of revisions kept, older ones are dropped
+const envHistoryLimit = 1000
+
+// SecretMask replaces the values of secrets in the history and in API responses
+const SecretMask = "********"
+
+// EnvRevision records one change of a managed variable. Values of secrets are redacted, with
+// EncryptSecrets the old value is kept encrypted so the change can be rolled back.
+type EnvRevision struct {
+	ID     int       `json:"id"`
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor,omitempty"` // Who made the change, as passed to WithActor
+	Key    string    `json:"key"`
+	Old    *string   `json:"old"` // nil if the variable wasn't set
+	New    *string   `json:"new"` // nil if the change unset it
+	Secret bool      `json:"secret,omitempty"`
+	// OldSealed is the old value of a secret encrypted with the device key, it is never returned
+	OldSealed string `json:"oldSealed,omitempty"`
+	// Set when the revision changed the target of the variable, Old and New are then its unchanged value
+	OldTarget *EnvTarget `json:"oldTarget,omitempty"`
+	NewTarget *EnvTarget `json:"newTarget,omitempty"`
+}
+
+// EnvRollback lists the variables a rollback set and unset, and the secrets it couldn't restore
+type EnvRollback struct {
+	Set     []string `json:"set"`
+	Unset   []string `json:"unset"`
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+// WithActor returns a NetworkManager that records actor as the author of the environment changes made through it
+func (nm *networkManager) WithActor(actor string) NetworkManager {
+	c := *nm
+	c.actor = actor
+	return &c
+}
+
+// readEnvHistory returns every stored revision, oldest first
+func (nm *networkManager) readEnvHistory() ([]EnvRevision, error) {
+	var revisions []EnvRevision
+	if err := nm.opts.State.Get(state.SectionEnvHistory, &revisions); err != nil {
+		return nil, err
+	}
+	return revisions, nil
+}
+
+// envChange is a change to record, old and new are nil when the variable wasn't or isn't set
+type envChange struct {
+	key      string
+	old, new *string
+	secret   bool
+	// Targets before and after the change, nil unless the change was to the target
+	oldTarget, newTarget *EnvTarget
+}
+
+// recordEnvChanges appends a revision for every change that changed a value or target. Failures are only
+// logged, the changes were already made.
+func (nm *networkManager) recordEnvChanges(changes []envChange) {
+	now := time.Now().UTC()
+	var revisions []EnvRevision
+	for _, c := range changes {
+		if c.newTarget == nil && (c.old != nil && c.new != nil && *c.old == *c.new || c.old == nil && c.new == nil) {
+			continue
+		}
+		rev := EnvRevision{Time: now, Actor: nm.actor, Key: c.key, Old: c.old, New: c.new, Secret: c.secret,
+			OldTarget: c.oldTarget, NewTarget: c.newTarget}
+		if c.secret {
+			if c.old != nil && nm.opts.EncryptSecrets {
+				if aead, err := nm.secretCipher(); err == nil {
+					rev.OldSealed, _ = sealSecret(aead, c.key, *c.old)
+				}
+			}
+			rev.Old, rev.New = redact(c.old), redact(c.new)
+		}
+		revisions = append(revisions, rev)
+	}
+	if len(revisions) == 0 {
+		return
+	}
+
+	err := nm.opts.State.Update(func(tx *state.Tx) error {
+		var history []EnvRevision
+		if err := tx.Get(state.SectionEnvHistory, &history); err != nil {
+			return err
+		}
+		next := 1
+		if len(history) > 0 {
+			next = history[len(history)-1].ID + 1
+		}
+		for i := range revisions {
+			revisions[i].ID = next + i
+		}
+		history = append(history, revisions...)
+		if len(history) > envHistoryLimit {
+			history = history[len(history)-envHistoryLimit:]
+		}
+		return tx.Set(state.SectionEnvHistory, history)
+	})
+	if err != nil {
+		log.Printf("Warning: failed to record environment history: %v", err)
+	}
+}
+
+// envSnapshot returns the current variables and secrets before a change, to record their old values.
+// History is best effort, so errors only leave them empty.
+func (nm *networkManager) envSnapshot() (map[string]string, []string) {
+	vars, err := nm.GetEnvironmentVariables()
+	if err != nil {
+		log.Printf("Warning: failed to read environment for history: %v", err)
+	}
+	secrets, _ := nm.GetEnvironmentSecrets()
+	return vars, secrets
+}
+
+// lookup returns the value of key in vars, nil if it isn't set
+func lookup(vars map[string]string, key string) *string {
+	if value, ok := vars[key]; ok {
+		return &value
+	}
+	return nil
+}
+
+// redact replaces a secret value with the mask shown for secrets, keeping whether it was set
+func redact(value *string) *string {
+	if value == nil {
+		return nil
+	}
+	mask := SecretMask
+	return &mask
+}
+
+// GetEnvironmentHistory returns the revisions of key, or of every variable if key is empty, newest first
+func (nm *networkManager) GetEnvironmentHistory(key string) ([]EnvRevision, error) {
+	history, err := nm.readEnvHistory()
+	if err != nil {
+		return nil, err
+	}
+	revisions := []EnvRevision{}
+	for i := len(history) - 1; i >= 0; i-- {
+		if rev := history[i]; key == "" || rev.Key == key {
+			rev.OldSealed = ""
+			revisions = append(revisions, rev)
+		}
+	}
+	return revisions, nil
+}
+
+// RollbackEnvironment restores the variables to their values right after revision id, undoing every
+// later change. With a key only that variable is restored. Secrets whose old value wasn't kept
+// are skipped. The rollback is applied at once and recorded as new revisions.
+func (nm *networkManager) RollbackEnvironment(id int, key string) (EnvRollback, error) {
+	result := EnvRollback{Set: []string{}, Unset: []string{}}
+	history, err := nm.readEnvHistory()
+	if err != nil {
+		return result, err
+	}
+	if !slices.ContainsFunc(history, func(r EnvRevision) bool { return r.ID == id && (key == "" || r.Key == key) }) {
+		if key != "" {
+			return result, fmt.Errorf("no revision %d of %s", id, key)
+		}
+		return result, fmt.Errorf("no revision %d", id)
+	}
+
+	// The value after revision id is the old value of the first later revision of each variable.
+	// Targets aren't rolled back, and revisions of them didn't change the value.
+	first := map[string]EnvRevision{}
+	var keys []string
+	for _, rev := range history {
+		if rev.ID <= id || key != "" && rev.Key != key || rev.NewTarget != nil {
+			continue
+		}
+		if _, ok := first[rev.Key]; !ok {
+			first[rev.Key] = rev
+			keys = append(keys, rev.Key)
+		}
+	}
+
+	set := map[string]string{}
+	var unset, secrets []string
+	for _, k := range keys {
+		rev := first[k]
+		switch {
+		case rev.Old == nil:
+			unset = append(unset, k)
+		case !rev.Secret:
+			set[k] = *rev.Old
+		case rev.OldSealed != "":
+			aead, err := nm.secretCipher()
+			if err != nil {
+				return result, err
+			}
+			value, err := openSecret(aead, k, rev.OldSealed)
+			if err != nil {
+				return result, err
+			}
+			set[k] = value
+			secrets = append(secrets, k)
+		default:
+			result.Skipped = append(result.Skipped, k)
+		}
+	}
+
+	// Variables already at their old value are left alone
+	current, err := nm.GetEnvironmentVariables()
+	if err != nil {
+		return result, err
+	}
+	for k, value := range set {
+		if old, ok := current[k]; ok && old == value {
+			delete(set, k)
+		}
+	}
+	unset = slices.DeleteFunc(unset, func(k string) bool { _, ok := current[k]; return !ok })
+
+	if err := nm.applyEnvironment(set, unset, secrets); err != nil {
+		return result, err
+	}
+	for k := range set {
+		result.Set = append(result.Set, k)
+	}
+	slices.Sort(result.Set)
+	result.Unset = append(result.Unset, unset...)
+	slices.Sort(result.Unset)
+	return result, nil
+}
@@ -0,0 +1,169 @@
+package networkmanager
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/ztkent/pifi/state"
+)
+
+// testState returns a state file in a temporary directory holding the managed variables
+func testState(t *testing.T, managed ManagedEnvVars) *state.Store {
+	t.Helper()
+	store := state.New(filepath.Join(t.TempDir(), "state.json"), state.Legacy{})
+	err := store.Update(func(tx *state.Tx) error {
+		return tx.Set(state.SectionManagedEnv, managed)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestRollbackEnvironment(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "app.env")
+	managed := ManagedEnvVars{Targets: map[string]EnvTarget{"PIFI_TEST_A": {File: file}, "PIFI_TEST_B": {File: file}}}
+	nm := &networkManager{opts: Options{
+		EnvSchemaFile: filepath.Join(dir, "schema.yaml"),
+		State:         testState(t, managed),
+	}}
+	t.Setenv("PIFI_TEST_A", "")
+	t.Setenv("PIFI_TEST_B", "")
+
+	alice := nm.WithActor("alice")
+	if err := alice.ApplyEnvironment(map[string]string{"PIFI_TEST_A": "1"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := nm.WithActor("bob").ApplyEnvironment(map[string]string{"PIFI_TEST_A": "2", "PIFI_TEST_B": "x"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Unchanged values aren't recorded
+	if err := alice.ApplyEnvironment(map[string]string{"PIFI_TEST_A": "2"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := nm.GetEnvironmentHistory("PIFI_TEST_A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[0].Actor != "bob" || *history[0].Old != "1" || *history[0].New != "2" || history[1].Old != nil {
+		t.Fatalf("history of PIFI_TEST_A = %+v", history)
+	}
+
+	result, err := nm.RollbackEnvironment(history[1].ID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(result.Set, []string{"PIFI_TEST_A"}) || !slices.Equal(result.Unset, []string{"PIFI_TEST_B"}) {
+		t.Errorf("rollback = %+v, want PIFI_TEST_A set and PIFI_TEST_B unset", result)
+	}
+	if vars, _ := readEnvFile(file); len(vars) != 1 || vars["PIFI_TEST_A"] != "1" {
+		t.Errorf("app.env after rollback = %v, want PIFI_TEST_A=1", vars)
+	}
+	// The rollback is recorded too
+	if all, _ := nm.GetEnvironmentHistory(""); len(all) != 5 {
+		t.Errorf("history has %d revisions after rollback, want 5", len(all))
+	}
+	if _, err := nm.RollbackEnvironment(99, ""); err == nil {
+		t.Error("RollbackEnvironment to a missing revision succeeded")
+	}
+}
+
+func TestRollbackEnvironmentSecret(t *testing.T) {
+	dir := t.TempDir()
+	managed := ManagedEnvVars{Targets: map[string]EnvTarget{"PIFI_TEST_S": {File: filepath.Join(dir, "app.env")}}}
+	nm := &networkManager{opts: Options{
+		EncryptSecrets: true,
+		DeviceKeyFile:  filepath.Join(dir, "device.key"),
+		SecretEnvFile:  filepath.Join(dir, "secrets.env"),
+		EnvSchemaFile:  filepath.Join(dir, "schema.yaml"),
+		State:          testState(t, managed),
+	}}
+	t.Setenv("PIFI_TEST_S", "")
+
+	for _, value := range []string{"one", "two"} {
+		if err := nm.SetSecretEnvironmentVariable("PIFI_TEST_S", value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	history, err := nm.GetEnvironmentHistory("PIFI_TEST_S")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || *history[0].New != SecretMask || *history[0].Old != SecretMask || history[0].OldSealed != "" {
+		t.Fatalf("history of a secret = %+v, want masked values", history)
+	}
+	if stored, _ := os.ReadFile(nm.opts.State.Path()); strings.Contains(string(stored), `"one"`) || strings.Contains(string(stored), `"two"`) {
+		t.Errorf("state file contains a secret value:\n%s", stored)
+	}
+
+	if _, err := nm.RollbackEnvironment(history[1].ID, "PIFI_TEST_S"); err != nil {
+		t.Fatal(err)
+	}
+	if vars, _ := nm.GetEnvironmentVariables(); vars["PIFI_TEST_S"] != "one" {
+		t.Errorf("secret after rollback = %q, want one", vars["PIFI_TEST_S"])
+	}
+}
+
+func TestEnvironmentTargetHistory(t *testing.T) {
+	dir := t.TempDir()
+	nm := &networkManager{opts: Options{
+		EnvSchemaFile: filepath.Join(dir, "schema.yaml"),
+		State:         testState(t, ManagedEnvVars{}),
+	}}
+	t.Setenv("PIFI_TEST_T", "")
+
+	target := EnvTarget{Restart: []string{"app.service"}}
+	for i := 0; i < 2; i++ {
+		if err := nm.WithActor("alice").SetEnvironmentTarget("PIFI_TEST_T", target); err != nil {
+			t.Fatal(err)
+		}
+	}
+	history, err := nm.GetEnvironmentHistory("PIFI_TEST_T")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 {
+		t.Fatalf("history = %+v, want one revision, unchanged targets aren't recorded", history)
+	}
+	rev := history[0]
+	if rev.Actor != "alice" || rev.OldTarget == nil || rev.OldTarget.String() != "/etc/environment" ||
+		rev.NewTarget == nil || rev.NewTarget.String() != "/etc/environment, restart app.service" {
+		t.Errorf("revision = %+v, want the target change by alice", rev)
+	}
+
+	// Rolling back to before the target change leaves the target alone
+	if _, err := nm.RollbackEnvironment(rev.ID, ""); err != nil {
+		t.Fatal(err)
+	}
+	if targets, _ := nm.GetEnvironmentTargets(); !targets["PIFI_TEST_T"].equal(target) {
+		t.Errorf("target after rollback = %+v", targets["PIFI_TEST_T"])
+	}
+}
+
+func TestEnvironmentTargetUnreadable(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	if err := os.WriteFile(path, []byte("{not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	nm := &networkManager{opts: Options{
+		EnvSchemaFile: filepath.Join(dir, "schema.yaml"),
+		State:         state.New(path, state.Legacy{}),
+	}}
+
+	// Without the target the variable could be written to the wrong file, so nothing is written
+	if err := nm.SetEnvironmentVariable("PIFI_TEST_U", "1"); err == nil {
+		t.Error("SetEnvironmentVariable succeeded with an unreadable state")
+	}
+	if err := nm.UnsetEnvironmentVariable("PIFI_TEST_U"); err == nil {
+		t.Error("UnsetEnvironmentVariable succeeded with an unreadable state")
+	}
+	if err := nm.ValidateEnvironmentVariable("PIFI_TEST_U", "1"); err == nil {
+		t.Error("ValidateEnvironmentVariable succeeded with an unreadable state")
+	}
+}
@@ -0,0 +1,303 @@
+package networkmanager
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/ztkent/pifi/filestore"
+	"github.com/ztkent/pifi/state"
+)
+
+// EnvDiff is what importing a .env file changes, each list is sorted by key
+type EnvDiff struct {
+	Added     []EnvChange `json:"added"`
+	Changed   []EnvChange `json:"changed"`
+	Removed   []EnvChange `json:"removed"`
+	Unchanged []string    `json:"unchanged"`
+}
+
+// EnvChange is one variable of an EnvDiff, Old is empty for added variables and New for removed ones
+type EnvChange struct {
+	Key    string `json:"key"`
+	Old    string `json:"old,omitempty"`
+	New    string `json:"new,omitempty"`
+	Secret bool   `json:"secret,omitempty"`
+}
+
+// ParseEnv parses a .env file like the environment files PiFi manages. Lines that are neither
+// assignments nor comments are returned as ignored.
+func ParseEnv(data string) (vars map[string]string, ignored []string) {
+	// Files edited on Windows would otherwise keep a carriage return in every unquoted value
+	env := parseEnvFile(strings.ReplaceAll(data, "\r\n", "\n"))
+	for _, e := range env.entries {
+		if line := strings.TrimSpace(e.raw); e.key == "" && line != "" && !strings.HasPrefix(line, "#") {
+			ignored = append(ignored, line)
+		}
+	}
+	return env.Vars(), ignored
+}
+
+// FormatEnv writes vars as a .env file sorted by key. The keys in omitted are listed in comments
+// without their values.
+func FormatEnv(vars map[string]string, omitted []string) []byte {
+	keys := make([]string, 0, len(vars))
+	for key := range vars {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	env := parseEnvFile("# Environment variables managed by PiFi\n")
+	for _, key := range keys {
+		env.Set(key, vars[key])
+	}
+	out := env.String()
+	for _, key := range omitted {
+		out += "# " + key + " is a secret, its value isn't exported\n"
+	}
+	return []byte(out)
+}
+
+// DiffEnv compares imported variables to the current ones. Variables missing from imported are
+// only removed with replace.
+func DiffEnv(current, imported map[string]string, replace bool) EnvDiff {
+	diff := EnvDiff{Added: []EnvChange{}, Changed: []EnvChange{}, Removed: []EnvChange{}, Unchanged: []string{}}
+	for key, value := range imported {
+		old, ok := current[key]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, EnvChange{Key: key, New: value})
+		case old != value:
+			diff.Changed = append(diff.Changed, EnvChange{Key: key, Old: old, New: value})
+		default:
+			diff.Unchanged = append(diff.Unchanged, key)
+		}
+	}
+	if replace {
+		for key, old := range current {
+			if _, ok := imported[key]; !ok {
+				diff.Removed = append(diff.Removed, EnvChange{Key: key, Old: old})
+			}
+		}
+	}
+
+	byKey := func(a, b EnvChange) int { return strings.Compare(a.Key, b.Key) }
+	slices.SortFunc(diff.Added, byKey)
+	slices.SortFunc(diff.Changed, byKey)
+	slices.SortFunc(diff.Removed, byKey)
+	sort.Strings(diff.Unchanged)
+	return diff
+}
+
+// EnvFingerprint identifies a set of variables, so a change planned against them can detect
+// that they changed in the meantime. It is keyed with the device key, so it can be handed to
+// clients without letting them guess the values of secrets.
+func (nm *networkManager) EnvFingerprint(vars map[string]string) (string, error) {
+	key, err := loadDeviceKey(nm.opts.DeviceKeyFile)
+	if err != nil {
+		return "", err
+	}
+	keys := make([]string, 0, len(vars))
+	for key := range vars {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	h := hmac.New(sha256.New, key)
+	for _, key := range keys {
+		fmt.Fprintf(h, "%s=%s\x00", key, vars[key])
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fileSnapshot is the contents of a file before ApplyEnvironment changed it, nil if it didn't exist
+type fileSnapshot struct {
+	path string
+	data []byte
+	perm os.FileMode
+}
+
+// ApplyEnvironment sets and unsets several variables at once. Every value is validated first,
+// then each file is rewritten once. If a write fails, the files already written are restored,
+// so either every change is applied or none. Secrets stay secrets.
+func (nm *networkManager) ApplyEnvironment(set map[string]string, unset []string) error {
+	return nm.applyEnvironment(set, unset, nil)
+}
+
+// applyEnvironment is ApplyEnvironment, also making the variables in secrets secret
+func (nm *networkManager) applyEnvironment(set map[string]string, unset []string, secrets []string) error {
+	schema, err := nm.GetEnvironmentSchema()
+	if err != nil {
+		return err
+	}
+	for key, value := range set {
+		if !validEnvKey(key) {
+			return fmt.Errorf("invalid environment variable key %q, use letters, digits and underscores", key)
+		}
+		if err := schema.Validate(key, value); err != nil {
+			return err
+		}
+	}
+	for _, key := range unset {
+		if !validEnvKey(key) {
+			return fmt.Errorf("invalid environment variable key %q, use letters, digits and underscores", key)
+		}
+		if _, ok := set[key]; ok {
+			return fmt.Errorf("environment variable %s is both set and unset", key)
+		}
+	}
+	if len(set) == 0 && len(unset) == 0 {
+		return nil
+	}
+
+	managed, err := nm.readManagedEnvVars()
+	if err != nil {
+		return err
+	}
+	isSecret := func(key string) bool {
+		v, ok := schema.Lookup(key)
+		return slices.Contains(managed.Secrets, key) || slices.Contains(secrets, key) || ok && v.Secret
+	}
+	old, _ := nm.envSnapshot()
+
+	// Group the changes by the file they are written to
+	fileSets := map[string]map[string]string{}
+	fileUnsets := map[string][]string{}
+	sealed := map[string]*string{}
+	for key, value := range set {
+		file := managed.Targets[key].envFile()
+		if isSecret(key) && nm.opts.EncryptSecrets {
+			value := value
+			sealed[key] = &value
+			fileUnsets[file] = append(fileUnsets[file], key)
+			continue
+		}
+		if err := checkEnvFileValue(file, key, value); err != nil {
+			return err
+		}
+		if fileSets[file] == nil {
+			fileSets[file] = map[string]string{}
+		}
+		fileSets[file][key] = value
+		sealed[key] = nil
+	}
+	for _, key := range unset {
+		file := managed.Targets[key].envFile()
+		fileUnsets[file] = append(fileUnsets[file], key)
+		sealed[key] = nil
+	}
+
+	var written []fileSnapshot
+	rollback := func(cause error) error {
+		for i := len(written) - 1; i >= 0; i-- {
+			s := written[i]
+			var err error
+			if s.data == nil {
+				err = os.Remove(s.path)
+			} else {
+				err = filestore.Revert(s.path, s.data, s.perm)
+			}
+			if err != nil {
+				log.Printf("Warning: failed to restore %s: %v", s.path, err)
+			}
+		}
+		return cause
+	}
+	// write applies update to path, remembering the old contents for rollback
+	write := func(path string, perm os.FileMode, update func([]byte) ([]byte, error)) error {
+		return filestore.Update(path, perm, func(old []byte) ([]byte, error) {
+			data, err := update(old)
+			if err == nil && string(data) != string(old) {
+				if info, statErr := os.Stat(path); statErr == nil {
+					perm = info.Mode().Perm()
+				}
+				written = append(written, fileSnapshot{path: path, data: old, perm: perm})
+			}
+			return data, err
+		})
+	}
+
+	files := make([]string, 0, len(fileSets)+len(fileUnsets))
+	for file := range fileSets {
+		files = append(files, file)
+	}
+	for file := range fileUnsets {
+		if !slices.Contains(files, file) {
+			files = append(files, file)
+		}
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		err := write(file, 0644, func(data []byte) ([]byte, error) {
+			env := parseEnvFileAt(file, string(data))
+			for key, value := range fileSets[file] {
+				env.Set(key, value)
+			}
+			for _, key := range fileUnsets[file] {
+				env.Unset(key)
+			}
+			return []byte(env.String()), nil
+		})
+		if err != nil {
+			return rollback(fmt.Errorf("failed to write %s: %v", file, err))
+		}
+	}
+
+	// The secrets and the managed list are changed together, the files are restored if that fails
+	update, err := nm.secretStoreUpdate(sealed)
+	if err != nil {
+		return rollback(err)
+	}
+	err = nm.opts.State.Update(func(tx *state.Tx) error {
+		if err := update(tx); err != nil {
+			return err
+		}
+		return updateManagedEnv(tx, func(managed *ManagedEnvVars) {
+			for key := range set {
+				if !slices.Contains(managed.Variables, key) {
+					managed.Variables = append(managed.Variables, key)
+				}
+				if isSecret(key) && !slices.Contains(managed.Secrets, key) {
+					managed.Secrets = append(managed.Secrets, key)
+				}
+			}
+			isUnset := func(v string) bool { return slices.Contains(unset, v) }
+			managed.Variables = slices.DeleteFunc(managed.Variables, isUnset)
+			managed.Secrets = slices.DeleteFunc(managed.Secrets, isUnset)
+		})
+	})
+	if err != nil {
+		return rollback(fmt.Errorf("failed to update managed list: %v", err))
+	}
+
+	for _, values := range fileSets {
+		for key, value := range values {
+			os.Setenv(key, value)
+		}
+	}
+	for _, key := range unset {
+		os.Unsetenv(key)
+	}
+	if err := nm.ApplyEnvironmentSecrets(); err != nil {
+		return fmt.Errorf("failed to apply secrets: %v", err)
+	}
+
+	changes := make([]envChange, 0, len(set)+len(unset))
+	for key, value := range set {
+		changes = append(changes, envChange{key: key, old: lookup(old, key), new: &value, secret: isSecret(key)})
+	}
+	for _, key := range unset {
+		changes = append(changes, envChange{key: key, old: lookup(old, key), secret: isSecret(key)})
+	}
+	slices.SortFunc(changes, func(a, b envChange) int { return strings.Compare(a.key, b.key) })
+	nm.recordEnvChanges(changes)
+
+	log.Printf("Environment updated, %d variables set and %d unset", len(set), len(unset))
+	return nil
+}
@@ -0,0 +1,122 @@
+package networkmanager
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ztkent/pifi/filestore"
+	"github.com/ztkent/pifi/state"
+)
+
+func TestFormatEnvRoundTrip(t *testing.T) {
+	vars := map[string]string{
+		"PLAIN":  "value",
+		"SPACES": "two words",
+		"QUOTES": `say "hi" it's $HOME`,
+		"EMPTY":  "",
+		"LINES":  "first\nsecond",
+	}
+	data := FormatEnv(vars, []string{"SECRET"})
+	parsed, ignored := ParseEnv(string(data))
+	if !maps.Equal(parsed, vars) || len(ignored) != 0 {
+		t.Errorf("ParseEnv(FormatEnv) = %v, ignored %v, want %v\n%s", parsed, ignored, vars, data)
+	}
+
+	if vars, ignored := ParseEnv("A=1\r\nnot an assignment\r\n# comment\r\n"); vars["A"] != "1" || len(ignored) != 1 {
+		t.Errorf("ParseEnv with CRLF = %q, ignored %q", vars, ignored)
+	}
+}
+
+func TestDiffEnv(t *testing.T) {
+	current := map[string]string{"SAME": "1", "CHANGED": "old", "GONE": "x"}
+	imported := map[string]string{"SAME": "1", "CHANGED": "new", "ADDED": "y"}
+
+	diff := DiffEnv(current, imported, false)
+	if len(diff.Added) != 1 || diff.Added[0].Key != "ADDED" || len(diff.Changed) != 1 || diff.Changed[0].Old != "old" ||
+		len(diff.Removed) != 0 || len(diff.Unchanged) != 1 {
+		t.Errorf("merge diff = %+v", diff)
+	}
+	if diff := DiffEnv(current, imported, true); len(diff.Removed) != 1 || diff.Removed[0].Key != "GONE" {
+		t.Errorf("replace diff removed %+v, want GONE", diff.Removed)
+	}
+}
+
+func TestApplyEnvironmentRollsBack(t *testing.T) {
+	dir := t.TempDir()
+	fileA, fileB := filepath.Join(dir, "a.env"), filepath.Join(dir, "b.env")
+	managed := ManagedEnvVars{
+		Variables: []string{"PIFI_TEST_A", "PIFI_TEST_B"},
+		Targets:   map[string]EnvTarget{"PIFI_TEST_A": {File: fileA}, "PIFI_TEST_B": {File: fileB}},
+	}
+	nm := &networkManager{opts: Options{
+		EnvSchemaFile: filepath.Join(dir, "schema.yaml"),
+		State:         testState(t, managed),
+	}}
+	if err := os.WriteFile(fileA, []byte("# keep me\nPIFI_TEST_A=1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PIFI_TEST_A", "")
+	t.Setenv("PIFI_TEST_B", "")
+
+	// The stored secrets are invalid, so the files written before the state are restored
+	invalid := func(tx *state.Tx) error { return tx.Set(state.SectionEnvSecrets, 5) }
+	if err := nm.opts.State.Update(invalid); err != nil {
+		t.Fatal(err)
+	}
+	if err := nm.ApplyEnvironment(map[string]string{"PIFI_TEST_A": "2", "PIFI_TEST_B": "3"}, nil); err == nil {
+		t.Fatal("ApplyEnvironment succeeded with invalid stored secrets")
+	}
+	if data, _ := os.ReadFile(fileA); string(data) != "# keep me\nPIFI_TEST_A=1\n" {
+		t.Errorf("a.env after rollback = %q", data)
+	}
+	// The backup isn't replaced by the version that was rolled back
+	if data, _ := os.ReadFile(fileA + filestore.BackupSuffix); string(data) != "# keep me\nPIFI_TEST_A=1\n" {
+		t.Errorf("a.env.bak after rollback = %q", data)
+	}
+	if _, err := os.Stat(fileB); !os.IsNotExist(err) {
+		t.Errorf("b.env exists after rollback: %v", err)
+	}
+
+	nm.opts.State.Update(func(tx *state.Tx) error { tx.Delete(state.SectionEnvSecrets); return nil })
+	if err := nm.ApplyEnvironment(map[string]string{"PIFI_TEST_B": "3"}, []string{"PIFI_TEST_A"}); err != nil {
+		t.Fatal(err)
+	}
+	if vars, _ := readEnvFile(fileA); len(vars) != 0 {
+		t.Errorf("a.env = %v, want PIFI_TEST_A unset", vars)
+	}
+	if vars, _ := readEnvFile(fileB); vars["PIFI_TEST_B"] != "3" {
+		t.Errorf("b.env = %v, want PIFI_TEST_B=3", vars)
+	}
+	if managed, _ := nm.readManagedEnvVars(); len(managed.Variables) != 1 || managed.Variables[0] != "PIFI_TEST_B" {
+		t.Errorf("managed list = %v, want [PIFI_TEST_B]", managed.Variables)
+	}
+}
+
+func TestEnvFingerprint(t *testing.T) {
+	dir := t.TempDir()
+	device := &networkManager{opts: Options{DeviceKeyFile: filepath.Join(dir, "device.key")}}
+	other := &networkManager{opts: Options{DeviceKeyFile: filepath.Join(dir, "other.key")}}
+	fingerprint := func(nm *networkManager, vars map[string]string) string {
+		t.Helper()
+		f, err := nm.EnvFingerprint(vars)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+
+	vars := map[string]string{"A": "1", "TOKEN": "secret"}
+	base := fingerprint(device, vars)
+	if base != fingerprint(device, map[string]string{"TOKEN": "secret", "A": "1"}) {
+		t.Error("fingerprint of the same variables changed")
+	}
+	if base == fingerprint(device, map[string]string{"A": "1", "TOKEN": "guess"}) {
+		t.Error("fingerprint didn't change with a value")
+	}
+	// Without the device key the fingerprint can't be recomputed to guess values
+	if base == fingerprint(other, vars) {
+		t.Error("fingerprint doesn't depend on the device key")
+	}
+}
@@ -0,0 +1,219 @@
+package networkmanager
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Types of a variable in the environment schema
+const (
+	EnvTypeString = "string"
+	EnvTypeInt    = "int"
+	EnvTypeFloat  = "float"
+	EnvTypeBool   = "bool"
+	EnvTypeURL    = "url"
+)
+
+var envTypes = []string{EnvTypeString, EnvTypeInt, EnvTypeFloat, EnvTypeBool, EnvTypeURL}
+
+// EnvSchema declares the variables an application on the device needs. It is loaded from
+// Options.EnvSchemaFile, without the file every variable is free-form.
+type EnvSchema struct {
+	// Strict rejects variables that aren't in the schema
+	Strict    bool           `yaml:"strict" json:"strict"`
+	Variables []EnvSchemaVar `yaml:"variables" json:"variables"`
+}
+
+// EnvSchemaVar declares one variable, the dashboard renders a typed input for it
+type EnvSchemaVar struct {
+	Key         string   `yaml:"key" json:"key"`
+	Type        string   `yaml:"type" json:"type"` // string if empty
+	Description string   `yaml:"description" json:"description,omitempty"`
+	Default     string   `yaml:"default" json:"default,omitempty"` // Suggested in the dashboard, not applied
+	Required    bool     `yaml:"required" json:"required,omitempty"`
+	Enum        []string `yaml:"enum" json:"enum,omitempty"`
+	Regex       string   `yaml:"regex" json:"regex,omitempty"` // Must match the whole value
+	Secret      bool     `yaml:"secret" json:"secret,omitempty"`
+}
+
+// EnvValidationError is returned when a value doesn't match the schema
+type EnvValidationError struct {
+	Key    string `json:"key"`
+	Reason string `json:"reason"`
+}
+
+func (e *EnvValidationError) Error() string {
+	return fmt.Sprintf("invalid value for %s: %s", e.Key, e.Reason)
+}
+
+// loadEnvSchema reads the schema at path, a missing file is an empty schema
+func loadEnvSchema(path string) (*EnvSchema, error) {
+	schema := &EnvSchema{}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return schema, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, schema); err != nil {
+		return nil, fmt.Errorf("failed to parse environment schema %s: %v", path, err)
+	}
+	if err := schema.check(); err != nil {
+		return nil, fmt.Errorf("invalid environment schema %s: %v", path, err)
+	}
+	return schema, nil
+}
+
+// check reports mistakes in the schema itself, so they aren't mistaken for invalid values
+func (s *EnvSchema) check() error {
+	var errs []error
+	seen := map[string]bool{}
+	for i := range s.Variables {
+		v := &s.Variables[i]
+		if v.Type == "" {
+			v.Type = EnvTypeString
+		}
+		switch {
+		case !validEnvKey(v.Key):
+			errs = append(errs, fmt.Errorf("invalid key %q", v.Key))
+			continue
+		case seen[v.Key]:
+			errs = append(errs, fmt.Errorf("%s is declared twice", v.Key))
+		case !slices.Contains(envTypes, v.Type):
+			errs = append(errs, fmt.Errorf("%s has unknown type %q", v.Key, v.Type))
+		}
+		seen[v.Key] = true
+		if v.Regex != "" {
+			if _, err := regexp.Compile(v.Regex); err != nil {
+				errs = append(errs, fmt.Errorf("%s has an invalid regex: %v", v.Key, err))
+				continue
+			}
+		}
+		if v.Default != "" {
+			if err := v.Validate(v.Default); err != nil {
+				errs = append(errs, fmt.Errorf("default of %s: %v", v.Key, err.(*EnvValidationError).Reason))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Lookup returns the declaration of key
+func (s *EnvSchema) Lookup(key string) (EnvSchemaVar, bool) {
+	for _, v := range s.Variables {
+		if v.Key == key {
+			return v, true
+		}
+	}
+	return EnvSchemaVar{}, false
+}
+
+// Validate checks value against the declaration of key. Undeclared keys are only rejected by a strict schema.
+func (s *EnvSchema) Validate(key, value string) error {
+	v, ok := s.Lookup(key)
+	if !ok {
+		if s.Strict {
+			return &EnvValidationError{Key: key, Reason: "not declared in the environment schema"}
+		}
+		return nil
+	}
+	return v.Validate(value)
+}
+
+// Missing returns the required variables that aren't set in vars
+func (s *EnvSchema) Missing(vars map[string]string) []string {
+	var missing []string
+	for _, v := range s.Variables {
+		if _, ok := vars[v.Key]; v.Required && !ok {
+			missing = append(missing, v.Key)
+		}
+	}
+	return missing
+}
+
+// Validate checks value against the type, enum and regex of the variable
+func (v EnvSchemaVar) Validate(value string) error {
+	invalid := func(format string, args ...interface{}) error {
+		return &EnvValidationError{Key: v.Key, Reason: fmt.Sprintf(format, args...)}
+	}
+	if value == "" {
+		if v.Required {
+			return invalid("a value is required")
+		}
+		return nil
+	}
+
+	switch v.Type {
+	case EnvTypeInt:
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			return invalid("%q is not an integer", value)
+		}
+	case EnvTypeFloat:
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return invalid("%q is not a number", value)
+		}
+	case EnvTypeBool:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return invalid("%q is not true or false", value)
+		}
+	case EnvTypeURL:
+		if u, err := url.Parse(value); err != nil || u.Scheme == "" || u.Host == "" {
+			return invalid("%q is not an absolute URL", value)
+		}
+	}
+	if len(v.Enum) > 0 && !slices.Contains(v.Enum, value) {
+		return invalid("%q is not one of %v", value, v.Enum)
+	}
+	if v.Regex != "" {
+		re, err := regexp.Compile(`^(?:` + v.Regex + `)$`)
+		if err != nil {
+			return invalid("the schema regex is invalid: %v", err)
+		}
+		if !re.MatchString(value) {
+			return invalid("%q doesn't match %s", value, v.Regex)
+		}
+	}
+	return nil
+}
+
+// GetEnvironmentSchema returns the environment schema, it is read again on every call so edits apply immediately
+func (nm *networkManager) GetEnvironmentSchema() (*EnvSchema, error) {
+	return loadEnvSchema(nm.opts.EnvSchemaFile)
+}
+
+// ValidateEnvironmentVariable checks a value against the environment schema, and that its target
+// file can hold it, without setting it
+func (nm *networkManager) ValidateEnvironmentVariable(key, value string) error {
+	if !validEnvKey(key) {
+		return fmt.Errorf("invalid environment variable key %q, use letters, digits and underscores", key)
+	}
+	schema, err := nm.GetEnvironmentSchema()
+	if err != nil {
+		return err
+	}
+	if err := schema.Validate(key, value); err != nil {
+		return err
+	}
+	if nm.opts.EncryptSecrets {
+		// Encrypted secrets are written to the secret env file instead
+		secrets, err := nm.GetEnvironmentSecrets()
+		if err != nil {
+			return err
+		}
+		if v, ok := schema.Lookup(key); ok && v.Secret || slices.Contains(secrets, key) {
+			return nil
+		}
+	}
+	target, err := nm.envTarget(key)
+	if err != nil {
+		return err
+	}
+	return checkEnvFileValue(target.envFile(), key, value)
+}
@@ -0,0 +1,87 @@
+package networkmanager
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+const testSchema = `
+strict: true
+variables:
+  - key: MQTT_HOST
+    description: Broker hostname
+    required: true
+    regex: '[a-z0-9.-]+'
+  - key: SAMPLE_RATE_HZ
+    type: int
+    default: "10"
+  - key: LOG_LEVEL
+    enum: [debug, info, warn]
+  - key: UPLOAD
+    type: bool
+  - key: API_URL
+    type: url
+`
+
+func TestEnvSchemaValidate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "env_schema.yaml")
+	if err := os.WriteFile(path, []byte(testSchema), 0644); err != nil {
+		t.Fatal(err)
+	}
+	schema, err := loadEnvSchema(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key, value string
+		valid      bool
+	}{
+		{"MQTT_HOST", "broker.local", true},
+		{"MQTT_HOST", "Broker Local", false},
+		{"MQTT_HOST", "", false},
+		{"SAMPLE_RATE_HZ", "250", true},
+		{"SAMPLE_RATE_HZ", "2.5", false},
+		{"SAMPLE_RATE_HZ", "", true},
+		{"LOG_LEVEL", "info", true},
+		{"LOG_LEVEL", "trace", false},
+		{"UPLOAD", "false", true},
+		{"UPLOAD", "yes", false},
+		{"API_URL", "https://example.com/v1", true},
+		{"API_URL", "example.com", false},
+		{"MQTT_HOTS", "typo", false},
+	}
+	for _, tt := range tests {
+		if err := schema.Validate(tt.key, tt.value); (err == nil) != tt.valid {
+			t.Errorf("Validate(%s, %q) = %v, want valid %v", tt.key, tt.value, err, tt.valid)
+		}
+	}
+
+	if missing := schema.Missing(map[string]string{"SAMPLE_RATE_HZ": "10"}); !slices.Equal(missing, []string{"MQTT_HOST"}) {
+		t.Errorf("Missing = %v, want [MQTT_HOST]", missing)
+	}
+}
+
+func TestEnvSchemaCheck(t *testing.T) {
+	for _, schema := range []string{
+		"variables: [{key: A, type: integer}]",
+		"variables: [{key: A}, {key: A}]",
+		"variables: [{key: 1A}]",
+		"variables: [{key: A, regex: '('}]",
+		"variables: [{key: A, type: int, default: ten}]",
+	} {
+		path := filepath.Join(t.TempDir(), "env_schema.yaml")
+		if err := os.WriteFile(path, []byte(schema), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadEnvSchema(path); err == nil {
+			t.Errorf("loadEnvSchema(%s) succeeded, want an error", schema)
+		}
+	}
+
+	if schema, err := loadEnvSchema(filepath.Join(t.TempDir(), "missing.yaml")); err != nil || len(schema.Variables) != 0 {
+		t.Errorf("missing schema = %+v, %v, want an empty schema", schema, err)
+	}
+}
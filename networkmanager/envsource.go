@@ -0,0 +1,166 @@
+package networkmanager
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// EnvSourceSecretStore is the source of secrets kept encrypted with EncryptSecrets
+const EnvSourceSecretStore = "secret store"
+
+// EnvProcessPiFi names PiFi's own process in an EnvDrift
+const EnvProcessPiFi = "pifi"
+
+// EnvProvenance is where the value of a managed variable was read from, and the running
+// processes that have a different value than the one on disk
+type EnvProvenance struct {
+	Source string     `json:"source,omitempty"` // File the value was read from, EnvSourceSecretStore, or empty if it isn't set
+	Drift  []EnvDrift `json:"drift,omitempty"`
+}
+
+// EnvDrift is a running process whose value of a variable differs from the one on disk, until it restarts
+type EnvDrift struct {
+	Process string  `json:"process"` // EnvProcessPiFi or a unit the variable restarts
+	Value   *string `json:"value"`   // nil if the variable isn't set in the process
+}
+
+// readEnvironment returns the value of every managed variable that is set, and where it was read from.
+// Encrypted secrets come from the secret store, other variables from their target file, or else
+// from the first of Options.EnvSources that sets them.
+func (nm *networkManager) readEnvironment() (map[string]string, map[string]string, error) {
+	managed, err := nm.readManagedEnvVars()
+	if err != nil {
+		return nil, nil, err
+	}
+	vars, sources := map[string]string{}, map[string]string{}
+	if len(managed.Variables) == 0 {
+		return vars, sources, nil
+	}
+
+	var secrets map[string]string
+	if nm.opts.EncryptSecrets {
+		if secrets, err = nm.readSecretStore(); err != nil {
+			return nil, nil, err
+		}
+	}
+	// Each file is read once, missing files set nothing
+	files := map[string]map[string]string{}
+	read := func(file string) map[string]string {
+		if _, ok := files[file]; !ok {
+			files[file], _ = readEnvFile(file)
+		}
+		return files[file]
+	}
+
+	for _, key := range managed.Variables {
+		if value, ok := secrets[key]; ok {
+			vars[key], sources[key] = value, EnvSourceSecretStore
+			continue
+		}
+		for _, file := range append([]string{managed.Targets[key].envFile()}, nm.opts.EnvSources...) {
+			if value, ok := read(file)[key]; ok {
+				vars[key], sources[key] = value, file
+				break
+			}
+		}
+	}
+	return vars, sources, nil
+}
+
+// GetEnvironmentProvenance returns where each managed variable was read from, and the running
+// processes with a different value: PiFi itself, and the units the variable restarts.
+// Values of secrets in the drift are returned in full and must be masked by callers.
+func (nm *networkManager) GetEnvironmentProvenance() (map[string]EnvProvenance, error) {
+	managed, err := nm.readManagedEnvVars()
+	if err != nil {
+		return nil, err
+	}
+	vars, sources, err := nm.readEnvironment()
+	if err != nil {
+		return nil, err
+	}
+
+	units := map[string]map[string]string{}
+	provenance := make(map[string]EnvProvenance, len(managed.Variables))
+	for _, key := range managed.Variables {
+		p := EnvProvenance{Source: sources[key]}
+		value, set := vars[key]
+		differs := func(process string, env map[string]string) {
+			running, ok := env[key]
+			if ok != set || running != value {
+				drift := EnvDrift{Process: process}
+				if ok {
+					drift.Value = &running
+				}
+				p.Drift = append(p.Drift, drift)
+			}
+		}
+
+		differs(EnvProcessPiFi, processEnv())
+		for _, unit := range managed.Targets[key].Restart {
+			if _, ok := units[unit]; !ok {
+				units[unit] = unitEnv(unit)
+			}
+			// Units that aren't running pick up the value when they start
+			if units[unit] != nil {
+				differs(unit, units[unit])
+			}
+		}
+		provenance[key] = p
+	}
+	return provenance, nil
+}
+
+// LoadEnvironment sets the managed variables in PiFi's own environment from the files they are written to.
+// Services don't read /etc/environment, this keeps PiFi's view the same as the files when it starts.
+func (nm *networkManager) LoadEnvironment() error {
+	vars, _, err := nm.readEnvironment()
+	if err != nil {
+		return err
+	}
+	for key, value := range vars {
+		os.Setenv(key, value)
+	}
+	return nm.ApplyEnvironmentSecrets()
+}
+
+// processEnv returns the environment of the PiFi process
+func processEnv() map[string]string {
+	env := map[string]string{}
+	for _, pair := range os.Environ() {
+		if key, value, ok := strings.Cut(pair, "="); ok {
+			env[key] = value
+		}
+	}
+	return env
+}
+
+// unitEnv returns the environment of the main process of a running unit, nil if it isn't running or can't be read
+func unitEnv(unit string) map[string]string {
+	ctx, cancel := context.WithTimeout(context.Background(), unitTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, "systemctl", "show", "--property=MainPID", "--value", unit).Output()
+	if err != nil {
+		return nil
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(output)))
+	if err != nil || pid == 0 {
+		return nil
+	}
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/environ", pid))
+	if err != nil {
+		return nil
+	}
+	env := map[string]string{}
+	for _, pair := range bytes.Split(data, []byte{0}) {
+		if key, value, ok := strings.Cut(string(pair), "="); ok {
+			env[key] = value
+		}
+	}
+	return env
+}
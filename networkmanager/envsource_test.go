@@ -0,0 +1,64 @@
+package networkmanager
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnvironmentProvenance(t *testing.T) {
+	dir := t.TempDir()
+	target, legacy := filepath.Join(dir, "app.env"), filepath.Join(dir, "pifi")
+	managed := ManagedEnvVars{
+		Variables: []string{"PIFI_TEST_A", "PIFI_TEST_B", "PIFI_TEST_C"},
+		Targets:   map[string]EnvTarget{"PIFI_TEST_A": {File: target}, "PIFI_TEST_B": {File: target}, "PIFI_TEST_C": {File: target}},
+	}
+	nm := &networkManager{opts: Options{
+		EnvSources: []string{legacy},
+		State:      testState(t, managed),
+	}}
+	files := map[string]string{
+		target: "PIFI_TEST_A=disk\n",
+		legacy: "PIFI_TEST_A=legacy\nPIFI_TEST_B=legacy\n",
+	}
+	for file, content := range files {
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PIFI_TEST_A", "")
+	t.Setenv("PIFI_TEST_B", "")
+	t.Setenv("PIFI_TEST_C", "process only")
+
+	// The target file wins over the sources, values only in the process aren't read
+	vars, err := nm.GetEnvironmentVariables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vars) != 2 || vars["PIFI_TEST_A"] != "disk" || vars["PIFI_TEST_B"] != "legacy" {
+		t.Errorf("variables = %v, want PIFI_TEST_A from the target and PIFI_TEST_B from the source", vars)
+	}
+
+	provenance, err := nm.GetEnvironmentProvenance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := provenance["PIFI_TEST_A"]; p.Source != target || len(p.Drift) != 1 || *p.Drift[0].Value != "" {
+		t.Errorf("provenance of PIFI_TEST_A = %+v, want %s with drift", p, target)
+	}
+	if p := provenance["PIFI_TEST_B"]; p.Source != legacy {
+		t.Errorf("source of PIFI_TEST_B = %q, want %s", p.Source, legacy)
+	}
+	if p := provenance["PIFI_TEST_C"]; p.Source != "" || len(p.Drift) != 1 || *p.Drift[0].Value != "process only" {
+		t.Errorf("provenance of PIFI_TEST_C = %+v, want unset with drift", p)
+	}
+
+	// Loading sets the values on disk in the process, variables only in the process keep drifting
+	if err := nm.LoadEnvironment(); err != nil {
+		t.Fatal(err)
+	}
+	provenance, _ = nm.GetEnvironmentProvenance()
+	if len(provenance["PIFI_TEST_A"].Drift) != 0 || len(provenance["PIFI_TEST_B"].Drift) != 0 || len(provenance["PIFI_TEST_C"].Drift) != 1 {
+		t.Errorf("provenance after LoadEnvironment = %+v", provenance)
+	}
+}
@@ -0,0 +1,207 @@
+package networkmanager
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Environment files other than /etc/environment must be in this directory, such as /etc/default/myapp
+const envTargetDir = "/etc/default"
+
+const unitTimeout = time.Minute
+
+var unitPattern = regexp.MustCompile(`^[A-Za-z0-9:_.@\\-]+$`)
+
+// EnvTarget is where a managed variable is written and which systemd units read it.
+// Most services never re-read /etc/environment, write to the file named by their EnvironmentFile= instead.
+type EnvTarget struct {
+	File    string   `json:"file,omitempty"`    // Environment file, /etc/environment if empty
+	Restart []string `json:"restart,omitempty"` // Units restarted after the variable changes
+	Reload  []string `json:"reload,omitempty"`  // Units reloaded after the variable changes
+}
+
+// UnitResult is the outcome of restarting or reloading a unit after an environment change
+type UnitResult struct {
+	Unit   string `json:"unit"`
+	Action string `json:"action"` // restart or reload
+	Error  string `json:"error,omitempty"`
+}
+
+// String describes the target for the environment history, e.g. "/etc/default/myapp, restart myapp.service"
+func (t EnvTarget) String() string {
+	parts := []string{t.envFile()}
+	if len(t.Restart) > 0 {
+		parts = append(parts, "restart "+strings.Join(t.Restart, " "))
+	}
+	if len(t.Reload) > 0 {
+		parts = append(parts, "reload "+strings.Join(t.Reload, " "))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// equal reports whether both targets write to the same file and name the same units
+func (t EnvTarget) equal(o EnvTarget) bool {
+	return t.envFile() == o.envFile() && slices.Equal(t.Restart, o.Restart) && slices.Equal(t.Reload, o.Reload)
+}
+
+// envFile returns the file the target writes to
+func (t EnvTarget) envFile() string {
+	if t.File == "" {
+		return systemEnvFile
+	}
+	return t.File
+}
+
+// validateEnvTarget checks that the target writes to an environment file and names valid units
+func (nm *networkManager) validateEnvTarget(t EnvTarget) error {
+	if t.File != "" {
+		if filepath.Dir(t.File) != envTargetDir || strings.HasPrefix(filepath.Base(t.File), ".") {
+			return fmt.Errorf("environment file %q must be %s or in %s", t.File, systemEnvFile, envTargetDir)
+		}
+		// Files of earlier versions of PiFi, moved into the state file
+		if strings.HasPrefix(filepath.Base(t.File), "pifi_") {
+			return fmt.Errorf("environment file %q is used by PiFi", t.File)
+		}
+	}
+	for _, unit := range append(slices.Clone(t.Restart), t.Reload...) {
+		if !unitPattern.MatchString(unit) || strings.HasPrefix(unit, "-") {
+			return fmt.Errorf("invalid unit name %q", unit)
+		}
+	}
+	return nil
+}
+
+// envTarget returns the target of key, the zero target writes to /etc/environment.
+// It fails if the state can't be read, rather than falling back to /etc/environment.
+func (nm *networkManager) envTarget(key string) (EnvTarget, error) {
+	managed, err := nm.readManagedEnvVars()
+	if err != nil {
+		return EnvTarget{}, err
+	}
+	return managed.Targets[key], nil
+}
+
+// GetEnvironmentTargets returns the targets of variables not written to /etc/environment or with units
+func (nm *networkManager) GetEnvironmentTargets() (map[string]EnvTarget, error) {
+	managed, err := nm.readManagedEnvVars()
+	if err != nil {
+		return nil, err
+	}
+	if managed.Targets == nil {
+		return map[string]EnvTarget{}, nil
+	}
+	return managed.Targets, nil
+}
+
+// SetEnvironmentTarget changes where key is written and which units depend on it. The current value
+// is moved to the new file, units are only restarted by RestartEnvironmentUnits. The change is
+// recorded in the environment history.
+func (nm *networkManager) SetEnvironmentTarget(key string, target EnvTarget) error {
+	if !validEnvKey(key) {
+		return fmt.Errorf("invalid environment variable key %q, use letters, digits and underscores", key)
+	}
+	if target.File == systemEnvFile {
+		target.File = ""
+	}
+	if err := nm.validateEnvTarget(target); err != nil {
+		return err
+	}
+
+	old, err := nm.envTarget(key)
+	if err != nil {
+		return err
+	}
+	vars, err := nm.GetEnvironmentVariables()
+	if err != nil {
+		return err
+	}
+	secrets, err := nm.GetEnvironmentSecrets()
+	if err != nil {
+		return err
+	}
+	// Encrypted secrets only live in the secret env file
+	inFile := !(nm.opts.EncryptSecrets && slices.Contains(secrets, key))
+	if value, ok := vars[key]; ok && inFile && old.envFile() != target.envFile() {
+		if err := setFileEnv(target.envFile(), key, value); err != nil {
+			return fmt.Errorf("failed to write %s: %v", target.envFile(), err)
+		}
+		if err := removeFileEnv(old.envFile(), key); err != nil {
+			return fmt.Errorf("failed to remove %s from %s: %v", key, old.envFile(), err)
+		}
+	}
+
+	err = nm.updateManagedEnvList(func(managed *ManagedEnvVars) {
+		if target.File == "" && len(target.Restart) == 0 && len(target.Reload) == 0 {
+			delete(managed.Targets, key)
+			return
+		}
+		if managed.Targets == nil {
+			managed.Targets = map[string]EnvTarget{}
+		}
+		managed.Targets[key] = target
+	})
+	if err != nil {
+		return err
+	}
+
+	if !old.equal(target) {
+		value := lookup(vars, key)
+		nm.recordEnvChanges([]envChange{{key: key, old: value, new: value, secret: slices.Contains(secrets, key),
+			oldTarget: &old, newTarget: &target}})
+	}
+	return nil
+}
+
+// RestartEnvironmentUnits restarts or reloads the units depending on keys, each unit once.
+// A unit that is both restarted and reloaded is only restarted.
+func (nm *networkManager) RestartEnvironmentUnits(keys []string) []UnitResult {
+	targets, err := nm.GetEnvironmentTargets()
+	if err != nil {
+		return []UnitResult{{Action: "restart", Error: err.Error()}}
+	}
+
+	var restart, reload []string
+	for _, key := range keys {
+		for _, unit := range targets[key].Restart {
+			if !slices.Contains(restart, unit) {
+				restart = append(restart, unit)
+			}
+		}
+	}
+	for _, key := range keys {
+		for _, unit := range targets[key].Reload {
+			if !slices.Contains(restart, unit) && !slices.Contains(reload, unit) {
+				reload = append(reload, unit)
+			}
+		}
+	}
+
+	results := []UnitResult{}
+	for _, unit := range restart {
+		results = append(results, runUnitAction("restart", unit))
+	}
+	for _, unit := range reload {
+		results = append(results, runUnitAction("reload", unit))
+	}
+	return results
+}
+
+func runUnitAction(action, unit string) UnitResult {
+	ctx, cancel := context.WithTimeout(context.Background(), unitTimeout)
+	defer cancel()
+
+	result := UnitResult{Unit: unit, Action: action}
+	if output, err := exec.CommandContext(ctx, "systemctl", action, unit).CombinedOutput(); err != nil {
+		result.Error = strings.TrimSpace(string(output))
+		if result.Error == "" {
+			result.Error = err.Error()
+		}
+	}
+	return result
+}
@@ -1,37 +1,82 @@
 package networkmanager
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
+	"context"
 	"fmt"
 	"log"
 	"math/rand"
-	"os"
 	"os/exec"
-	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/ztkent/pifi/state"
 	"golang.org/x/text/cases"
 	"golang.org/x/text/language"
 )
 
 const (
-	ModeClient   = "client"
-	ModeAP       = "ap"
-	passwordFile = "/etc/default/pifi_env_password"
+	ModeClient = "client"
+	ModeAP     = "ap"
+
+	DefaultInterface       = "wlan0"
+	DefaultAPSSIDPrefix    = "PiFi-AP-"
+	DefaultAPBand          = "bg"
+	DefaultMonitorInterval = 60 * time.Second
+	DefaultDeviceKeyFile   = "/etc/pifi/device.key"
+	DefaultSecretEnvFile   = "/run/pifi/secrets.env"
+	DefaultEnvSchemaFile   = "/etc/pifi/env_schema.yaml"
+
+	// Range of connection priorities, higher ones are preferred when several saved networks are in range
+	MinPriority = -999
+	MaxPriority = 999
 )
 
+// DefaultEnvSources are read for managed variables their target file doesn't set, the EnvironmentFile of pifi.service
+var DefaultEnvSources = []string{"/etc/default/pifi"}
+
+// Options configures the WiFi device, access point and files used by the NetworkManager
+type Options struct {
+	Interface       string        // WiFi interface used for both client and AP mode
+	APSSIDPrefix    string        // The AP SSID is this prefix followed by 4 random characters
+	APBand          string        // "bg" for 2.4GHz or "a" for 5GHz
+	MonitorInterval time.Duration // How often ManageOfflineAP checks the connection
+	EncryptSecrets  bool          // Keep secret values encrypted instead of in /etc/environment
+	DeviceKeyFile   string        // Key secrets are encrypted with, generated on first use
+	SecretEnvFile   string        // Where encrypted secrets are decrypted to when applied, on tmpfs by default
+	EnvSchemaFile   string        // Optional schema environment variables are validated against
+	EnvSources      []string      // Files read, in order, for managed variables their target file doesn't set
+	State           *state.Store  // Password, managed variables, secrets and history
+}
+
+// DefaultOptions returns the options used by New
+func DefaultOptions() Options {
+	return Options{
+		Interface:       DefaultInterface,
+		APSSIDPrefix:    DefaultAPSSIDPrefix,
+		APBand:          DefaultAPBand,
+		MonitorInterval: DefaultMonitorInterval,
+		DeviceKeyFile:   DefaultDeviceKeyFile,
+		SecretEnvFile:   DefaultSecretEnvFile,
+		EnvSchemaFile:   DefaultEnvSchemaFile,
+		EnvSources:      DefaultEnvSources,
+		State:           state.New(state.DefaultFile, state.DefaultLegacy),
+	}
+}
+
 type NetworkStatus struct {
 	State        string
 	Connectivity string
 	WifiHW       string
 	Wifi         string
 	WifiSSID     string
-	APSSID       string
-	SignalStr    int32
-	Mode         string
-	IPs          NetworkIPs
+	// WifiConnection is the name of the active WiFi connection, which can differ from its SSID
+	WifiConnection string
+	APSSID         string
+	SignalStr      int32
+	Mode           string
+	IPs            NetworkIPs
 }
 
 type NetworkIPs struct {
@@ -48,48 +93,134 @@ type ConnectionInfo struct {
 	Password string
 }
 
+// SavedConnection is a saved WiFi network with its password, as kept in backups
+type SavedConnection struct {
+	SSID        string `json:"ssid"`
+	Password    string `json:"password,omitempty"`
+	AutoConnect bool   `json:"autoConnect"`
+	Priority    int    `json:"priority,omitempty"`
+}
+
+// APSettings are the settings of the access point that can change while PiFi runs
+type APSettings struct {
+	Band string `json:"band"` // "bg" for 2.4GHz or "a" for 5GHz
+}
+
 type NetworkManager interface {
 	SetupAPConnection() error
-	ManageOfflineAP(connectionLossTimeout time.Duration) error
+	ManageOfflineAP(ctx context.Context, connectionLossTimeout time.Duration) error
 
 	// Network Status
 	GetNetworkStatus() (NetworkStatus, error)
 	SetWifiMode(mode string) error
 
-	// Network Configuration
+	// Network Configuration, ModifyNetworkConnection and ConnectNetwork fail with a *ConnectionError
 	FindAvailableNetworks() ([]string, error)
 	GetConfiguredConnections() ([]ConnectionInfo, error)
+	GetSavedConnections() ([]SavedConnection, error) // Passwords are returned in full
 	ModifyNetworkConnection(ssid, password string, autoConnect bool) error
 	RemoveNetworkConnection(ssid string) error
 	SetAutoConnectConnection(ssid string, autoConnect bool) error
+	SetConnectionPriority(ssid string, priority int) error
 	ConnectNetwork(ssid string) error
-
-	// Environment Management
+	GetAPSettings() (APSettings, error)
+	SetAPSettings(settings APSettings) error
+
+	// Environment Management, values of secrets are returned in full and must be masked by callers.
+	// Values are read from the file each variable is written to, GetEnvironmentProvenance tells which,
+	// and which running processes still have another value.
+	// Changes are written to the target file of each variable, call RestartEnvironmentUnits with the
+	// changed keys afterwards to restart the units that read them.
+	// Values are validated against the environment schema, failing with an *EnvValidationError.
 	GetEnvironmentVariables() (map[string]string, error)
+	GetEnvironmentSecrets() ([]string, error)
+	GetEnvironmentTargets() (map[string]EnvTarget, error)
+	GetEnvironmentProvenance() (map[string]EnvProvenance, error)
+	GetEnvironmentSchema() (*EnvSchema, error)
+	ValidateEnvironmentVariable(key, value string) error
 	SetEnvironmentVariable(key, value string) error
+	SetSecretEnvironmentVariable(key, value string) error
+	SetEnvironmentTarget(key string, target EnvTarget) error
 	UnsetEnvironmentVariable(key string) error
+	ApplyEnvironment(set map[string]string, unset []string) error
+	ApplyEnvironmentSecrets() error
+	EnvFingerprint(vars map[string]string) (string, error)
+	LoadEnvironment() error
+	RestartEnvironmentUnits(keys []string) []UnitResult
+
+	// Every change is recorded as a revision, attributed to the actor set with WithActor
+	WithActor(actor string) NetworkManager
+	GetEnvironmentHistory(key string) ([]EnvRevision, error)
+	RollbackEnvironment(revision int, key string) (EnvRollback, error)
 	SetEnvPassword(password string) error
 	RemoveEnvPassword() error
 	ValidateEnvPassword(password string) (bool, error)
-	IsEnvPasswordSet() bool
+	IsEnvPasswordSet() (bool, error)
 }
 
 type networkManager struct {
 	status NetworkStatus
+	opts   Options
+	actor  string // Recorded as the author of environment changes
 }
 
 func New() NetworkManager {
+	return NewWithOptions(DefaultOptions())
+}
+
+// NewWithOptions creates a NetworkManager, unset options fall back to their defaults
+func NewWithOptions(opts Options) NetworkManager {
+	defaults := DefaultOptions()
+	if opts.Interface == "" {
+		opts.Interface = defaults.Interface
+	}
+	if opts.APSSIDPrefix == "" {
+		opts.APSSIDPrefix = defaults.APSSIDPrefix
+	}
+	if opts.APBand == "" {
+		opts.APBand = defaults.APBand
+	}
+	if opts.MonitorInterval <= 0 {
+		opts.MonitorInterval = defaults.MonitorInterval
+	}
+	if opts.DeviceKeyFile == "" {
+		opts.DeviceKeyFile = defaults.DeviceKeyFile
+	}
+	if opts.SecretEnvFile == "" {
+		opts.SecretEnvFile = defaults.SecretEnvFile
+	}
+	if opts.EnvSchemaFile == "" {
+		opts.EnvSchemaFile = defaults.EnvSchemaFile
+	}
+	if opts.EnvSources == nil {
+		opts.EnvSources = defaults.EnvSources
+	}
+	if opts.State == nil {
+		opts.State = defaults.State
+	}
+	// Reads fail until the state file can be migrated, rather than importing the legacy files every time
+	if err := opts.State.Migrate(); err != nil {
+		log.Printf("Warning: failed to migrate the state file: %v", err)
+	}
+
 	nm := &networkManager{
 		status: NetworkStatus{
-			APSSID: "PiFi-AP-" + randSeq(4),
+			APSSID: opts.APSSIDPrefix + randSeq(apSuffixLen),
 		},
+		opts: opts,
 	}
 	nm.GetNetworkStatus()
 	return nm
 }
 
+// The AP SSID ends in apSuffixLen random characters from apSuffixLetters
+const (
+	apSuffixLen     = 4
+	apSuffixLetters = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+)
+
 func randSeq(n int) string {
-	var letters = []rune("ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
+	var letters = []rune(apSuffixLetters)
 	b := make([]rune, n)
 	for i := range b {
 		b[i] = letters[rand.Intn(len(letters))]
@@ -126,15 +257,16 @@ func (nm *networkManager) GetNetworkStatus() (NetworkStatus, error) {
 
 	setCase := cases.Title(language.English)
 	networkStatus := NetworkStatus{
-		APSSID:       nm.status.APSSID,
-		State:        setCase.String(state),
-		Connectivity: setCase.String(connectivity),
-		WifiHW:       setCase.String(wifiHW),
-		Wifi:         setCase.String(wifi),
-		WifiSSID:     getWifiSSID(),
-		SignalStr:    getWifiSignal(),
-		Mode:         getWifiMode(nm.status.APSSID),
-		IPs:          getNetworkIps(),
+		APSSID:         nm.status.APSSID,
+		State:          setCase.String(state),
+		Connectivity:   setCase.String(connectivity),
+		WifiHW:         setCase.String(wifiHW),
+		Wifi:           setCase.String(wifi),
+		WifiSSID:       getWifiSSID(),
+		WifiConnection: getWifiConnection(),
+		SignalStr:      getWifiSignal(),
+		Mode:           getWifiMode(nm.status.APSSID),
+		IPs:            getNetworkIps(nm.opts.Interface),
 	}
 	nm.status = networkStatus
 	return networkStatus, nil
@@ -194,7 +326,7 @@ func (nm *networkManager) SetWifiMode(mode string) error {
 	return nil
 }
 
-// Creates a new AP connection for wlan0 if it doesn't exist
+// Creates a new AP connection on the WiFi interface if it doesn't exist
 func (nm *networkManager) SetupAPConnection() error {
 	// Check if AP connection already exists
 	cmd := exec.Command("nmcli", "connection", "show", nm.status.APSSID)
@@ -202,20 +334,20 @@ func (nm *networkManager) SetupAPConnection() error {
 		return nil
 	}
 
-	// Remove all existing AP interfaces, PiFi-AP-*
-	removeExistingAPs()
+	// Remove the APs of earlier runs, PiFi-AP-XXXX
+	removeExistingAPs(nm.opts.APSSIDPrefix)
 
 	// Create AP connection with required settings
 	cmd = exec.Command("nmcli", "connection", "add",
 		"type", "wifi",
-		"ifname", "wlan0",
+		"ifname", nm.opts.Interface,
 		"con-name", nm.status.APSSID,
 		"autoconnect", "no",
 		"ssid", nm.status.APSSID,
 		"mode", "ap",
 		"ipv4.method", "shared",
 		"ipv6.method", "disabled",
-		"802-11-wireless.band", "bg",
+		"802-11-wireless.band", nm.opts.APBand,
 	)
 
 	output, err := cmd.CombinedOutput()
@@ -291,6 +423,37 @@ func (nm *networkManager) GetConfiguredConnections() ([]ConnectionInfo, error) {
 	return connections, nil
 }
 
+// GetSavedConnections returns the saved WiFi networks with their passwords, leaving out access points
+func (nm *networkManager) GetSavedConnections() ([]SavedConnection, error) {
+	output, err := exec.Command("nmcli", "-t", "-f", "NAME,TYPE", "connection", "show").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list configured connections: %v", err)
+	}
+
+	connections := make([]SavedConnection, 0)
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := splitTerse(line)
+		if len(fields) < 2 || fields[1] != "802-11-wireless" {
+			continue
+		}
+		name := fields[0]
+		// -s shows the password, which nmcli otherwise hides
+		output, err := exec.Command("nmcli", "-s", "-g",
+			"802-11-wireless.mode,connection.autoconnect,connection.autoconnect-priority,802-11-wireless-security.psk",
+			"connection", "show", name).Output()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read connection %s: %v", name, err)
+		}
+		values := splitTerse(strings.TrimRight(string(output), "\n"))
+		if len(values) < 4 || values[0] == "ap" {
+			continue
+		}
+		priority, _ := strconv.Atoi(values[2])
+		connections = append(connections, SavedConnection{SSID: name, AutoConnect: values[1] == "yes", Priority: priority, Password: values[3]})
+	}
+	return connections, nil
+}
+
 // Modify a connection if it exists, otherwise create a new one
 func (nm *networkManager) ModifyNetworkConnection(ssid, password string, autoConnect bool) error {
 	checkCmd := exec.Command("nmcli", "connection", "show", ssid)
@@ -307,7 +470,7 @@ func (nm *networkManager) ModifyNetworkConnection(ssid, password string, autoCon
 
 		cmd := exec.Command("nmcli", args...)
 		if output, err := cmd.CombinedOutput(); err != nil {
-			return fmt.Errorf("failed to modify connection: %v\nOutput: %s", err, output)
+			return diagnose("save", ssid, output, err)
 		}
 		return nil
 	}
@@ -316,7 +479,7 @@ func (nm *networkManager) ModifyNetworkConnection(ssid, password string, autoCon
 	args := []string{
 		"connection", "add",
 		"type", "wifi",
-		"ifname", "wlan0",
+		"ifname", nm.opts.Interface,
 		"con-name", ssid,
 		"autoconnect", map[bool]string{true: "yes", false: "no"}[autoConnect],
 		"ssid", ssid,
@@ -330,7 +493,7 @@ func (nm *networkManager) ModifyNetworkConnection(ssid, password string, autoCon
 
 	cmd := exec.Command("nmcli", args...)
 	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to create connection: %v\nOutput: %s", err, output)
+		return diagnose("save", ssid, output, err)
 	}
 
 	return nil
@@ -364,37 +527,123 @@ func (nm *networkManager) SetAutoConnectConnection(ssid string, autoConnect bool
 	return nil
 }
 
+// SetConnectionPriority sets the priority of a saved network, higher ones are connected to first
+func (nm *networkManager) SetConnectionPriority(ssid string, priority int) error {
+	if priority < MinPriority || priority > MaxPriority {
+		return fmt.Errorf("priority %d is out of range, use %d to %d", priority, MinPriority, MaxPriority)
+	}
+	output, err := exec.Command("nmcli", "connection", "modify", ssid,
+		"connection.autoconnect-priority", strconv.Itoa(priority)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to set the priority of %s: %v\nOutput: %s", ssid, err, output)
+	}
+	return nil
+}
+
+// GetAPSettings returns the settings of the AP connection
+func (nm *networkManager) GetAPSettings() (APSettings, error) {
+	output, err := exec.Command("nmcli", "-g", "802-11-wireless.band", "connection", "show", nm.status.APSSID).Output()
+	if err != nil {
+		return APSettings{}, fmt.Errorf("failed to read AP connection %s: %v", nm.status.APSSID, err)
+	}
+	return APSettings{Band: strings.TrimSpace(string(output))}, nil
+}
+
+// SetAPSettings changes the AP connection, reactivating it if the AP is up
+func (nm *networkManager) SetAPSettings(settings APSettings) error {
+	if settings.Band != "bg" && settings.Band != "a" {
+		return fmt.Errorf("AP band %q must be bg or a", settings.Band)
+	}
+	if err := verifyAPConnection(nm.status.APSSID); err != nil {
+		return err
+	}
+	output, err := exec.Command("nmcli", "connection", "modify", nm.status.APSSID,
+		"802-11-wireless.band", settings.Band).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to change AP connection: %v\nOutput: %s", err, output)
+	}
+	if getWifiMode(nm.status.APSSID) == ModeAP {
+		if output, err := exec.Command("nmcli", "connection", "up", nm.status.APSSID).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to restart the AP: %v\nOutput: %s", err, output)
+		}
+	}
+	return nil
+}
+
 // Connect to a saved network by name
 func (nm *networkManager) ConnectNetwork(ssid string) error {
 	cmd := exec.Command("nmcli", "connection", "up", ssid)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("failed to connect to %s: %v\nOutput: %s", ssid, err, output)
+		return diagnose("connect to", ssid, output, err)
 	}
 	return nil
 }
 
-// Get environment variables - now returns only managed variables
+// GetEnvironmentVariables returns the managed variables that are set, as they are on disk
 func (nm *networkManager) GetEnvironmentVariables() (map[string]string, error) {
-	return getManagedEnvironmentVariables()
+	vars, _, err := nm.readEnvironment()
+	return vars, err
 }
 
 // Set environment variable and add to managed list
 func (nm *networkManager) SetEnvironmentVariable(key, value string) error {
+	return nm.setEnvironmentVariable(key, value, false)
+}
+
+// setEnvironmentVariable sets a variable, replacing a secret with a plain value or the other way around
+func (nm *networkManager) setEnvironmentVariable(key, value string, secret bool) error {
 	if key == "" {
 		return fmt.Errorf("environment variable key cannot be empty")
 	}
+	schema, err := nm.GetEnvironmentSchema()
+	if err != nil {
+		return err
+	}
+	if err := schema.Validate(key, value); err != nil {
+		return err
+	}
+	// Variables the schema declares secret can't be set in plain text
+	if v, ok := schema.Lookup(key); ok && v.Secret {
+		secret = true
+	}
+	// Nothing is written unless the managed list can be updated afterwards
+	target, err := nm.envTarget(key)
+	if err != nil {
+		return err
+	}
+	old, secrets := nm.envSnapshot()
 
-	// Set the environment variable
-	if err := setSystemEnv(key, value); err != nil {
-		return fmt.Errorf("failed to set environment variable: %v", err)
+	file := target.envFile()
+	if secret && nm.opts.EncryptSecrets {
+		if !validEnvKey(key) {
+			return fmt.Errorf("invalid environment variable key %q, use letters, digits and underscores", key)
+		}
+		if err := nm.updateSecretStore(key, &value); err != nil {
+			return fmt.Errorf("failed to store secret: %v", err)
+		}
+		// Remove a plaintext copy from before the variable was a secret
+		if err := removeFileEnv(file, key); err != nil {
+			return fmt.Errorf("failed to remove plaintext value of %s: %v", key, err)
+		}
+	} else {
+		// Set the environment variable
+		if err := setFileEnv(file, key, value); err != nil {
+			return fmt.Errorf("failed to set environment variable: %v", err)
+		}
+		if err := nm.updateSecretStore(key, nil); err != nil {
+			return fmt.Errorf("failed to remove encrypted value of %s: %v", key, err)
+		}
 	}
 
-	// Add to managed list
-	if err := addToManagedList(key); err != nil {
-		log.Printf("Warning: failed to add %s to managed list: %v", key, err)
-		// Don't fail the whole operation, just log the warning
+	// Add to managed list, the state was readable above so a failure here is a failed write
+	if err := nm.addToManagedList(key, secret); err != nil {
+		return fmt.Errorf("failed to add %s to managed list: %v", key, err)
 	}
+	if err := nm.ApplyEnvironmentSecrets(); err != nil {
+		return fmt.Errorf("failed to apply secrets: %v", err)
+	}
+	nm.recordEnvChanges([]envChange{{key: key, old: lookup(old, key), new: &value, secret: secret || slices.Contains(secrets, key)}})
 
 	log.Printf("Environment variable %s set and added to managed list", key)
 	return nil
@@ -405,28 +654,44 @@ func (nm *networkManager) UnsetEnvironmentVariable(key string) error {
 	if key == "" {
 		return fmt.Errorf("environment variable key cannot be empty")
 	}
+	// Nothing is removed unless the file the variable is written to is known
+	target, err := nm.envTarget(key)
+	if err != nil {
+		return err
+	}
+	old, secrets := nm.envSnapshot()
 
 	// Remove the environment variable
-	if err := removeSystemEnv(key); err != nil {
-		log.Printf("Warning: failed to remove environment variable %s: %v", key, err)
+	if err := removeFileEnv(target.envFile(), key); err != nil {
+		return fmt.Errorf("failed to remove environment variable %s: %v", key, err)
 	}
 
 	// Remove from managed list
-	if err := removeFromManagedList(key); err != nil {
-		log.Printf("Warning: failed to remove %s from managed list: %v", key, err)
+	if err := nm.removeFromManagedList(key); err != nil {
+		return fmt.Errorf("failed to remove %s from managed list: %v", key, err)
+	}
+	if err := nm.updateSecretStore(key, nil); err != nil {
+		return fmt.Errorf("failed to remove encrypted value of %s: %v", key, err)
 	}
+	if err := nm.ApplyEnvironmentSecrets(); err != nil {
+		return fmt.Errorf("failed to apply secrets: %v", err)
+	}
+	nm.recordEnvChanges([]envChange{{key: key, old: lookup(old, key), secret: slices.Contains(secrets, key)}})
 
 	log.Printf("Environment variable %s removed and deleted from managed list", key)
 	return nil
 }
 
 // Enable the AP if there's no internet connection for a certain amount of time. This will run in the background.
-func (nm *networkManager) ManageOfflineAP(connectionLossTimeout time.Duration) error {
+// It returns the context error once ctx is cancelled.
+func (nm *networkManager) ManageOfflineAP(ctx context.Context, connectionLossTimeout time.Duration) error {
 	for {
 		apMode := getWifiMode(nm.status.APSSID)
 		if !nm.checkWlanConnection() && apMode != "ap" {
 			log.Println("Device offline, waiting for recovery...")
-			time.Sleep(connectionLossTimeout)
+			if err := sleepContext(ctx, connectionLossTimeout); err != nil {
+				return err
+			}
 			if !nm.checkWlanConnection() {
 				log.Println("No connection after timeout, enabling AP mode")
 				if err := nm.ConnectNetwork(nm.status.APSSID); err != nil {
@@ -436,7 +701,21 @@ func (nm *networkManager) ManageOfflineAP(connectionLossTimeout time.Duration) e
 				log.Println("Device connection recovered")
 			}
 		}
-		time.Sleep(60 * time.Second)
+		if err := sleepContext(ctx, nm.opts.MonitorInterval); err != nil {
+			return err
+		}
+	}
+}
+
+// sleepContext waits for d, returning early with the context error if ctx is cancelled
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
 	}
 }
 
@@ -446,105 +725,83 @@ func (nm *networkManager) SetEnvPassword(password string) error {
 	}
 
 	// Hash the password
-	hash := sha256.Sum256([]byte(password))
-	hashedPassword := hex.EncodeToString(hash[:])
-
-	// Try to write to system location first, fallback to user directory
-	if err := writePasswordFile(passwordFile, hashedPassword); err != nil {
-		homeDir, homeErr := os.UserHomeDir()
-		if homeErr != nil {
-			return fmt.Errorf("failed to set password: no write access to system files and cannot determine home directory")
-		}
-
-		userPasswordFile := filepath.Join(homeDir, ".pifi_env_password")
-		if err := writePasswordFile(userPasswordFile, hashedPassword); err != nil {
-			return fmt.Errorf("failed to set password: %v", err)
-		}
+	hashedPassword, err := HashPassword(password)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %v", err)
 	}
 
+	if err := nm.writeEnvPassword(hashedPassword); err != nil {
+		return fmt.Errorf("failed to set password: %v", err)
+	}
 	return nil
 }
 
 // RemoveEnvPassword removes the password protection
 func (nm *networkManager) RemoveEnvPassword() error {
-	// Try to remove from both system and user locations
-	systemRemoved := os.Remove(passwordFile) == nil
-
-	homeDir, err := os.UserHomeDir()
-	userRemoved := false
-	if err == nil {
-		userPasswordFile := filepath.Join(homeDir, ".pifi_env_password")
-		userRemoved = os.Remove(userPasswordFile) == nil
-	}
-
-	if !systemRemoved && !userRemoved {
-		return fmt.Errorf("no password file found to remove")
-	}
-
-	return nil
+	return nm.opts.State.Update(func(tx *state.Tx) error {
+		var hash string
+		if err := tx.Get(state.SectionEnvPassword, &hash); err != nil {
+			return err
+		}
+		if hash == "" {
+			return fmt.Errorf("no environment password set")
+		}
+		tx.Delete(state.SectionEnvPassword)
+		return nil
+	})
 }
 
-// ValidateEnvPassword validates the provided password against the stored hash
+// ValidateEnvPassword validates the provided password against the stored hash.
+// Legacy SHA-256 hashes are upgraded to scrypt after a successful validation.
 func (nm *networkManager) ValidateEnvPassword(password string) (bool, error) {
-	// Try system location first
-	if hash, err := readPasswordFile(passwordFile); err == nil {
-		return validatePassword(password, hash), nil
-	}
-
-	// Try user location
-	homeDir, err := os.UserHomeDir()
+	hash, err := nm.readEnvPassword()
 	if err != nil {
-		return false, fmt.Errorf("cannot determine home directory")
-	}
-
-	userPasswordFile := filepath.Join(homeDir, ".pifi_env_password")
-	if hash, err := readPasswordFile(userPasswordFile); err == nil {
-		return validatePassword(password, hash), nil
+		return false, err
 	}
 
-	return false, fmt.Errorf("no password file found")
-}
-
-// IsEnvPasswordSet checks if a password is currently set
-func (nm *networkManager) IsEnvPasswordSet() bool {
-	// Check system location
-	if _, err := readPasswordFile(passwordFile); err == nil {
-		return true
+	valid, needsUpgrade, err := VerifyPassword(password, hash)
+	if err != nil {
+		return false, err
 	}
 
-	// Check user location
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		return false
+	if valid && needsUpgrade {
+		if upgraded, err := HashPassword(password); err != nil {
+			log.Printf("Warning: failed to upgrade password hash: %v", err)
+		} else if err := nm.writeEnvPassword(upgraded); err != nil {
+			log.Printf("Warning: failed to upgrade password hash: %v", err)
+		} else {
+			log.Printf("Upgraded environment password hash")
+		}
 	}
 
-	userPasswordFile := filepath.Join(homeDir, ".pifi_env_password")
-	_, err = readPasswordFile(userPasswordFile)
-	return err == nil
+	return valid, nil
 }
 
-// Helper functions
-func writePasswordFile(filename, hashedPassword string) error {
-	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		return err
+// IsEnvPasswordSet checks if a password is currently set.
+// It fails if the state can't be read, callers must treat the environment as locked then.
+func (nm *networkManager) IsEnvPasswordSet() (bool, error) {
+	var hash string
+	if err := nm.opts.State.Get(state.SectionEnvPassword, &hash); err != nil {
+		return false, err
 	}
-	defer file.Close()
-
-	_, err = file.WriteString(hashedPassword)
-	return err
+	return hash != "", nil
 }
 
-func readPasswordFile(filename string) (string, error) {
-	data, err := os.ReadFile(filename)
-	if err != nil {
+// readEnvPassword returns the stored password hash
+func (nm *networkManager) readEnvPassword() (string, error) {
+	var hash string
+	if err := nm.opts.State.Get(state.SectionEnvPassword, &hash); err != nil {
 		return "", err
 	}
-	return strings.TrimSpace(string(data)), nil
+	if hash == "" {
+		return "", fmt.Errorf("no environment password set")
+	}
+	return hash, nil
 }
 
-func validatePassword(password, storedHash string) bool {
-	hash := sha256.Sum256([]byte(password))
-	providedHash := hex.EncodeToString(hash[:])
-	return providedHash == storedHash
+// writeEnvPassword stores the password hash
+func (nm *networkManager) writeEnvPassword(hash string) error {
+	return nm.opts.State.Update(func(tx *state.Tx) error {
+		return tx.Set(state.SectionEnvPassword, hash)
+	})
 }
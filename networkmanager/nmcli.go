@@ -12,7 +12,7 @@ import (
 func verifyAPConnection(apName string) error {
 	cmd := exec.Command("nmcli", "connection", "show", apName)
 	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("AP connection not configured. Run: sudo nmcli connection add type wifi ifname wlan0 con-name PiFi-AP autoconnect no ssid PiFi mode ap 802-11-wireless.band bg")
+		return fmt.Errorf("AP connection %s not configured, restart PiFi to recreate it", apName)
 	}
 	return nil
 }
@@ -77,14 +77,28 @@ func getWifiSSID() string {
 	return ""
 }
 
-func getNetworkIps() NetworkIPs {
+// getWifiConnection returns the name of the active WiFi connection, empty if there is none
+func getWifiConnection() string {
+	output, err := exec.Command("nmcli", "-t", "-f", "NAME,TYPE", "connection", "show", "--active").Output()
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		if fields := splitTerse(line); len(fields) == 2 && fields[1] == "802-11-wireless" {
+			return fields[0]
+		}
+	}
+	return ""
+}
+
+func getNetworkIps(wifiInterface string) NetworkIPs {
 	status := NetworkIPs{
 		WifiState: "offline",
 		EthState:  "offline",
 	}
 
 	// Check WiFi
-	if output, err := exec.Command("nmcli", "-g", "IP4.ADDRESS", "dev", "show", "wlan0").Output(); err == nil {
+	if output, err := exec.Command("nmcli", "-g", "IP4.ADDRESS", "dev", "show", wifiInterface).Output(); err == nil {
 		if ip := strings.TrimSpace(string(output)); ip != "" {
 			status.WifiIP = strings.Split(ip, "/")[0]
 			status.WifiState = "online"
@@ -105,7 +119,7 @@ func (nm *networkManager) pingTest() bool {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	cmd := exec.CommandContext(ctx, "ping", "-I", "wlan0", "-c", "1", "-W", "2", "1.1.1.1")
+	cmd := exec.CommandContext(ctx, "ping", "-I", nm.opts.Interface, "-c", "1", "-W", "2", "1.1.1.1")
 	return cmd.Run() == nil
 }
 
@@ -116,14 +130,16 @@ func (nm *networkManager) checkWlanConnection() bool {
 		return false
 	}
 	for _, line := range strings.Split(string(output), "\n") {
-		if strings.HasPrefix(line, "wlan0:connected") {
+		if strings.HasPrefix(line, nm.opts.Interface+":connected") {
 			return nm.pingTest()
 		}
 	}
 	return false
 }
 
-func removeExistingAPs() error {
+// removeExistingAPs deletes the access points earlier runs of PiFi created. Only AP mode connections
+// named ssidPrefix followed by a generated suffix are removed, never networks the user saved.
+func removeExistingAPs(ssidPrefix string) error {
 	// Get all connections
 	cmd := exec.Command("nmcli", "-t", "-f", "NAME", "connection", "show")
 	output, err := cmd.Output()
@@ -131,15 +147,52 @@ func removeExistingAPs() error {
 		return fmt.Errorf("failed to list connections: %v", err)
 	}
 
-	// Find and delete PiFi-AP-* connections
-	connections := strings.Split(string(output), "\n")
-	for _, conn := range connections {
-		if strings.HasPrefix(conn, "PiFi-AP-") {
-			deleteCmd := exec.Command("nmcli", "connection", "delete", conn)
-			if err := deleteCmd.Run(); err != nil {
-				return fmt.Errorf("failed to delete connection %s: %v", conn, err)
-			}
+	for _, conn := range strings.Split(string(output), "\n") {
+		name := strings.Join(splitTerse(conn), ":")
+		if !isGeneratedAPName(name, ssidPrefix) {
+			continue
+		}
+		mode, err := exec.Command("nmcli", "-g", "802-11-wireless.mode", "connection", "show", name).Output()
+		if err != nil || strings.TrimSpace(string(mode)) != ModeAP {
+			continue
+		}
+		deleteCmd := exec.Command("nmcli", "connection", "delete", name)
+		if err := deleteCmd.Run(); err != nil {
+			return fmt.Errorf("failed to delete connection %s: %v", name, err)
 		}
 	}
 	return nil
 }
+
+// isGeneratedAPName reports whether name is ssidPrefix followed by a suffix from randSeq
+func isGeneratedAPName(name, ssidPrefix string) bool {
+	suffix, ok := strings.CutPrefix(name, ssidPrefix)
+	if !ok || len(suffix) != apSuffixLen {
+		return false
+	}
+	for _, c := range suffix {
+		if !strings.ContainsRune(apSuffixLetters, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// splitTerse splits a line of nmcli terse output into its fields, unescaping \: and \\
+func splitTerse(line string) []string {
+	var fields []string
+	var field strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line):
+			i++
+			field.WriteByte(line[i])
+		case line[i] == ':':
+			fields = append(fields, field.String())
+			field.Reset()
+		default:
+			field.WriteByte(line[i])
+		}
+	}
+	return append(fields, field.String())
+}
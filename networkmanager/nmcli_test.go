@@ -0,0 +1,23 @@
+package networkmanager
+
+import "testing"
+
+func TestIsGeneratedAPName(t *testing.T) {
+	for _, tc := range []struct {
+		name, prefix string
+		want         bool
+	}{
+		{"PiFi-AP-7QX2", DefaultAPSSIDPrefix, true},
+		{"PiFi-AP-7QX", DefaultAPSSIDPrefix, false},
+		{"PiFi-AP-7QX2a", DefaultAPSSIDPrefix, false},
+		{"PiFi-AP-home", DefaultAPSSIDPrefix, false},
+		{"Home-AB12", "Home-", true},
+		{"Home WiFi", "Home", false},
+		{"HomeNetwork", "Home", false},
+		{"Office-AB12", "Home-", false},
+	} {
+		if got := isGeneratedAPName(tc.name, tc.prefix); got != tc.want {
+			t.Errorf("isGeneratedAPName(%q, %q) = %v, want %v", tc.name, tc.prefix, got, tc.want)
+		}
+	}
+}
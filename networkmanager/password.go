@@ -0,0 +1,96 @@
+package networkmanager
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Password hashes are stored as $scrypt$ln=<log2 N>,r=<r>,p=<p>$<salt>$<key>,
+// with the salt and key in unpadded base64.
+const (
+	scryptLogN    = 15
+	scryptR       = 8
+	scryptP       = 1
+	scryptKeyLen  = 32
+	scryptSaltLen = 16
+
+	// Hashes with higher parameters are rejected, so a tampered hash can't exhaust memory or CPU.
+	// They allow one step above the current defaults.
+	scryptMaxLogN = scryptLogN + 1
+	scryptMaxR    = scryptR
+	scryptMaxP    = scryptP * 2
+)
+
+// HashPassword derives a salted scrypt hash of the password
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, scryptSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %v", err)
+	}
+
+	key, err := scrypt.Key([]byte(password), salt, 1<<scryptLogN, scryptR, scryptP, scryptKeyLen)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s",
+		scryptLogN, scryptR, scryptP,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// VerifyPassword checks the password against an encoded hash.
+// needsUpgrade is set when the hash is a legacy SHA-256 digest or uses weaker parameters than the current defaults.
+func VerifyPassword(password, encoded string) (valid bool, needsUpgrade bool, err error) {
+	if !strings.HasPrefix(encoded, "$") {
+		return verifyLegacyPassword(password, encoded), true, nil
+	}
+
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 5 || parts[1] != "scrypt" {
+		return false, false, fmt.Errorf("unsupported password hash format")
+	}
+
+	var logN, r, p int
+	if _, err := fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &logN, &r, &p); err != nil {
+		return false, false, fmt.Errorf("invalid scrypt parameters: %v", err)
+	}
+	if logN < 1 || logN > scryptMaxLogN || r < 1 || r > scryptMaxR || p < 1 || p > scryptMaxP {
+		return false, false, fmt.Errorf("unsupported scrypt parameters: ln=%d,r=%d,p=%d", logN, r, p)
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false, false, fmt.Errorf("invalid salt encoding: %v", err)
+	}
+	storedKey, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, false, fmt.Errorf("invalid hash encoding: %v", err)
+	}
+	if len(salt) == 0 || len(salt) > 4*scryptSaltLen || len(storedKey) != scryptKeyLen {
+		return false, false, fmt.Errorf("invalid salt or hash length")
+	}
+
+	key, err := scrypt.Key([]byte(password), salt, 1<<logN, r, p, len(storedKey))
+	if err != nil {
+		return false, false, err
+	}
+
+	valid = subtle.ConstantTimeCompare(key, storedKey) == 1
+	needsUpgrade = logN < scryptLogN || r < scryptR || p < scryptP
+	return valid, needsUpgrade, nil
+}
+
+// verifyLegacyPassword checks the password against an unsalted SHA-256 hex digest
+func verifyLegacyPassword(password, storedHash string) bool {
+	hash := sha256.Sum256([]byte(password))
+	providedHash := hex.EncodeToString(hash[:])
+	return subtle.ConstantTimeCompare([]byte(providedHash), []byte(storedHash)) == 1
+}
@@ -0,0 +1,66 @@
+package networkmanager
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestPasswordHash(t *testing.T) {
+	hash, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$scrypt$ln=15,r=8,p=1$") {
+		t.Errorf("hash = %s, want current scrypt parameters", hash)
+	}
+	if other, _ := HashPassword("correct horse"); other == hash {
+		t.Error("two hashes of the same password are equal, the salt isn't random")
+	}
+
+	if valid, upgrade, err := VerifyPassword("correct horse", hash); err != nil || !valid || upgrade {
+		t.Errorf("VerifyPassword(right) = %v, %v, %v", valid, upgrade, err)
+	}
+	if valid, _, err := VerifyPassword("wrong horse", hash); err != nil || valid {
+		t.Errorf("VerifyPassword(wrong) = %v, %v", valid, err)
+	}
+
+	// Legacy SHA-256 digests are accepted once and flagged for an upgrade
+	digest := sha256.Sum256([]byte("correct horse"))
+	if valid, upgrade, err := VerifyPassword("correct horse", hex.EncodeToString(digest[:])); err != nil || !valid || !upgrade {
+		t.Errorf("VerifyPassword(legacy) = %v, %v, %v", valid, upgrade, err)
+	}
+	// Hashes with weaker parameters are flagged too
+	parts := strings.Split(hash, "$")
+	parts[2] = "ln=10,r=8,p=1"
+	if _, upgrade, err := VerifyPassword("correct horse", strings.Join(parts, "$")); err != nil || !upgrade {
+		t.Errorf("VerifyPassword(weak) upgrade = %v, %v", upgrade, err)
+	}
+}
+
+func TestPasswordHashMalformed(t *testing.T) {
+	hash, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(hash, "$")
+	salt, key := parts[3], parts[4]
+
+	for name, hash := range map[string]string{
+		"unknown algorithm": "$bcrypt$ln=15,r=8,p=1$" + salt + "$" + key,
+		"missing part":      "$scrypt$ln=15,r=8,p=1$" + salt,
+		"bad parameters":    "$scrypt$n=15$" + salt + "$" + key,
+		"huge cost":         "$scrypt$ln=30,r=8,p=1$" + salt + "$" + key,
+		"huge block size":   "$scrypt$ln=15,r=1048576,p=1$" + salt + "$" + key,
+		"huge parallelism":  "$scrypt$ln=15,r=8,p=1000000$" + salt + "$" + key,
+		"zero block size":   "$scrypt$ln=15,r=0,p=1$" + salt + "$" + key,
+		"bad salt":          "$scrypt$ln=15,r=8,p=1$!!$" + key,
+		"empty salt":        "$scrypt$ln=15,r=8,p=1$$" + key,
+		"long key":          "$scrypt$ln=15,r=8,p=1$" + salt + "$" + strings.Repeat(key, 100),
+	} {
+		if valid, _, err := VerifyPassword("correct horse", hash); err == nil || valid {
+			t.Errorf("%s: VerifyPassword(%s) = %v, %v, want an error", name, hash, valid, err)
+		}
+	}
+}
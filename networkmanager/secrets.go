@@ -0,0 +1,209 @@
+package networkmanager
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ztkent/pifi/filestore"
+	"github.com/ztkent/pifi/state"
+)
+
+// secretStore is the state section holding the encrypted values of secret environment variables
+type secretStore struct {
+	// Secrets maps each variable to its AES-GCM encrypted value, nonce first, in base64
+	Secrets map[string]string `json:"secrets"`
+}
+
+// loadDeviceKey returns the key secrets are encrypted with, generating it on first use
+func loadDeviceKey(path string) ([]byte, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create device key directory: %v", err)
+	}
+
+	var encoded []byte
+	err := filestore.Update(path, 0600, func(data []byte) ([]byte, error) {
+		if len(data) == 0 {
+			key := make([]byte, 32)
+			if _, err := rand.Read(key); err != nil {
+				return nil, err
+			}
+			data = []byte(hex.EncodeToString(key) + "\n")
+		}
+		encoded = data
+		return data, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load device key: %v", err)
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("invalid device key in %s", path)
+	}
+	return key, nil
+}
+
+// secretCipher returns the AES-GCM cipher for the device key
+func (nm *networkManager) secretCipher() (cipher.AEAD, error) {
+	key, err := loadDeviceKey(nm.opts.DeviceKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// updateSecretStore stores value encrypted for key, or removes key if value is nil
+func (nm *networkManager) updateSecretStore(key string, value *string) error {
+	update, err := nm.secretStoreUpdate(map[string]*string{key: value})
+	if err != nil {
+		return err
+	}
+	return nm.opts.State.Update(update)
+}
+
+// secretStoreUpdate returns the update of the state that stores every value of changes
+// encrypted, and removes the keys whose value is nil
+func (nm *networkManager) secretStoreUpdate(changes map[string]*string) (func(tx *state.Tx) error, error) {
+	sealed := make(map[string]string)
+	var aead cipher.AEAD
+	for key, value := range changes {
+		if value == nil {
+			continue
+		}
+		if aead == nil {
+			var err error
+			if aead, err = nm.secretCipher(); err != nil {
+				return nil, err
+			}
+		}
+		var err error
+		if sealed[key], err = sealSecret(aead, key, *value); err != nil {
+			return nil, err
+		}
+	}
+
+	return func(tx *state.Tx) error {
+		store := secretStore{}
+		if err := tx.Get(state.SectionEnvSecrets, &store); err != nil {
+			return err
+		}
+		if store.Secrets == nil {
+			store.Secrets = map[string]string{}
+		}
+		changed := false
+		for key, value := range changes {
+			if value != nil {
+				store.Secrets[key] = sealed[key]
+				changed = true
+			} else if _, ok := store.Secrets[key]; ok {
+				delete(store.Secrets, key)
+				changed = true
+			}
+		}
+		if !changed {
+			return nil
+		}
+		return tx.Set(state.SectionEnvSecrets, store)
+	}, nil
+}
+
+// readSecretStore decrypts every stored secret
+func (nm *networkManager) readSecretStore() (map[string]string, error) {
+	var store secretStore
+	if err := nm.opts.State.Get(state.SectionEnvSecrets, &store); err != nil {
+		return nil, err
+	}
+	secrets := make(map[string]string, len(store.Secrets))
+	if len(store.Secrets) == 0 {
+		return secrets, nil
+	}
+
+	aead, err := nm.secretCipher()
+	if err != nil {
+		return nil, err
+	}
+	for key, sealed := range store.Secrets {
+		if secrets[key], err = openSecret(aead, key, sealed); err != nil {
+			return nil, err
+		}
+	}
+	return secrets, nil
+}
+
+// sealSecret encrypts the value of key, nonce first, in base64
+func sealSecret(aead cipher.AEAD, key, value string) (string, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	// The variable name is authenticated, so values can't be swapped between variables
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(value), []byte(key))), nil
+}
+
+// openSecret decrypts a value sealed by sealSecret
+func openSecret(aead cipher.AEAD, key, sealed string) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(raw) < aead.NonceSize() {
+		return "", fmt.Errorf("invalid encrypted value for %s", key)
+	}
+	value, err := aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], []byte(key))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt %s, was the device key replaced? %v", key, err)
+	}
+	return string(value), nil
+}
+
+// ApplyEnvironmentSecrets materializes the encrypted secrets into the secret env file and the
+// process environment. The file is rewritten from scratch, so removed secrets disappear from it.
+func (nm *networkManager) ApplyEnvironmentSecrets() error {
+	if !nm.opts.EncryptSecrets {
+		return nil
+	}
+	secrets, err := nm.readSecretStore()
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(secrets))
+	for key := range secrets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	env := parseEnvFile("# Written by PiFi from the encrypted secrets, changes are overwritten\n")
+	for _, key := range keys {
+		env.Set(key, secrets[key])
+		os.Setenv(key, secrets[key])
+	}
+
+	if err := os.MkdirAll(filepath.Dir(nm.opts.SecretEnvFile), 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %v", filepath.Dir(nm.opts.SecretEnvFile), err)
+	}
+	return filestore.Write(nm.opts.SecretEnvFile, []byte(env.String()), 0600)
+}
+
+// GetEnvironmentSecrets returns the managed variables whose values are secret
+func (nm *networkManager) GetEnvironmentSecrets() ([]string, error) {
+	managed, err := nm.readManagedEnvVars()
+	if err != nil {
+		return nil, err
+	}
+	return managed.Secrets, nil
+}
+
+// SetSecretEnvironmentVariable sets a variable whose value is masked in the UI and API.
+// With EncryptSecrets the value is kept encrypted and only written to the secret env file.
+func (nm *networkManager) SetSecretEnvironmentVariable(key, value string) error {
+	return nm.setEnvironmentVariable(key, value, true)
+}
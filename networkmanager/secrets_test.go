@@ -0,0 +1,61 @@
+package networkmanager
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSecretStore(t *testing.T) {
+	dir := t.TempDir()
+	nm := &networkManager{opts: Options{
+		EncryptSecrets: true,
+		State:          testState(t, ManagedEnvVars{}),
+		DeviceKeyFile:  filepath.Join(dir, "key", "device.key"),
+		SecretEnvFile:  filepath.Join(dir, "run", "secrets.env"),
+	}}
+	t.Setenv("PIFI_TEST_SECRET", "")
+
+	value := `p@ss "word" $HOME`
+	if err := nm.updateSecretStore("PIFI_TEST_SECRET", &value); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(nm.opts.State.Path()); strings.Contains(string(data), "word") {
+		t.Errorf("secret stored in plaintext: %s", data)
+	}
+	if info, err := os.Stat(nm.opts.DeviceKeyFile); err != nil {
+		t.Error(err)
+	} else if info.Mode().Perm() != 0600 {
+		t.Errorf("device key mode = %v, want 0600", info.Mode().Perm())
+	}
+
+	if err := nm.ApplyEnvironmentSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(nm.opts.SecretEnvFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := parseEnvFile(string(data)).Get("PIFI_TEST_SECRET"); got != value {
+		t.Errorf("secret env file has %q, want %q", got, value)
+	}
+	if got := os.Getenv("PIFI_TEST_SECRET"); got != value {
+		t.Errorf("process env has %q, want %q", got, value)
+	}
+
+	// A value sealed for one variable can't be read as another
+	store, _ := os.ReadFile(nm.opts.State.Path())
+	os.WriteFile(nm.opts.State.Path(), []byte(strings.Replace(string(store), "PIFI_TEST_SECRET", "PIFI_OTHER", 1)), 0600)
+	if _, err := nm.readSecretStore(); err == nil {
+		t.Error("readSecretStore accepted a value moved to another variable")
+	}
+	os.WriteFile(nm.opts.State.Path(), store, 0600)
+
+	if err := nm.updateSecretStore("PIFI_TEST_SECRET", nil); err != nil {
+		t.Fatal(err)
+	}
+	if secrets, err := nm.readSecretStore(); err != nil || len(secrets) != 0 {
+		t.Errorf("after removal = %v, %v", secrets, err)
+	}
+}
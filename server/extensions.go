@@ -0,0 +1,143 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/ztkent/pifi/html/handlers"
+)
+
+// Extension routes are mounted under these prefixes, so they can't shadow PiFi's own routes
+const (
+	extensionPath    = "/ext"
+	extensionAPIPath = "/api/ext"
+)
+
+var (
+	tabIDPattern    = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+	extensionMethod = regexp.MustCompile(`^[A-Z]+$`)
+)
+
+// Tab is a navigation tab added to the dashboard by an embedding application
+type Tab struct {
+	ID    string // Lowercase letters, digits and dashes, the HTML id is ext-<ID> so it can't clash with PiFi's own elements
+	Title string
+	Role  string // Minimum role that sees the tab and loads its cards, defaults to handlers.RoleViewer
+	Cards []Card
+}
+
+// Card is a panel on a Tab. PiFi draws the card frame and title, then loads the content from Handler with htmx.
+// The content can use the pifi-item, pifi-label, pifi-input, pifi-btn and pifi-btn-danger classes to match the dashboard.
+type Card struct {
+	Title   string
+	Path    string // Served at <base>/ext<Path>, such as /device for <base>/ext/device
+	Trigger string // htmx trigger that loads the card, defaults to "load"
+	Handler http.Handler
+}
+
+// AddTab adds a tab and serves its cards behind the tab's role.
+// Extensions must be registered before the Server handles requests.
+func (s *Server) AddTab(tab Tab) error {
+	if !tabIDPattern.MatchString(tab.ID) {
+		return fmt.Errorf("invalid tab id %q, use lowercase letters, digits and dashes", tab.ID)
+	}
+	for _, existing := range s.dashboard.Tabs {
+		if existing.ID == tab.ID {
+			return fmt.Errorf("tab %q already exists", tab.ID)
+		}
+	}
+	if tab.Title == "" {
+		return fmt.Errorf("tab %q needs a title", tab.ID)
+	}
+	if tab.Role == "" {
+		tab.Role = handlers.RoleViewer
+	}
+	if !validRole(tab.Role) {
+		return fmt.Errorf("invalid role %q", tab.Role)
+	}
+
+	dashboardTab := handlers.DashboardTab{ID: tab.ID, Title: tab.Title, Role: tab.Role}
+	for _, card := range tab.Cards {
+		if card.Trigger == "" {
+			card.Trigger = "load"
+		}
+		if err := s.HandlePage(http.MethodGet, card.Path, tab.Role, card.Handler); err != nil {
+			return fmt.Errorf("tab %q: %v", tab.ID, err)
+		}
+		dashboardTab.Cards = append(dashboardTab.Cards, handlers.DashboardCard{
+			Title:   card.Title,
+			Path:    strings.TrimPrefix(extensionPath, "/") + card.Path,
+			Trigger: card.Trigger,
+		})
+	}
+
+	s.dashboard.Tabs = append(s.dashboard.Tabs, dashboardTab)
+	return nil
+}
+
+// HandlePage serves a dashboard route at <base>/ext<path> for users with at least role.
+// Requests other than GET need the CSRF token, which htmx requests from the dashboard send automatically.
+func (s *Server) HandlePage(method, path, role string, handler http.Handler) error {
+	if err := validExtensionRoute(method, path, handler); err != nil {
+		return err
+	}
+	if !validRole(role) {
+		return fmt.Errorf("invalid role %q", role)
+	}
+
+	next := s.requireRole(role)(handler.ServeHTTP)
+	if method != http.MethodGet && method != http.MethodHead {
+		next = handlers.RequireCSRF(s.sessions)(next)
+	}
+	s.router.HandleFunc(extensionPath+path, next).Methods(method)
+	return nil
+}
+
+// HandleAPI serves a JSON API route at <base>/api/ext<path> for API tokens with scope, see handlers.TokenScopes
+func (s *Server) HandleAPI(method, path, scope string, handler http.Handler) error {
+	if !s.Enabled(FeatureAPI) {
+		return fmt.Errorf("the API is disabled")
+	}
+	if err := validExtensionRoute(method, path, handler); err != nil {
+		return err
+	}
+	if !validScope(scope) {
+		return fmt.Errorf("invalid scope %q", scope)
+	}
+
+	s.router.HandleFunc(extensionAPIPath+path, handlers.RequireSameOrigin(s.requireAPI(scope)(handler.ServeHTTP))).Methods(method)
+	return nil
+}
+
+func validExtensionRoute(method, path string, handler http.Handler) error {
+	if handler == nil {
+		return fmt.Errorf("route %s has no handler", path)
+	}
+	if !extensionMethod.MatchString(method) {
+		return fmt.Errorf("invalid method %q", method)
+	}
+	if !strings.HasPrefix(path, "/") || len(path) < 2 {
+		return fmt.Errorf("invalid path %q, it must start with /", path)
+	}
+	return nil
+}
+
+func validRole(role string) bool {
+	for _, r := range handlers.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func validScope(scope string) bool {
+	for _, s := range handlers.TokenScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// migrations[v] migrates the state from version v to v+1
+var migrations = []func(s *Store, tx *Tx) error{
+	importLegacy,
+}
+
+// importLegacy moves the separate files of earlier versions into the state file. The environment
+// password and managed variables could also have been written to the home directory.
+func importLegacy(s *Store, tx *Tx) error {
+	files := []struct {
+		section string
+		paths   []string
+		text    bool // Plain text instead of JSON
+	}{
+		{SectionEnvPassword, []string{s.legacy.EnvPassword, homeFile(".pifi_env_password")}, true},
+		{SectionManagedEnv, []string{s.legacy.ManagedEnvVars, homeFile(".pifi_managed_vars")}, false},
+	}
+
+	for _, f := range files {
+		for _, path := range f.paths {
+			if path == "" {
+				continue
+			}
+			data, err := os.ReadFile(path)
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return err
+			}
+
+			if _, ok := tx.sections[f.section]; !ok {
+				raw := json.RawMessage(data)
+				if f.text {
+					if raw, err = json.Marshal(strings.TrimSpace(string(data))); err != nil {
+						return err
+					}
+				} else if !json.Valid(data) {
+					return fmt.Errorf("%s is not valid JSON, fix or remove it", path)
+				}
+				tx.sections[f.section] = raw
+			}
+			// Every copy is moved aside, so none of them is read again
+			tx.migrated = append(tx.migrated, path)
+		}
+	}
+	return nil
+}
+
+// homeFile returns name in the home directory, empty if there is none
+func homeFile(name string) string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, name)
+}
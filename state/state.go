@@ -0,0 +1,202 @@
+// Package state keeps the data PiFi owns, such as the managed environment variables, API tokens and
+// users, in a single versioned JSON file. Every change is written atomically through filestore.
+// Files of earlier versions are imported once and renamed with a .migrated suffix.
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/ztkent/pifi/filestore"
+)
+
+const (
+	DefaultFile = "/var/lib/pifi/state.json"
+
+	// Version is the layout of the state file written by this version of PiFi
+	Version = 1
+
+	// MigratedSuffix is appended to the legacy files imported into the state file
+	MigratedSuffix = ".migrated"
+)
+
+// Sections of the state file, each owned by one package
+const (
+	SectionEnvPassword = "envPassword" // Hash of the environment password
+	SectionManagedEnv  = "managedEnv"  // Managed environment variables, their secrets and targets
+	SectionEnvSecrets  = "envSecrets"  // Encrypted values of secret environment variables
+	SectionEnvHistory  = "envHistory"  // Revisions of the managed environment variables
+	SectionAPITokens   = "apiTokens"
+	SectionUsers       = "users"
+)
+
+// Legacy names the files earlier versions kept the sections in, empty fields are skipped
+type Legacy struct {
+	EnvPassword    string
+	ManagedEnvVars string
+}
+
+// DefaultLegacy are the files earlier versions used by default
+var DefaultLegacy = Legacy{
+	EnvPassword:    "/etc/default/pifi_env_password",
+	ManagedEnvVars: "/etc/default/pifi_managed_vars",
+}
+
+// Store is the state file. Its sections are read and changed independently.
+type Store struct {
+	path   string
+	legacy Legacy
+}
+
+// New returns the store for the state file at path, the legacy files are imported when it is first written
+func New(path string, legacy Legacy) *Store {
+	return &Store{path: path, legacy: legacy}
+}
+
+// Path returns the location of the state file
+func (s *Store) Path() string {
+	return s.path
+}
+
+// Migrate creates the state file or brings it to the current version, importing the legacy files.
+// Call it at startup, so a state file that can't be written fails there.
+func (s *Store) Migrate() error {
+	return s.Update(func(*Tx) error { return nil })
+}
+
+// Get decodes section into v, leaving v unchanged if the section isn't set.
+// Until Migrate has run, every Get imports the legacy files again.
+func (s *Store) Get(section string, v interface{}) error {
+	data, err := os.ReadFile(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read the state file: %v", err)
+	}
+	tx, err := s.load(data)
+	if err != nil {
+		return err
+	}
+	return tx.Get(section, v)
+}
+
+// Update calls change with the current state and writes it if change returns without an error.
+// Other writers, in this process or another, wait until the state is written.
+func (s *Store) Update(change func(tx *Tx) error) error {
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create the state directory %s: %v", dir, err)
+	}
+
+	var migrated []string
+	var changeErr error // Errors of the state itself are returned as they are
+	err := filestore.Update(s.path, 0600, func(data []byte) ([]byte, error) {
+		tx, err := s.load(data)
+		if err == nil {
+			err = change(tx)
+		}
+		if err != nil {
+			changeErr = err
+			return nil, err
+		}
+		migrated = tx.migrated
+		return tx.encode(data)
+	})
+	if changeErr != nil {
+		return changeErr
+	} else if err != nil {
+		return fmt.Errorf("failed to write the state file %s: %v", s.path, err)
+	}
+
+	// The legacy files are only moved aside once their contents are safely in the state file
+	for _, file := range migrated {
+		if err := os.Rename(file, file+MigratedSuffix); err != nil {
+			log.Printf("Warning: failed to rename migrated %s: %v", file, err)
+		} else {
+			log.Printf("Migrated %s into %s", file, s.path)
+		}
+	}
+	return nil
+}
+
+// Tx is the state during an Update
+type Tx struct {
+	sections map[string]json.RawMessage
+	changed  bool
+	migrated []string // Legacy files imported by the migrations
+}
+
+// Get decodes section into v, leaving v unchanged if the section isn't set
+func (tx *Tx) Get(section string, v interface{}) error {
+	raw, ok := tx.sections[section]
+	if !ok {
+		return nil
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return fmt.Errorf("invalid %s section in the state file: %v", section, err)
+	}
+	return nil
+}
+
+// Set replaces section with v
+func (tx *Tx) Set(section string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tx.sections[section] = raw
+	tx.changed = true
+	return nil
+}
+
+// Delete removes section
+func (tx *Tx) Delete(section string) {
+	if _, ok := tx.sections[section]; ok {
+		delete(tx.sections, section)
+		tx.changed = true
+	}
+}
+
+// load decodes the state file and migrates it to the current version, a missing file is version 0
+func (s *Store) load(data []byte) (*Tx, error) {
+	tx := &Tx{sections: map[string]json.RawMessage{}}
+	version := 0
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &tx.sections); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", s.path, err)
+		}
+		if err := json.Unmarshal(tx.sections["version"], &version); err != nil {
+			return nil, fmt.Errorf("invalid version in %s", s.path)
+		}
+		delete(tx.sections, "version")
+	}
+	if version > Version {
+		return nil, fmt.Errorf("%s has version %d, this PiFi only knows up to version %d", s.path, version, Version)
+	}
+
+	for ; version < Version; version++ {
+		if err := migrations[version](s, tx); err != nil {
+			return nil, fmt.Errorf("failed to migrate %s to version %d: %v", s.path, version+1, err)
+		}
+		tx.changed = true
+	}
+	return tx, nil
+}
+
+// encode returns the state file, data unchanged if nothing changed
+func (tx *Tx) encode(data []byte) ([]byte, error) {
+	if !tx.changed {
+		return data, nil
+	}
+	doc := make(map[string]json.RawMessage, len(tx.sections)+1)
+	for section, raw := range tx.sections {
+		doc[section] = raw
+	}
+	doc["version"] = json.RawMessage(fmt.Sprint(Version))
+	out, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(out, '\n'), nil
+}
@@ -0,0 +1,72 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrateLegacy(t *testing.T) {
+	dir := t.TempDir()
+	legacy := Legacy{
+		EnvPassword:    filepath.Join(dir, "pifi_env_password"),
+		ManagedEnvVars: filepath.Join(dir, "pifi_managed_vars"),
+	}
+	t.Setenv("HOME", dir)
+	files := map[string]string{
+		legacy.EnvPassword:    "$scrypt$hash\n",
+		legacy.ManagedEnvVars: `{"variables":["A"]}`,
+	}
+	for file, content := range files {
+		if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := New(filepath.Join(dir, "lib", "state.json"), legacy)
+	if err := s.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	var password string
+	var managed struct{ Variables []string }
+	if err := s.Get(SectionEnvPassword, &password); err != nil || password != "$scrypt$hash" {
+		t.Errorf("password = %q, %v", password, err)
+	}
+	if err := s.Get(SectionManagedEnv, &managed); err != nil || len(managed.Variables) != 1 {
+		t.Errorf("managed = %+v, %v", managed, err)
+	}
+	for file := range files {
+		if _, err := os.Stat(file + MigratedSuffix); err != nil {
+			t.Errorf("%s wasn't moved aside: %v", file, err)
+		}
+	}
+
+	// A legacy file showing up again isn't imported over the state
+	os.WriteFile(legacy.EnvPassword, []byte("other"), 0600)
+	if err := s.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Get(SectionEnvPassword, &password); err != nil || password != "$scrypt$hash" {
+		t.Errorf("password after second migration = %q, %v", password, err)
+	}
+}
+
+func TestStateErrors(t *testing.T) {
+	dir := t.TempDir()
+	s := New(filepath.Join(dir, "state.json"), Legacy{})
+	if err := os.WriteFile(s.Path(), []byte(`{"version": 99}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Migrate(); err == nil || !strings.Contains(err.Error(), "version 99") {
+		t.Errorf("Migrate of a newer state file = %v", err)
+	}
+
+	// There's no fallback when the state directory can't be created
+	blocked := filepath.Join(dir, "file")
+	os.WriteFile(blocked, nil, 0600)
+	s = New(filepath.Join(blocked, "state.json"), Legacy{})
+	if err := s.Update(func(tx *Tx) error { return tx.Set(SectionUsers, []string{}) }); err == nil {
+		t.Error("Update succeeded without a state directory")
+	}
+}
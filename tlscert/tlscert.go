@@ -0,0 +1,204 @@
+// Package tlscert loads the certificate PiFi serves HTTPS with, generating a self-signed one on first boot.
+package tlscert
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultCertFile = "/etc/pifi/tls/pifi.crt"
+	DefaultKeyFile  = "/etc/pifi/tls/pifi.key"
+
+	// Address of the device while it runs the PiFi access point
+	apAddress    = "10.42.0.1"
+	certValidity = 10 * 365 * 24 * time.Hour
+)
+
+// LoadOrCreate loads the certificate and key from disk.
+// If neither file exists, a self-signed certificate for this device is generated and saved there.
+// A certificate PiFi generated earlier is reissued with the same key once it no longer covers the
+// hostname of the device, certificates from elsewhere are left alone. IPs handed out by DHCP
+// come and go, so they are only added when the certificate is issued and never reissue it.
+func LoadOrCreate(certFile, keyFile string) (tls.Certificate, error) {
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	regenerate := os.IsNotExist(certErr) && os.IsNotExist(keyErr)
+	if !regenerate {
+		if reason := outdated(certFile); reason != "" {
+			log.Printf("Replacing the self-signed certificate %s, %s", certFile, reason)
+			regenerate = true
+		}
+	}
+	if regenerate {
+		if err := generate(certFile, keyFile); err != nil {
+			return tls.Certificate{}, fmt.Errorf("failed to generate self-signed certificate: %v", err)
+		}
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to load certificate %s: %v", certFile, err)
+	}
+	return cert, nil
+}
+
+// Fingerprint returns the SHA-256 fingerprint of the leaf certificate, as colon separated hex
+func Fingerprint(cert tls.Certificate) string {
+	if len(cert.Certificate) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(cert.Certificate[0])
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// generate writes a self-signed certificate covering the hostname, its mDNS name and the current IPs.
+// An existing key is kept, so clients that pinned it keep trusting the device.
+func generate(certFile, keyFile string) error {
+	key, err := loadKey(keyFile)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	hostname := deviceHostname()
+	dnsNames, ips := subjectAltNames(hostname)
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hostname, Organization: []string{"PiFi"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(certValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  false, // Trusting it must not let the key on the device sign other certificates
+		DNSNames:              dnsNames,
+		IPAddresses:           ips,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(certFile), 0755); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(keyFile), 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// loadKey reads the EC key generate wrote earlier, or generates one if there is none
+func loadKey(keyFile string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(keyFile)
+	if os.IsNotExist(err) {
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	} else if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "EC PRIVATE KEY" {
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	return key, nil
+}
+
+// outdated returns why a certificate PiFi generated must be replaced, empty if it is current or
+// wasn't generated by PiFi
+func outdated(certFile string) string {
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		return ""
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return ""
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil || !generated(cert) {
+		return ""
+	}
+
+	if cert.IsCA {
+		return "it was issued as a CA certificate"
+	}
+	// Only the hostname is checked, the IPs change with every DHCP lease
+	dnsNames, _ := subjectAltNames(deviceHostname())
+	for _, name := range dnsNames {
+		if cert.VerifyHostname(name) != nil {
+			return fmt.Sprintf("it doesn't cover %s", name)
+		}
+	}
+	return ""
+}
+
+// generated reports whether cert is a self-signed certificate written by generate
+func generated(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) && slices.Equal(cert.Subject.Organization, []string{"PiFi"})
+}
+
+func deviceHostname() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return "pifi"
+	}
+	return hostname
+}
+
+func subjectAltNames(hostname string) ([]string, []net.IP) {
+	dnsNames := []string{hostname, hostname + ".local", "localhost"}
+	ips := []net.IP{net.ParseIP(apAddress), net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return dnsNames, ips
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if !ipNet.IP.Equal(net.ParseIP(apAddress)) {
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	return dnsNames, ips
+}
@@ -0,0 +1,131 @@
+package tlscert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadOrCreate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls", "pifi.crt"), filepath.Join(dir, "tls", "pifi.key")
+
+	cert, err := LoadOrCreate(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf.IsCA || leaf.KeyUsage&x509.KeyUsageCertSign != 0 {
+		t.Errorf("IsCA = %v, KeyUsage = %v, want a leaf that can't sign certificates", leaf.IsCA, leaf.KeyUsage)
+	}
+	for _, host := range []string{"localhost", apAddress, "127.0.0.1"} {
+		if err := leaf.VerifyHostname(host); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// A current certificate is kept
+	again, err := LoadOrCreate(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Fingerprint(again) != Fingerprint(cert) {
+		t.Error("current certificate was replaced")
+	}
+	if reason := outdated(certFile); reason != "" {
+		t.Errorf("outdated = %q for a new certificate", reason)
+	}
+}
+
+func TestLoadOrCreateReplacesOutdated(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		organization string
+		isCA         bool
+		replaced     bool
+	}{
+		{"generated for another hostname", "PiFi", false, true},
+		{"generated as a CA", "PiFi", true, true},
+		{"brought by the user", "Example", false, false},
+	} {
+		dir := t.TempDir()
+		certFile, keyFile := filepath.Join(dir, "pifi.crt"), filepath.Join(dir, "pifi.key")
+		writeCert(t, certFile, keyFile, tc.organization, tc.isCA, []string{"example.com"})
+		before, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cert, err := LoadOrCreate(certFile, keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if replaced := Fingerprint(cert) != Fingerprint(before); replaced != tc.replaced {
+			t.Errorf("%s: replaced = %v, want %v", tc.name, replaced, tc.replaced)
+		}
+		// A reissued certificate keeps the key
+		if key := cert.PrivateKey.(*ecdsa.PrivateKey); !key.Equal(before.PrivateKey) {
+			t.Errorf("%s: key was replaced", tc.name)
+		}
+	}
+}
+
+func TestLoadOrCreateIgnoresIPs(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "pifi.crt"), filepath.Join(dir, "pifi.key")
+	// A certificate issued before the device got its current DHCP lease
+	dnsNames, _ := subjectAltNames(deviceHostname())
+	writeCert(t, certFile, keyFile, "PiFi", false, dnsNames)
+	before, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := LoadOrCreate(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Fingerprint(cert) != Fingerprint(before) {
+		t.Error("certificate was replaced because it doesn't cover the current IPs")
+	}
+}
+
+// writeCert writes a self-signed certificate that only covers dnsNames
+func writeCert(t *testing.T, certFile, keyFile, organization string, isCA bool, dnsNames []string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "example.com", Organization: []string{organization}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+		DNSNames:              dnsNames,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}